@@ -3,11 +3,14 @@ package config
 import (
 	"errors"
 	"flag"
-	"io"
+	"fmt"
+	"io/fs"
 	"log"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
+	"sync"
 
 	"github.com/OnnaSoft/lipstick/helper"
 	"gopkg.in/yaml.v3"
@@ -18,22 +21,26 @@ type Config struct {
 	ServerURL string   `yaml:"server_url"` // URL of the server manager
 	ProxyPass []string `yaml:"proxy_pass"` // List of proxy targets
 	Workers   int      `yaml:"workers"`    // Number of worker routines
+	Ephemeral bool     `yaml:"ephemeral"`  // Request a server-assigned subdomain
+	Routes    []string `yaml:"routes"`     // Route groups served by this agent
 }
 
-var config *Config
+var (
+	config     *Config
+	configErr  error
+	configOnce sync.Once
+)
 
-// loadConfig reads the configuration file and merges it with CLI arguments
-func loadConfig() {
-	var (
-		configPath string
-		serverURL  string
-		proxyPass  string
-		apiSecret  string
-		workers    int
-	)
+// loadConfig builds the configuration from, in increasing precedence, the
+// defaults, the configuration file, the environment and the CLI arguments
+func loadConfig() (*Config, error) {
+	var configPath string
 
 	// Default configuration
-	result := Config{}
+	result := Config{
+		ServerURL: "http://localhost:5051",
+		ProxyPass: []string{"tcp://127.0.0.1:12000"},
+	}
 
 	// Set default configuration path relative to the executable's location
 	execDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
@@ -42,43 +49,71 @@ func loadConfig() {
 	}
 	defaultConfigPath := filepath.Join(execDir, "config.client.yml")
 
-	// CLI Flags
+	// CLI Flags, applied after the file and the environment
+	settings := helper.NewSettings(flag.CommandLine)
 	flag.StringVar(&configPath, "c", defaultConfigPath, "Path to the configuration file")
-	flag.StringVar(&serverURL, "s", "http://localhost:5051", "URL for the server manager WebSocket")
-	flag.StringVar(&proxyPass, "p", "tcp://127.0.0.1:12000", "Proxy targets separated by spaces")
-	flag.StringVar(&apiSecret, "k", "", "API secret for authenticating nodes")
+	settings.String(&result.ServerURL, "s", "SERVER_URL", "URL for the server manager WebSocket")
+	settings.List(&result.ProxyPass, "", "p", "PROXY_PASS", "Proxy targets separated by spaces")
+	settings.Secret(&result.APISecret, "k", "API_SECRET", "API secret for authenticating nodes")
+	settings.Bool(&result.Ephemeral, "e", "EPHEMERAL", "Request an ephemeral tunnel with a server-assigned subdomain")
+	settings.List(&result.Routes, ",", "r", "ROUTES", "Route groups served by this agent, separated by commas")
 	flag.Parse()
 
-	// Load YAML config file
-	if file, err := os.Open(configPath); err == nil {
-		defer file.Close()
-		content, err := io.ReadAll(file)
-		if err != nil {
-			log.Printf("Error reading config file: %v", err)
-		} else if err := yaml.Unmarshal(content, &result); err != nil {
-			log.Printf("Error parsing config file: %v", err)
+	var errs []error
+
+	// Load YAML config file; the default one may be missing
+	content, err := os.ReadFile(configPath)
+	if err == nil {
+		if err := yaml.Unmarshal(content, &result); err != nil {
+			errs = append(errs, fmt.Errorf("error parsing config file %s: %w", configPath, err))
 		}
+	} else if !errors.Is(err, fs.ErrNotExist) || configPath != defaultConfigPath {
+		errs = append(errs, fmt.Errorf("error reading config file: %w", err))
 	}
 
-	// Merge CLI arguments
-	result.ServerURL = helper.SetValue(serverURL, result.ServerURL).(string)
-	if proxyPass != "" {
-		result.ProxyPass = strings.Fields(proxyPass)
+	// Merge the environment and CLI arguments
+	if err := settings.Apply(); err != nil {
+		errs = append(errs, err)
 	}
-	result.APISecret = helper.SetValue(apiSecret, result.APISecret).(string)
-	result.Workers = helper.SetValue(workers, result.Workers).(int)
 
-	// Store in global config
-	config = &result
+	if err := result.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return &result, errors.Join(errs...)
 }
 
-// GetConfig provides the application configuration
-func GetConfig() (*Config, error) {
-	if config == nil {
-		loadConfig()
-		if config == nil {
-			return nil, errors.New("failed to load configuration")
+// Validate reports every setting the client cannot connect with
+func (c Config) Validate() error {
+	var errs []error
+
+	if u, err := url.Parse(c.ServerURL); err != nil || u.Host == "" ||
+		(u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "ws" && u.Scheme != "wss") {
+		errs = append(errs, fmt.Errorf("server_url: %q is not an HTTP or WebSocket URL", c.ServerURL))
+	}
+	if c.APISecret == "" {
+		errs = append(errs, errors.New("api_secret is required"))
+	}
+	if len(c.ProxyPass) == 0 {
+		errs = append(errs, errors.New("proxy_pass: at least one target is required"))
+	}
+	for _, target := range c.ProxyPass {
+		_, address := helper.ParseTargetEndpoint(target)
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			errs = append(errs, fmt.Errorf("proxy_pass: %q: %v", target, err))
 		}
 	}
-	return config, nil
+	if c.Workers < 0 {
+		errs = append(errs, fmt.Errorf("workers: %d is negative", c.Workers))
+	}
+
+	return errors.Join(errs...)
+}
+
+// GetConfig provides the application configuration; the error lists every
+// invalid setting
+func GetConfig() (*Config, error) {
+	configOnce.Do(func() {
+		config, configErr = loadConfig()
+	})
+	return config, configErr
 }
@@ -30,7 +30,7 @@ var client = &http.Client{
 	},
 }
 
-func HandleHTTP(connection net.Conn, proxyTarget, protocol string) {
+func HandleHTTP(connection net.Conn, proxyTarget, protocol, hostname string) {
 	req, err := helper.ParseHTTPRequest(connection)
 	if err != nil {
 		fmt.Println("Error parsing HTTP request:", err)
@@ -52,6 +52,12 @@ func HandleHTTP(connection net.Conn, proxyTarget, protocol string) {
 	requestToServer.Header = req.Header
 	requestToServer.Host = host
 	requestToServer.Header.Add("Host", host)
+	if hostname == "" {
+		hostname = req.Host
+	}
+	if hostname != "" && requestToServer.Header.Get("X-Forwarded-Host") == "" {
+		requestToServer.Header.Set("X-Forwarded-Host", hostname)
+	}
 
 	// Check if the request is an Upgrade (WebSocket) request
 	hconn := strings.ToLower(req.Header.Get("Connection"))
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"strings"
@@ -21,10 +23,19 @@ import (
 )
 
 var httpmanager = manager.NewHTTPManager()
-var configuration, _ = config.GetConfig()
-var serverURL = configuration.ServerURL
+var configuration *config.Config
+var serverURL string
 
 func main() {
+	var err error
+	configuration, err = config.GetConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	serverURL = configuration.ServerURL
+
 	interruptChannel := make(chan os.Signal, 1)
 	signal.Notify(interruptChannel, os.Interrupt)
 
@@ -44,6 +55,12 @@ func startClient(proxyTarget string) {
 	retryDelay := 3 * time.Second
 	headers := http.Header{}
 	headers.Set("authorization", configuration.APISecret)
+	if configuration.Ephemeral {
+		headers.Set("X-Lipstick-Ephemeral", "true")
+	}
+	if len(configuration.Routes) > 0 {
+		headers.Set("X-Lipstick-Routes", strings.Join(configuration.Routes, ","))
+	}
 
 	env := os.Getenv("ENV")
 	if env == "development" {
@@ -60,16 +77,50 @@ func startClient(proxyTarget string) {
 			time.Sleep(retryDelay)
 			continue
 		}
-		helper.ReadUntilHeadersEnd(conn)
+		tunnelHost, err := readHandshake(conn)
+		if err != nil {
+			log.Printf("Error reading handshake from %v: %v\n", serverURL, err)
+			conn.Close()
+			time.Sleep(retryDelay)
+			continue
+		}
 
 		fmt.Println("Connected to server at", serverURL)
 		go checkConnection(conn)
-		handleTickets(conn, proxyTarget)
+		handleTickets(conn, proxyTarget, tunnelHost)
 		fmt.Println("Disconnected from server at", serverURL)
 		time.Sleep(retryDelay)
 	}
 }
 
+// readHandshake consumes the upgrade response and returns the hostname the
+// server assigned to an ephemeral tunnel, if any.
+func readHandshake(conn net.Conn) (string, error) {
+	b, err := helper.ReadUntilHeadersEnd(conn)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	publicURL := resp.Header.Get("X-Lipstick-Public-URL")
+	if publicURL == "" {
+		return "", nil
+	}
+	fmt.Println("Public URL:", publicURL)
+
+	parsed, err := url.Parse(publicURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid public URL: %w", err)
+	}
+	return parsed.Host, nil
+}
+
 func checkConnection(connection io.ReadWriter) {
 	writeMessage := []byte("ping")
 	for {
@@ -80,23 +131,35 @@ func checkConnection(connection io.ReadWriter) {
 		time.Sleep(30 * time.Second)
 	}
 }
-func readMessage(reader *bufio.Reader) (string, string, error) {
+
+// readMessage parses a ticket line ("addr:ticket[:hostname]"). The hostname
+// is the visitor-facing name the server matched, which may be an alias or a
+// wildcard match of the tunnel's domain.
+func readMessage(reader *bufio.Reader) (string, string, string, error) {
 	line, err := reader.ReadString('\n')
 	if err != nil {
-		return "", "", fmt.Errorf("error reading until newline: %w", err)
+		return "", "", "", fmt.Errorf("error reading until newline: %w", err)
 	}
 	line = line[:len(line)-1]
 	if line == "close" {
 		fmt.Println("Connection closed by server")
-		return "", "", fmt.Errorf("connection closed by server")
+		return "", "", "", fmt.Errorf("connection closed by server")
 	}
 
 	data := strings.Split(line, ":")
+	if len(data) < 2 {
+		return "", "", "", nil
+	}
+
+	hostname := ""
+	if len(data) > 2 {
+		hostname = data[2]
+	}
 
-	return data[0], data[1], nil
+	return data[0], data[1], hostname, nil
 }
 
-func handleTickets(connection net.Conn, proxyTarget string) {
+func handleTickets(connection net.Conn, proxyTarget, tunnelHost string) {
 	defer func() {
 		recover()
 	}()
@@ -104,25 +167,31 @@ func handleTickets(connection net.Conn, proxyTarget string) {
 
 	reader := bufio.NewReader(connection)
 	for {
-		addr, ticket, err := readMessage(reader)
+		addr, ticket, hostname, err := readMessage(reader)
 		if err != nil {
 			return
 		}
 
 		if len(ticket) > 0 {
 			protocol, targetAddress := helper.ParseTargetEndpoint(proxyTarget)
-			go establishConnection(protocol, addr, targetAddress, string(ticket))
+			go establishConnection(protocol, addr, targetAddress, string(ticket), tunnelHost, hostname)
 		}
 	}
 }
 
-func establishConnection(protocol, addr, proxyTarget, uuid string) {
+func establishConnection(protocol, addr, proxyTarget, uuid, tunnelHost, hostname string) {
 	defer func() {
 		recover()
 	}()
 	url := serverURL + "/" + uuid
 
-	connection, err := httpmanager.ConnectByAddress(addr, url, nil)
+	var headers http.Header
+	if tunnelHost != "" {
+		headers = http.Header{}
+		headers.Set("Host", tunnelHost)
+	}
+
+	connection, err := httpmanager.ConnectByAddress(addr, url, headers)
 	if err != nil {
 		fmt.Fprintf(connection, helper.BadGatewayResponse)
 		return
@@ -139,7 +208,7 @@ func establishConnection(protocol, addr, proxyTarget, uuid string) {
 	conn := helper.NewConnWithBuffer(connection, buff)
 
 	if helper.IsHTTPRequest(string(buff)) {
-		handlers.HandleHTTP(conn, proxyTarget, protocol)
+		handlers.HandleHTTP(conn, proxyTarget, protocol, hostname)
 		return
 	}
 
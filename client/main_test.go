@@ -0,0 +1,23 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadMessage(t *testing.T) {
+	for line, want := range map[string][3]string{
+		"edge-1.example.com:0f8c2d:www.example.com:api\n": {"edge-1.example.com", "0f8c2d", "www.example.com"},
+		"203.0.113.7:0f8c2d:example.com:\n":               {"203.0.113.7", "0f8c2d", "example.com"},
+		"203.0.113.7:0f8c2d\n":                            {"203.0.113.7", "0f8c2d", ""},
+	} {
+		addr, ticket, hostname, err := readMessage(bufio.NewReader(strings.NewReader(line)))
+		if err != nil {
+			t.Fatalf("readMessage(%q): %v", line, err)
+		}
+		if got := [3]string{addr, ticket, hostname}; got != want {
+			t.Errorf("readMessage(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
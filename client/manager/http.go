@@ -78,6 +78,9 @@ func (m *HTTPManager) ConnectByAddress(addr, url string, headers http.Header) (*
 		return nil, fmt.Errorf("error creating request: %w", err)
 	}
 	req.Header = headers
+	if host := headers.Get("Host"); host != "" {
+		req.Host = host
+	}
 
 	host := req.URL.Host
 	if host == "" {
@@ -95,6 +98,11 @@ func (m *HTTPManager) ConnectByAddress(addr, url string, headers http.Header) (*
 	if req.URL.Scheme == "http" || req.URL.Scheme == "ws" {
 		conn, err = net.Dial("tcp", host)
 	} else {
+		// Tickets name the node's host only; it listens on the same port.
+		if _, _, splitErr := net.SplitHostPort(addr); splitErr != nil {
+			_, port, _ := net.SplitHostPort(host)
+			addr = net.JoinHostPort(addr, port)
+		}
 		conn, err = tls.Dial("tcp", addr, &tls.Config{
 			InsecureSkipVerify: true,
 			ServerName:         strings.Split(host, ":")[0],
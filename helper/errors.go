@@ -18,3 +18,83 @@ var BadGatewayBody = `<!DOCTYPE html>
 </html>`
 
 var BadGatewayResponse = BadGatewayHeader + fmt.Sprint(len(BadGatewayBody)) + "\n\n" + BadGatewayBody
+
+var ForbiddenHeader = `HTTP/1.1 403 Forbidden
+Content-Type: text/html
+Connection: close
+Content-Length: `
+
+var ForbiddenBody = `<!DOCTYPE html>
+<html>
+<head>
+    <title>403 Forbidden</title>
+</head>
+<body>
+    <h1>Forbidden</h1>
+    <p>You are not allowed to access this resource.</p>
+</body>
+</html>`
+
+var ForbiddenResponse = ForbiddenHeader + fmt.Sprint(len(ForbiddenBody)) + "\n\n" + ForbiddenBody
+
+var TooManyRequestsHeader = `HTTP/1.1 429 Too Many Requests
+Content-Type: text/html
+Connection: close
+Retry-After: 1
+Content-Length: `
+
+var TooManyRequestsBody = `<!DOCTYPE html>
+<html>
+<head>
+    <title>429 Too Many Requests</title>
+</head>
+<body>
+    <h1>Too Many Requests</h1>
+    <p>You have sent too many requests. Please try again later.</p>
+</body>
+</html>`
+
+var TooManyRequestsResponse = TooManyRequestsHeader + fmt.Sprint(len(TooManyRequestsBody)) + "\n\n" + TooManyRequestsBody
+
+var ServiceUnavailableHeader = `HTTP/1.1 503 Service Unavailable
+Content-Type: text/html
+Connection: close
+Retry-After: 5
+Content-Length: `
+
+var ServiceUnavailableBody = `<!DOCTYPE html>
+<html>
+<head>
+    <title>503 Service Unavailable</title>
+</head>
+<body>
+    <h1>Service Unavailable</h1>
+    <p>The service is handling too many connections. Please try again later.</p>
+</body>
+</html>`
+
+var ServiceUnavailableResponse = ServiceUnavailableHeader + fmt.Sprint(len(ServiceUnavailableBody)) + "\n\n" + ServiceUnavailableBody
+
+var QuotaExceededHeader = `HTTP/1.1 429 Too Many Requests
+Content-Type: text/html
+Connection: close
+Content-Length: `
+
+var QuotaExceededBody = `<!DOCTYPE html>
+<html>
+<head>
+    <title>Quota Exceeded</title>
+</head>
+<body>
+    <h1>Quota Exceeded</h1>
+    <p>This site has used all of its traffic for the month.</p>
+</body>
+</html>`
+
+// QuotaExceededResponse answers with page, or the default page when empty.
+func QuotaExceededResponse(page string) string {
+	if page == "" {
+		page = QuotaExceededBody
+	}
+	return QuotaExceededHeader + fmt.Sprint(len(page)) + "\n\n" + page
+}
@@ -53,6 +53,23 @@ func GetDomainName(conn net.Conn) (string, error) {
 	return domain, nil
 }
 
+// IsTLSConn reports whether conn, possibly wrapped by this package, was
+// accepted over TLS.
+func IsTLSConn(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case *tls.Conn:
+			return true
+		case *RemoteConn:
+			conn = c.Conn
+		case *ConnWithBuffer:
+			conn = c.Conn
+		default:
+			return false
+		}
+	}
+}
+
 func IsHTTPRequest(data string) bool {
 	lines := strings.Split(data, "\n")
 	if len(lines) == 0 {
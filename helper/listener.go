@@ -9,20 +9,17 @@ import (
 	"net/http"
 )
 
-func NewListenerManagerTCP(addr string, tlsConfig *tls.Config) *ListenerManager {
-	var l net.Listener
-	var err error
-	if tlsConfig != nil {
-		l, err = tls.Listen("tcp", addr, tlsConfig)
-		if err != nil {
-			return nil
-		}
-		return NewListenerManager(l)
-	}
-	l, err = net.Listen("tcp", addr)
+func NewListenerManagerTCP(addr string, tlsConfig *tls.Config, proxyProtocol bool) *ListenerManager {
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil
 	}
+	if proxyProtocol {
+		l = NewProxyProtoListener(l)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
 	return NewListenerManager(l)
 }
 
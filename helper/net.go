@@ -3,7 +3,10 @@ package helper
 import (
 	"log"
 	"net"
+	"net/netip"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/OnnaSoft/lipstick/logger"
@@ -12,7 +15,7 @@ import (
 type RemoteConn struct {
 	Domain string
 	net.Conn
-	used      bool
+	used      atomic.Bool
 	closeOnce sync.Once
 }
 
@@ -32,21 +35,21 @@ func MonitorIdle(c *RemoteConn, timeout time.Duration) {
 		defer ticker.Stop()
 
 		for range ticker.C {
-			if !c.used {
+			if !c.used.Load() {
 				c.closeOnce.Do(func() {
 					log.Printf("Closing idle connection to domain: %s", c.Domain)
 					c.Conn.Close()
 				})
 				return
 			}
-			c.used = false // Resetea el estado usado para la próxima verificación
+			c.used.Store(false) // Resetea el estado usado para la próxima verificación
 		}
 	}()
 }
 
 // Marca la conexión como usada
 func (c *RemoteConn) markAsUsed() {
-	c.used = true
+	c.used.Store(true)
 }
 
 type ConnWithBuffer struct {
@@ -96,3 +99,39 @@ func GetPublicIP() string {
 	logger.Default.Info("No se encontró una dirección IP pública válida")
 	return ""
 }
+
+// ParsePrefix parses a CIDR block, accepting bare addresses as single-host
+// prefixes.
+func ParsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// AddrIP returns the IP address of a network address, if it has one.
+func AddrIP(addr net.Addr) (netip.Addr, bool) {
+	if addr == nil {
+		return netip.Addr{}, false
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+		return ip.Unmap(), ok
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), true
+}
@@ -0,0 +1,153 @@
+package helper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtoV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrMissingProxyHeader = errors.New("missing PROXY protocol header")
+
+// ProxyProtoListener accepts connections preceded by a PROXY protocol header
+// (v1 or v2), as sent by load balancers such as HAProxy or AWS NLB. The
+// address announced in the header becomes the connection's RemoteAddr.
+type ProxyProtoListener struct {
+	net.Listener
+	HeaderTimeout time.Duration
+}
+
+func NewProxyProtoListener(l net.Listener) *ProxyProtoListener {
+	return &ProxyProtoListener{Listener: l, HeaderTimeout: 10 * time.Second}
+}
+
+func (l *ProxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyProtoConn{Conn: conn, reader: bufio.NewReader(conn), timeout: l.HeaderTimeout}, nil
+}
+
+// ProxyProtoConn parses the PROXY header lazily, on the first Read or
+// RemoteAddr call, so that Accept never blocks on a slow client.
+type ProxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+}
+
+func (c *ProxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *ProxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *ProxyProtoConn) readHeader() {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+	}
+
+	signature, err := c.reader.Peek(len(proxyProtoV2Signature))
+	if err != nil {
+		c.err = fmt.Errorf("%w: %v", ErrMissingProxyHeader, err)
+		return
+	}
+
+	switch {
+	case bytes.Equal(signature, proxyProtoV2Signature):
+		c.remoteAddr, c.err = readProxyHeaderV2(c.reader)
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		c.remoteAddr, c.err = readProxyHeaderV1(c.reader)
+	default:
+		c.err = ErrMissingProxyHeader
+	}
+}
+
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+	if len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+
+	fields := strings.Fields(strings.TrimSuffix(line, "\r\n"))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY v1 header: %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY v1 source address: %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New("unsupported PROXY protocol version")
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("error reading PROXY header: %w", err)
+	}
+
+	// LOCAL commands (health checks from the balancer) keep the real address.
+	if header[12]&0x0f == 0 {
+		return nil, nil
+	}
+
+	switch header[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, errors.New("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:4]),
+			Port: int(binary.BigEndian.Uint16(payload[8:10])),
+		}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, errors.New("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(payload[0:16]),
+			Port: int(binary.BigEndian.Uint16(payload[32:34])),
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,111 @@
+package helper
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a thread-safe token bucket whose rate and burst can be
+// changed while it is in use. A rate of zero or less disables the limit.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	b := &TokenBucket{last: time.Now()}
+	b.SetLimit(rate, burst)
+	b.tokens = b.burst
+	return b
+}
+
+// SetLimit changes the refill rate (tokens per second) and the bucket size.
+// A burst below one second worth of tokens is raised to the rate.
+func (b *TokenBucket) SetLimit(rate float64, burst int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	wasUnlimited := b.rate <= 0
+	b.rate = rate
+	b.burst = math.Max(float64(burst), math.Max(rate, 1))
+	if wasUnlimited || b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+func (b *TokenBucket) Unlimited() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.rate <= 0
+}
+
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(1)
+}
+
+// AllowN takes n tokens if they are available right now.
+func (b *TokenBucket) AllowN(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.rate <= 0 {
+		return true
+	}
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// WaitN blocks until n tokens have been taken. Requests larger than the
+// burst are served in burst-sized pieces.
+func (b *TokenBucket) WaitN(n int) {
+	for n > 0 {
+		b.mu.Lock()
+		if b.rate <= 0 {
+			b.mu.Unlock()
+			return
+		}
+		now := time.Now()
+		b.refill(now)
+
+		chunk := math.Min(float64(n), b.burst)
+		if b.tokens >= chunk {
+			b.tokens -= chunk
+			n -= int(chunk)
+			b.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((chunk - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		// Sleep in short steps so that a new limit set meanwhile applies soon.
+		time.Sleep(min(wait, 100*time.Millisecond))
+	}
+}
+
+// Full reports whether the bucket has been idle long enough to refill.
+func (b *TokenBucket) Full() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.last = now
+	if b.rate <= 0 || elapsed <= 0 {
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+}
@@ -0,0 +1,119 @@
+package helper
+
+import (
+	"testing"
+	"time"
+)
+
+// take counts the tokens available right now, up to limit.
+func take(b *TokenBucket, limit int) int {
+	n := 0
+	for n < limit && b.Allow() {
+		n++
+	}
+	return n
+}
+
+// rewind makes the bucket refill as if d had passed.
+func rewind(b *TokenBucket, d time.Duration) {
+	b.mu.Lock()
+	b.last = b.last.Add(-d)
+	b.mu.Unlock()
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		want  int
+	}{
+		{"burst", 2, 5, 5},
+		{"burst below the rate", 10, 5, 10},
+		{"slow rate", 0.5, 0, 1},
+		{"unlimited", 0, 5, 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewTokenBucket(test.rate, test.burst)
+			if got := take(b, 100); got != test.want {
+				t.Errorf("took %d tokens, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTokenBucketRefill(t *testing.T) {
+	b := NewTokenBucket(10, 10)
+	take(b, 100)
+	if b.Full() {
+		t.Fatal("an empty bucket is full")
+	}
+
+	rewind(b, 300*time.Millisecond)
+	if got := take(b, 100); got != 3 {
+		t.Errorf("took %d tokens after 300ms, want 3", got)
+	}
+
+	rewind(b, time.Minute)
+	if !b.Full() {
+		t.Error("the bucket is not full after a minute")
+	}
+	if got := take(b, 100); got != 10 {
+		t.Errorf("took %d tokens after a minute, want the burst of 10", got)
+	}
+}
+
+func TestTokenBucketSetLimit(t *testing.T) {
+	b := NewTokenBucket(0, 0)
+	if !b.Unlimited() {
+		t.Fatal("a zero rate is limited")
+	}
+
+	// A limit set on an unlimited bucket starts with the full burst.
+	b.SetLimit(10, 20)
+	if b.Unlimited() {
+		t.Fatal("the limit was not set")
+	}
+	if got := take(b, 100); got != 20 {
+		t.Errorf("took %d tokens, want 20", got)
+	}
+
+	// A larger limit does not refill the bucket at once.
+	b.SetLimit(100, 100)
+	if got := take(b, 100); got != 0 {
+		t.Errorf("took %d tokens after raising the limit, want 0", got)
+	}
+	rewind(b, 100*time.Millisecond)
+	if got := take(b, 100); got != 10 {
+		t.Errorf("took %d tokens after 100ms at the new rate, want 10", got)
+	}
+
+	// A smaller burst drops the tokens above it.
+	rewind(b, time.Minute)
+	b.SetLimit(5, 5)
+	if got := take(b, 100); got != 5 {
+		t.Errorf("took %d tokens after lowering the burst, want 5", got)
+	}
+
+	b.SetLimit(0, 0)
+	if !b.Unlimited() || take(b, 100) != 100 {
+		t.Error("removing the limit kept it")
+	}
+}
+
+func TestTokenBucketWaitN(t *testing.T) {
+	b := NewTokenBucket(100, 100)
+	start := time.Now()
+	b.WaitN(100)
+	b.WaitN(10)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("WaitN beyond the burst returned after %v, want about 100ms", elapsed)
+	}
+
+	start = time.Now()
+	NewTokenBucket(0, 0).WaitN(1 << 20)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("WaitN on an unlimited bucket took %v", elapsed)
+	}
+}
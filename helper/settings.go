@@ -0,0 +1,160 @@
+package helper
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings binds configuration fields to environment variables and
+// command-line flags. The flags are registered on a flag set but only read
+// by Apply, which runs after the flags are parsed and the configuration
+// file loaded, so that each field is taken from, in increasing precedence,
+// its default, the file, the environment and the command line.
+type Settings struct {
+	flags    *flag.FlagSet
+	settings []*setting
+}
+
+type setting struct {
+	flag   string
+	env    string
+	secret bool
+	parse  func(string) error
+}
+
+func NewSettings(flags *flag.FlagSet) *Settings {
+	return &Settings{flags: flags}
+}
+
+// String binds p to the flag and to the environment variable named; either
+// may be empty.
+func (s *Settings) String(p *string, flagName, env, usage string) {
+	s.bind(&setting{flag: flagName, env: env}, func(value string) error {
+		*p = value
+		return nil
+	}, func(usage string) { s.flags.String(flagName, *p, usage) }, usage)
+}
+
+// Secret binds p like String, and also reads it from the file named by the
+// environment variable with the _FILE suffix. Its value is never shown in
+// the usage message.
+func (s *Settings) Secret(p *string, flagName, env, usage string) {
+	s.bind(&setting{flag: flagName, env: env, secret: true}, func(value string) error {
+		*p = value
+		return nil
+	}, func(usage string) { s.flags.String(flagName, "", usage) }, usage)
+}
+
+func (s *Settings) Int(p *int, flagName, env, usage string) {
+	s.bind(&setting{flag: flagName, env: env}, func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*p = n
+		return nil
+	}, func(usage string) { s.flags.Int(flagName, *p, usage) }, usage)
+}
+
+func (s *Settings) Bool(p *bool, flagName, env, usage string) {
+	s.bind(&setting{flag: flagName, env: env}, func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+		*p = b
+		return nil
+	}, func(usage string) { s.flags.Bool(flagName, *p, usage) }, usage)
+}
+
+// List binds p to a list separated by sep, or by white space when sep is
+// empty.
+func (s *Settings) List(p *[]string, sep, flagName, env, usage string) {
+	split, join := strings.Fields, " "
+	if sep != "" {
+		split, join = func(value string) []string {
+			var items []string
+			for _, item := range strings.Split(value, sep) {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			return items
+		}, sep
+	}
+	s.bind(&setting{flag: flagName, env: env}, func(value string) error {
+		*p = split(value)
+		return nil
+	}, func(usage string) { s.flags.String(flagName, strings.Join(*p, join), usage) }, usage)
+}
+
+// bind records the setting and registers its flag, with the current value
+// of the field as the default shown in the usage message.
+func (s *Settings) bind(st *setting, parse func(string) error, register func(usage string), usage string) {
+	st.parse = parse
+	s.settings = append(s.settings, st)
+	if st.flag == "" {
+		return
+	}
+	if st.env != "" {
+		usage += " (" + st.env + ")"
+	}
+	register(usage)
+}
+
+// Apply sets the fields given in the environment and then those given on
+// the command line, and reports every value that could not be used.
+func (s *Settings) Apply() error {
+	given := make(map[string]bool)
+	s.flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	var errs []error
+	for _, st := range s.settings {
+		value, ok, err := st.lookupEnv()
+		if err != nil {
+			errs = append(errs, err)
+		} else if ok {
+			if err := st.parse(value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", st.env, err))
+			}
+		}
+
+		if st.flag != "" && given[st.flag] {
+			if err := st.parse(s.flags.Lookup(st.flag).Value.String()); err != nil {
+				errs = append(errs, fmt.Errorf("-%s: %w", st.flag, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// lookupEnv reads the environment variable of the setting or, for secrets,
+// the file named by its _FILE variant, without the trailing line break.
+func (st *setting) lookupEnv() (string, bool, error) {
+	if st.env == "" {
+		return "", false, nil
+	}
+	value, ok := os.LookupEnv(st.env)
+	if !st.secret {
+		return value, ok, nil
+	}
+
+	path, fromFile := os.LookupEnv(st.env + "_FILE")
+	if !fromFile {
+		return value, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("%s and %s_FILE are both set", st.env, st.env)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", st.env, err)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), true, nil
+}
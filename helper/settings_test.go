@@ -0,0 +1,149 @@
+package helper
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testSettings struct {
+	Name   string
+	Port   int
+	Debug  bool
+	Hosts  []string
+	Secret string
+}
+
+// applySettings binds a testSettings holding the defaults, parses args, lets
+// file change the fields as the configuration file would, and applies the
+// environment and the flags.
+func applySettings(t *testing.T, args []string, file func(*testSettings)) (testSettings, error) {
+	t.Helper()
+	values := testSettings{Name: "default", Port: 80, Hosts: []string{"localhost"}}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	settings := NewSettings(flags)
+	settings.String(&values.Name, "name", "TEST_NAME", "")
+	settings.Int(&values.Port, "port", "TEST_PORT", "")
+	settings.Bool(&values.Debug, "debug", "TEST_DEBUG", "")
+	settings.List(&values.Hosts, ",", "hosts", "TEST_HOSTS", "")
+	settings.Secret(&values.Secret, "secret", "TEST_SECRET", "")
+	if err := flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if file != nil {
+		file(&values)
+	}
+	err := settings.Apply()
+	return values, err
+}
+
+func TestSettingsApply(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fromFile := func(values *testSettings) {
+		values.Name = "file"
+		values.Port = 8080
+		values.Secret = "file-secret"
+	}
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		file   func(*testSettings)
+		want   testSettings
+		errors []string
+	}{
+		{
+			name: "defaults",
+			want: testSettings{Name: "default", Port: 80, Hosts: []string{"localhost"}},
+		},
+		{
+			name: "file over defaults",
+			file: fromFile,
+			want: testSettings{Name: "file", Port: 8080, Hosts: []string{"localhost"}, Secret: "file-secret"},
+		},
+		{
+			name: "environment over file",
+			env:  map[string]string{"TEST_NAME": "env", "TEST_DEBUG": "true", "TEST_HOSTS": "a.example.com, b.example.com,", "TEST_SECRET": "env-secret"},
+			file: fromFile,
+			want: testSettings{Name: "env", Port: 8080, Debug: true, Hosts: []string{"a.example.com", "b.example.com"}, Secret: "env-secret"},
+		},
+		{
+			name: "flags over environment",
+			env:  map[string]string{"TEST_NAME": "env", "TEST_PORT": "9000", "TEST_SECRET": "env-secret"},
+			args: []string{"-name", "flag", "-hosts", "c.example.com", "-secret", "flag-secret"},
+			file: fromFile,
+			want: testSettings{Name: "flag", Port: 9000, Hosts: []string{"c.example.com"}, Secret: "flag-secret"},
+		},
+		{
+			name: "secret file",
+			env:  map[string]string{"TEST_SECRET_FILE": secretFile},
+			file: fromFile,
+			want: testSettings{Name: "file", Port: 8080, Hosts: []string{"localhost"}, Secret: "from-file"},
+		},
+		{
+			name: "flag over secret file",
+			env:  map[string]string{"TEST_SECRET_FILE": secretFile},
+			args: []string{"-secret", "flag-secret"},
+			want: testSettings{Name: "default", Port: 80, Hosts: []string{"localhost"}, Secret: "flag-secret"},
+		},
+		{
+			name:   "secret and secret file",
+			env:    map[string]string{"TEST_SECRET": "env-secret", "TEST_SECRET_FILE": secretFile},
+			want:   testSettings{Name: "default", Port: 80, Hosts: []string{"localhost"}},
+			errors: []string{"TEST_SECRET and TEST_SECRET_FILE are both set"},
+		},
+		{
+			name: "every error",
+			env: map[string]string{
+				"TEST_PORT":        "eighty",
+				"TEST_DEBUG":       "maybe",
+				"TEST_SECRET_FILE": filepath.Join(t.TempDir(), "missing"),
+			},
+			args: []string{"-name", "flag"},
+			want: testSettings{Name: "flag", Port: 80, Hosts: []string{"localhost"}},
+			errors: []string{
+				`TEST_PORT: "eighty" is not a number`,
+				`TEST_DEBUG: "maybe" is not a boolean`,
+				"TEST_SECRET_FILE: ",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			values, err := applySettings(t, test.args, test.file)
+			if !reflect.DeepEqual(values, test.want) {
+				t.Errorf("values = %+v, want %+v", values, test.want)
+			}
+			if len(test.errors) == 0 {
+				if err != nil {
+					t.Fatalf("Apply: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Apply succeeded")
+			}
+			joined, ok := err.(interface{ Unwrap() []error })
+			if !ok || len(joined.Unwrap()) != len(test.errors) {
+				t.Fatalf("Apply = %q, want %d errors", err, len(test.errors))
+			}
+			for i, message := range test.errors {
+				if got := joined.Unwrap()[i].Error(); !strings.HasPrefix(got, message) {
+					t.Errorf("error %d = %q, want %q", i, got, message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testSecret       = "secret"
+	testMetricsToken = "metrics-token"
+)
+
+// TestMain runs the tests against a standalone configuration, whose usage
+// is kept in a SQLite database of its own.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "lipstick-admin")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("MODE", config.ModeStandalone)
+	os.Setenv("ADMIN_SECRET_KEY", testSecret)
+	os.Setenv("METRICS_TOKEN", testMetricsToken)
+	os.Setenv("DB_PATH", filepath.Join(dir, "lipstick.db"))
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.MigrateConnection(connection); err != nil {
+		log.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// stubStore caches domains the way the stores do, returning the same
+// pointer on every GetDomain. UpdateDomain fails with err when it is set.
+type stubStore struct {
+	auth.AuthManager
+	domains map[string]*auth.Domain
+	err     error
+}
+
+func (s *stubStore) GetDomain(name string) (*auth.Domain, error) {
+	if domain, ok := s.domains[name]; ok {
+		return domain, nil
+	}
+	return nil, auth.ErrNotFound
+}
+
+func (s *stubStore) UpdateDomain(domain *auth.Domain) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.domains[domain.Name] = domain
+	return nil
+}
+
+func newTestAdmin(store auth.AuthManager) *Admin {
+	admin := &Admin{authManager: store}
+	configureRouter(admin)
+	return admin
+}
+
+// call sends an authorized request to admin, encoding body as JSON, and
+// decodes the answer into result unless it is nil.
+func call(t *testing.T, admin *Admin, method, path string, body, result any) int {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Authorization", testSecret)
+	req.Header.Set("Content-Type", "application/json")
+	res := httptest.NewRecorder()
+	admin.engine.ServeHTTP(res, req)
+	if result != nil && res.Code == http.StatusOK {
+		if err := json.Unmarshal(res.Body.Bytes(), result); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return res.Code
+}
@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/cluster"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/gin-gonic/gin"
+)
+
+func (r *router) getClusterNodes(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get config"})
+		return
+	}
+
+	interval := time.Duration(conf.Cluster.HeartbeatInterval) * time.Second
+	nodes, err := cluster.Nodes(interval)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get nodes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"nodes": nodes})
+}
+
+func (r *router) getClusterSessions(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	sessions, err := cluster.Sessions(c.Query("domain"), c.Query("node"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
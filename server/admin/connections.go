@@ -0,0 +1,104 @@
+package admin
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/gin-gonic/gin"
+)
+
+const maxConnectionsPageSize = 500
+
+// getConnections lists connection log entries, newest first. Filters: domain,
+// agent, protocol, visitor, reason, and from/to as RFC 3339 times or dates.
+func (r *router) getConnections(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'page' parameter"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > maxConnectionsPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'limit' parameter"})
+		return
+	}
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get config"})
+		return
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to connect to database"})
+		return
+	}
+
+	query := connection.Model(&db.ConnectionLog{})
+	filters := map[string]string{
+		"domain":   "domain = ?",
+		"agent":    "agent_id = ?",
+		"protocol": "protocol = ?",
+		"visitor":  "visitor_addr LIKE ?",
+		"reason":   "close_reason = ?",
+	}
+	for param, condition := range filters {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		if param == "visitor" {
+			value += "%"
+		}
+		query = query.Where(condition, value)
+	}
+	for param, condition := range map[string]string{"from": "started_at >= ?", "to": "started_at <= ?"} {
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := parseTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid '" + param + "' parameter"})
+			return
+		}
+		query = query.Where(condition, t)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to count connections"})
+		return
+	}
+
+	var entries []db.ConnectionLog
+	err = query.Order("started_at DESC").Order("id DESC").
+		Offset((page - 1) * limit).Limit(limit).
+		Find(&entries).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get connections"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"connections": entries,
+		"page":        page,
+		"limit":       limit,
+		"total":       total,
+	})
+}
+
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02", value)
+}
@@ -0,0 +1,112 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/traffic"
+	"github.com/gin-gonic/gin"
+)
+
+// quotaRequest resets the usage counted this month, replaces the quota with
+// MonthlyQuota or raises it by Raise bytes. Fields can be combined.
+type quotaRequest struct {
+	Reset        bool   `json:"reset"`
+	MonthlyQuota *int64 `json:"monthlyQuota"`
+	Raise        int64  `json:"raise"`
+}
+
+func quotaStatus(domain *auth.Domain) (gin.H, error) {
+	month := traffic.Month(time.Now())
+	used, err := traffic.MonthlyUsage(domain.Name, month)
+	if err != nil {
+		return nil, err
+	}
+	used = domain.QuotaUsage(month, used)
+
+	status := gin.H{
+		"domain":       domain.Name,
+		"month":        month,
+		"used":         used,
+		"monthlyQuota": domain.MonthlyQuota,
+		"action":       domain.QuotaAction,
+		"exceeded":     domain.MonthlyQuota > 0 && used >= domain.MonthlyQuota,
+	}
+	if domain.MonthlyQuota > 0 {
+		status["percent"] = float64(used) * 100 / float64(domain.MonthlyQuota)
+	}
+	return status, nil
+}
+
+func (r *router) getQuota(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	domain, err := r.admin.authManager.GetDomain(c.Param("domainName"))
+	if err != nil {
+		domainError(c, err)
+		return
+	}
+
+	status, err := quotaStatus(domain)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get usage"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
+
+func (r *router) updateQuota(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	request := quotaRequest{}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Raise < 0 || (request.MonthlyQuota != nil && *request.MonthlyQuota < 0) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "quota must not be negative"})
+		return
+	}
+
+	domain, err := r.admin.authManager.GetDomain(c.Param("domainName"))
+	if err != nil {
+		domainError(c, err)
+		return
+	}
+
+	// The domain may be the one cached by the store, so it is changed on a copy.
+	updated := *domain
+	if request.Reset {
+		month := traffic.Month(time.Now())
+		used, err := traffic.MonthlyUsage(updated.Name, month)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get usage"})
+			return
+		}
+		updated.QuotaResetMonth = month
+		updated.QuotaResetBytes = used
+	}
+	if request.MonthlyQuota != nil {
+		updated.MonthlyQuota = *request.MonthlyQuota
+	}
+	updated.MonthlyQuota += request.Raise
+
+	if err := r.admin.authManager.UpdateDomain(&updated); err != nil {
+		storeError(c, err, "Unable to update domain")
+		return
+	}
+
+	status, err := quotaStatus(&updated)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get usage"})
+		return
+	}
+	c.JSON(http.StatusOK, status)
+}
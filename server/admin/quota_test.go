@@ -0,0 +1,141 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/OnnaSoft/lipstick/server/traffic"
+)
+
+// recordUsage stores bytes as the usage of domain today.
+func recordUsage(t *testing.T, domain string, bytes int64) {
+	t.Helper()
+	conf, err := config.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = connection.Create(&db.DailyConsumption{
+		Domain:    domain,
+		Date:      now.UTC().Truncate(24 * time.Hour),
+		Month:     traffic.Month(now),
+		BytesUsed: bytes,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+type quotaResponse struct {
+	Used         int64 `json:"used"`
+	MonthlyQuota int64 `json:"monthlyQuota"`
+	Exceeded     bool  `json:"exceeded"`
+}
+
+func TestUpdateQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		quota   int64
+		request map[string]any
+		code    int
+		want    quotaResponse
+	}{
+		{
+			name:    "reset",
+			quota:   1000,
+			request: map[string]any{"reset": true},
+			code:    http.StatusOK,
+			want:    quotaResponse{Used: 0, MonthlyQuota: 1000},
+		},
+		{
+			name:    "raise",
+			quota:   1000,
+			request: map[string]any{"raise": 500},
+			code:    http.StatusOK,
+			want:    quotaResponse{Used: 1200, MonthlyQuota: 1500},
+		},
+		{
+			name:    "replace and raise",
+			quota:   1000,
+			request: map[string]any{"monthlyQuota": 100, "raise": 50},
+			code:    http.StatusOK,
+			want:    quotaResponse{Used: 1200, MonthlyQuota: 150, Exceeded: true},
+		},
+		{
+			name:    "reset and raise",
+			quota:   1000,
+			request: map[string]any{"reset": true, "raise": 1},
+			code:    http.StatusOK,
+			want:    quotaResponse{Used: 0, MonthlyQuota: 1001},
+		},
+		{
+			name:    "negative raise",
+			quota:   1000,
+			request: map[string]any{"raise": -1},
+			code:    http.StatusBadRequest,
+		},
+		{
+			name:    "negative quota",
+			quota:   1000,
+			request: map[string]any{"monthlyQuota": -1},
+			code:    http.StatusBadRequest,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := fmt.Sprintf("quota%d.example.com", i)
+			recordUsage(t, name, 1200)
+			cached := &auth.Domain{Name: name, MonthlyQuota: test.quota}
+			store := &stubStore{domains: map[string]*auth.Domain{name: cached}}
+			admin := newTestAdmin(store)
+
+			var status quotaResponse
+			code := call(t, admin, http.MethodPost, "/domains/"+name+"/quota", test.request, &status)
+			if code != test.code {
+				t.Fatalf("answered %d, want %d", code, test.code)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			if status != test.want {
+				t.Errorf("status = %+v, want %+v", status, test.want)
+			}
+			if cached.MonthlyQuota != test.quota || cached.QuotaResetBytes != 0 {
+				t.Errorf("the cached domain was changed: %+v", cached)
+			}
+
+			var stored quotaResponse
+			if code := call(t, admin, http.MethodGet, "/domains/"+name+"/quota", nil, &stored); code != http.StatusOK || stored != test.want {
+				t.Errorf("stored status = %+v (%d), want %+v", stored, code, test.want)
+			}
+		})
+	}
+}
+
+func TestUpdateQuotaFailure(t *testing.T) {
+	cached := &auth.Domain{Name: "failure.example.com", MonthlyQuota: 1000}
+	store := &stubStore{domains: map[string]*auth.Domain{cached.Name: cached}, err: errors.New("unavailable")}
+	admin := newTestAdmin(store)
+
+	request := map[string]any{"reset": true, "raise": 500}
+	if code := call(t, admin, http.MethodPost, "/domains/failure.example.com/quota", request, nil); code != http.StatusInternalServerError {
+		t.Fatalf("answered %d", code)
+	}
+	if cached.MonthlyQuota != 1000 || cached.QuotaResetMonth != "" {
+		t.Fatalf("failed update changed the cached domain: %+v", cached)
+	}
+	if code := call(t, admin, http.MethodPost, "/domains/unknown.example.com/quota", request, nil); code != http.StatusNotFound {
+		t.Fatalf("unknown domain answered %d", code)
+	}
+}
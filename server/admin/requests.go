@@ -0,0 +1,119 @@
+package admin
+
+import (
+	"cmp"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/gin-gonic/gin"
+)
+
+type requestCount struct {
+	Method      string `json:"method"`
+	StatusClass string `json:"statusClass"`
+	Requests    int64  `json:"requests"`
+	LatencyMs   int64  `json:"latencyMs"`
+}
+
+type latencyBucket struct {
+	LeMs     int64 `json:"leMs"`
+	Requests int64 `json:"requests"`
+}
+
+// getRequests summarizes the HTTP requests answered for a domain between the
+// from and to dates (inclusive; today by default).
+func (r *router) getRequests(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	today := time.Now().Format("2006-01-02")
+	from, err := time.Parse("2006-01-02", c.DefaultQuery("from", today))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+	to, err := time.Parse("2006-01-02", c.DefaultQuery("to", today))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' parameter"})
+		return
+	}
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get config"})
+		return
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to connect to database"})
+		return
+	}
+
+	domainName := c.Param("domainName")
+	var counts []requestCount
+	err = connection.Model(&db.DailyRequests{}).
+		Select("method, status_class, SUM(requests) AS requests, SUM(latency_ms) AS latency_ms").
+		Where("domain = ? AND date >= ? AND date <= ?", domainName, from, to).
+		Group("method, status_class").
+		Order("method, status_class").
+		Scan(&counts).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get requests"})
+		return
+	}
+
+	var histogram []latencyBucket
+	err = connection.Model(&db.DailyLatency{}).
+		Select("le_ms, SUM(requests) AS requests").
+		Where("domain = ? AND date >= ? AND date <= ?", domainName, from, to).
+		Group("le_ms").
+		Scan(&histogram).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get latencies"})
+		return
+	}
+	sortBuckets(histogram)
+
+	var total, errors, latency int64
+	for _, count := range counts {
+		total += count.Requests
+		latency += count.LatencyMs
+		if count.StatusClass == "5xx" {
+			errors += count.Requests
+		}
+	}
+
+	summary := gin.H{
+		"domain":   domainName,
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"requests": total,
+		"counts":   counts,
+		"latency":  histogram,
+	}
+	if total > 0 {
+		summary["errorRate"] = float64(errors) / float64(total)
+		summary["averageLatencyMs"] = float64(latency) / float64(total)
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// sortBuckets orders the histogram by upper bound, with the open-ended
+// bucket (-1) last.
+func sortBuckets(buckets []latencyBucket) {
+	key := func(b latencyBucket) int64 {
+		if b.LeMs < 0 {
+			return math.MaxInt64
+		}
+		return b.LeMs
+	}
+	slices.SortFunc(buckets, func(a, b latencyBucket) int {
+		return cmp.Compare(key(a), key(b))
+	})
+}
@@ -1,11 +1,14 @@
 package admin
 
 import (
+	"crypto/subtle"
+	"errors"
 	"log"
 	"net/http"
 
 	"github.com/OnnaSoft/lipstick/server/auth"
 	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/metrics"
 	"github.com/gin-gonic/gin"
 )
 
@@ -18,6 +21,7 @@ func configureRouter(admin *Admin) {
 	r := gin.New()
 
 	r.GET("/health", router.health)
+	r.GET("/metrics", router.metrics)
 
 	r.GET("/domains", router.getDomains)
 	const domainNamePath = "/domains/:domainName"
@@ -26,6 +30,21 @@ func configureRouter(admin *Admin) {
 	r.POST("/domains", router.addDomain)
 	r.PATCH(domainNamePath, router.updateDomain)
 	r.DELETE(domainNamePath, router.deleteDomain)
+	r.GET(domainNamePath+"/quota", router.getQuota)
+	r.POST(domainNamePath+"/quota", router.updateQuota)
+	r.GET(domainNamePath+"/requests", router.getRequests)
+	r.GET(domainNamePath+"/tokens", router.getTokens)
+	r.POST(domainNamePath+"/tokens", router.addToken)
+	r.DELETE(domainNamePath+"/tokens/:tokenId", router.deleteToken)
+
+	r.GET("/accounts", router.getAccounts)
+	r.POST("/accounts", router.addAccount)
+	r.DELETE("/accounts/:accountName", router.deleteAccount)
+
+	r.GET("/connections", router.getConnections)
+
+	r.GET("/cluster/nodes", router.getClusterNodes)
+	r.GET("/cluster/sessions", router.getClusterSessions)
 
 	admin.engine = r
 }
@@ -40,6 +59,26 @@ func isAuthorized(c *gin.Context) bool {
 	return authorization == conf.AdminSecretKey
 }
 
+// domainError answers a domain the store could not return, which is 404
+// when the domain does not exist.
+func domainError(c *gin.Context, err error) {
+	if errors.Is(err, auth.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Domain not found"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get domain"})
+}
+
+// storeError answers a change the domain store refused. Read-only stores are
+// managed outside the admin API.
+func storeError(c *gin.Context, err error, message string) {
+	if errors.Is(err, auth.ErrReadOnly) {
+		c.JSON(http.StatusMethodNotAllowed, gin.H{"error": "The domain store is read-only"})
+		return
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
 func (r *router) getDomains(c *gin.Context) {
 	if !isAuthorized(c) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
@@ -64,7 +103,7 @@ func (r *router) getDomain(c *gin.Context) {
 	domainName := c.Param("domainName")
 	domain, err := r.admin.authManager.GetDomain(domainName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "unable to get domain"})
+		domainError(c, err)
 		return
 	}
 
@@ -82,9 +121,17 @@ func (r *router) addDomain(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err := validateDomain(domain); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := hashCredentials(domain); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to hash credentials"})
+		return
+	}
 
 	if err := r.admin.authManager.AddDomain(domain); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to add domain"})
+		storeError(c, err, "Unable to add domain")
 		return
 	}
 
@@ -106,7 +153,7 @@ func (r *router) updateDomain(c *gin.Context) {
 	domainName := c.Param("domainName")
 	record, err := r.admin.authManager.GetDomain(domainName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get domain"})
+		domainError(c, err)
 		return
 	}
 
@@ -116,9 +163,66 @@ func (r *router) updateDomain(c *gin.Context) {
 	if _, ok := domain["allowMultipleConnections"]; ok {
 		record.AllowMultipleConnections = domain["allowMultipleConnections"].(bool)
 	}
+	if value, ok := domain["aliases"]; ok {
+		if record.Aliases, ok = toStringSlice(value); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "aliases must be a list of strings"})
+			return
+		}
+	}
+	if value, ok := domain["wildcards"]; ok {
+		if record.Wildcards, ok = toStringSlice(value); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "wildcards must be a list of strings"})
+			return
+		}
+	}
+	if value, ok := domain["allowCidrs"]; ok {
+		if record.AllowCIDRs, ok = toStringSlice(value); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "allowCidrs must be a list of strings"})
+			return
+		}
+	}
+	if value, ok := domain["denyCidrs"]; ok {
+		if record.DenyCIDRs, ok = toStringSlice(value); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "denyCidrs must be a list of strings"})
+			return
+		}
+	}
+	if value, ok := domain["basicAuth"]; ok {
+		record.BasicAuth = nil
+		if err := decodeValue(value, &record.BasicAuth); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "basicAuth must be a list of credentials"})
+			return
+		}
+	}
+	if value, ok := domain["oidc"]; ok {
+		record.OIDC = nil
+		if err := decodeValue(value, &record.OIDC); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid oidc settings"})
+			return
+		}
+	}
+	if value, ok := domain["routes"]; ok {
+		record.Routes = nil
+		if err := decodeValue(value, &record.Routes); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "routes must be a list of route rules"})
+			return
+		}
+	}
+	if err := decodeLimits(domain, record); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateDomain(record); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := hashCredentials(record); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to hash credentials"})
+		return
+	}
 
 	if err := r.admin.authManager.UpdateDomain(record); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to update domain"})
+		storeError(c, err, "Unable to update domain")
 		return
 	}
 
@@ -134,12 +238,72 @@ func (r *router) deleteDomain(c *gin.Context) {
 	domainName := c.Param("domainName")
 	record, err := r.admin.authManager.GetDomain(domainName)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get domain"})
+		domainError(c, err)
 		return
 	}
 
 	if err := r.admin.authManager.DelDomain(record.ID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to delete domain"})
+		storeError(c, err, "Unable to delete domain")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (r *router) getAccounts(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	accounts, err := r.admin.authManager.GetAccounts()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get accounts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+func (r *router) addAccount(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	account := &auth.Account{}
+	if err := c.BindJSON(account); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if account.Name == "" || account.ApiKey == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and apiKey are required"})
+		return
+	}
+
+	if err := r.admin.authManager.AddAccount(account); err != nil {
+		storeError(c, err, "Unable to add account")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+func (r *router) deleteAccount(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	accountName := c.Param("accountName")
+	record, err := r.admin.authManager.GetAccount(accountName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get account"})
+		return
+	}
+
+	if err := r.admin.authManager.DelAccount(record.ID); err != nil {
+		storeError(c, err, "Unable to delete account")
 		return
 	}
 
@@ -149,3 +313,18 @@ func (r *router) deleteDomain(c *gin.Context) {
 func (r *router) health(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
+
+func (r *router) metrics(c *gin.Context) {
+	conf, err := config.GetConfig()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get config"})
+		return
+	}
+	authorization := []byte(c.Request.Header.Get("Authorization"))
+	if conf.Metrics.Token != "" && subtle.ConstantTimeCompare(authorization, []byte("Bearer "+conf.Metrics.Token)) != 1 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	metrics.Default.Handler().ServeHTTP(c.Writer, c.Request)
+}
@@ -0,0 +1,33 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsToken(t *testing.T) {
+	admin := newTestAdmin(&stubStore{})
+	tests := []struct {
+		authorization string
+		code          int
+	}{
+		{"", http.StatusUnauthorized},
+		{testMetricsToken, http.StatusUnauthorized},
+		{"Bearer wrong-token", http.StatusUnauthorized},
+		{"Bearer " + testMetricsToken + "x", http.StatusUnauthorized},
+		{testSecret, http.StatusUnauthorized},
+		{"Bearer " + testMetricsToken, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		res := httptest.NewRecorder()
+		admin.engine.ServeHTTP(res, req)
+		if res.Code != test.code {
+			t.Errorf("Authorization %q answered %d, want %d", test.authorization, res.Code, test.code)
+		}
+	}
+}
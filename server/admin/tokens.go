@@ -0,0 +1,138 @@
+package admin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/gin-gonic/gin"
+)
+
+var knownScopes = []string{auth.ScopeTrafficRead, auth.ScopeAgentConnect}
+
+func newToken() (id, token string, err error) {
+	b := make([]byte, 28)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:4]), "lst_" + hex.EncodeToString(b[4:]), nil
+}
+
+func (r *router) getTokens(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	domain, err := r.admin.authManager.GetDomain(c.Param("domainName"))
+	if err != nil {
+		domainError(c, err)
+		return
+	}
+
+	tokens := domain.Tokens
+	if tokens == nil {
+		tokens = []auth.ApiToken{}
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// addToken creates a token for the domain. The token itself is only returned
+// in this response.
+func (r *router) addToken(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	request := struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}{}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Scopes) == 0 {
+		request.Scopes = []string{auth.ScopeTrafficRead}
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(knownScopes, scope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope " + scope})
+			return
+		}
+	}
+
+	domain, err := r.admin.authManager.GetDomain(c.Param("domainName"))
+	if err != nil {
+		domainError(c, err)
+		return
+	}
+
+	id, token, err := newToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to generate token"})
+		return
+	}
+	record := auth.ApiToken{
+		ID:        id,
+		Name:      request.Name,
+		Hash:      auth.HashToken(token),
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	tokens := append(slices.Clone(domain.Tokens), record)
+	if err := r.admin.authManager.UpdateDomain(withTokens(domain, tokens)); err != nil {
+		storeError(c, err, "Unable to update domain")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":        record.ID,
+		"name":      record.Name,
+		"scopes":    record.Scopes,
+		"createdAt": record.CreatedAt,
+		"token":     token,
+	})
+}
+
+func (r *router) deleteToken(c *gin.Context) {
+	if !isAuthorized(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	domain, err := r.admin.authManager.GetDomain(c.Param("domainName"))
+	if err != nil {
+		domainError(c, err)
+		return
+	}
+
+	tokenID := c.Param("tokenId")
+	index := slices.IndexFunc(domain.Tokens, func(token auth.ApiToken) bool {
+		return token.ID == tokenID
+	})
+	if index < 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	tokens := slices.Delete(slices.Clone(domain.Tokens), index, index+1)
+	if err := r.admin.authManager.UpdateDomain(withTokens(domain, tokens)); err != nil {
+		storeError(c, err, "Unable to update domain")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// withTokens returns a copy of domain holding tokens. Stores may return the
+// domain they cache, which hubs read concurrently, so it is never modified in
+// place, nor left changed when the update fails.
+func withTokens(domain *auth.Domain, tokens []auth.ApiToken) *auth.Domain {
+	updated := *domain
+	updated.Tokens = tokens
+	return &updated
+}
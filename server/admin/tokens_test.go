@@ -0,0 +1,44 @@
+package admin
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+func TestTokensKeepCachedDomain(t *testing.T) {
+	cached := &auth.Domain{
+		Name:   "example.com",
+		Tokens: make([]auth.ApiToken, 2, 4),
+	}
+	cached.Tokens[0] = auth.ApiToken{ID: "first"}
+	cached.Tokens[1] = auth.ApiToken{ID: "second"}
+	store := &stubStore{domains: map[string]*auth.Domain{"example.com": cached}}
+	admin := newTestAdmin(store)
+
+	store.err = errors.New("unavailable")
+	if code := call(t, admin, http.MethodPost, "/domains/example.com/tokens", map[string]any{"name": "ci"}, nil); code != http.StatusInternalServerError {
+		t.Fatalf("failed add answered %d", code)
+	}
+	if len(cached.Tokens) != 2 || cached.Tokens[:3][2].ID != "" {
+		t.Fatalf("failed add changed the cached domain: %+v", cached.Tokens[:3])
+	}
+
+	store.err = nil
+	if code := call(t, admin, http.MethodDelete, "/domains/example.com/tokens/first", nil, nil); code != http.StatusOK {
+		t.Fatalf("delete answered %d", code)
+	}
+	if len(cached.Tokens) != 2 || cached.Tokens[0].ID != "first" || cached.Tokens[1].ID != "second" {
+		t.Fatalf("delete changed the cached domain: %+v", cached.Tokens)
+	}
+	if tokens := store.domains["example.com"].Tokens; len(tokens) != 1 || tokens[0].ID != "second" {
+		t.Fatalf("stored tokens = %+v", tokens)
+	}
+
+	var listed []auth.ApiToken
+	if code := call(t, admin, http.MethodGet, "/domains/example.com/tokens", nil, &listed); code != http.StatusOK || len(listed) != 1 {
+		t.Fatalf("list answered %d with %+v", code, listed)
+	}
+}
@@ -0,0 +1,204 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/edgeauth"
+)
+
+func toStringSlice(value interface{}) ([]string, bool) {
+	if value == nil {
+		return nil, true
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, false
+	}
+
+	result := make([]string, 0, len(items))
+	for _, item := range items {
+		str, ok := item.(string)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, str)
+	}
+	return result, true
+}
+
+// decodeValue converts a value taken from a generic JSON object into target.
+func decodeValue(value interface{}, target interface{}) error {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, target)
+}
+
+func validateDomain(domain *auth.Domain) error {
+	if err := validateHostnames(domain); err != nil {
+		return err
+	}
+	if err := validateCIDRs(domain.AllowCIDRs); err != nil {
+		return err
+	}
+	if err := validateCIDRs(domain.DenyCIDRs); err != nil {
+		return err
+	}
+	if err := validateEdgeAuth(domain); err != nil {
+		return err
+	}
+	if err := validateLimits(domain); err != nil {
+		return err
+	}
+	return validateRoutes(domain.Routes)
+}
+
+// decodeLimits copies the connection, bandwidth and quota settings present
+// in a PATCH body.
+func decodeLimits(values map[string]interface{}, domain *auth.Domain) error {
+	fields := map[string]interface{}{
+		"maxConnections":    &domain.MaxConnections,
+		"connectionRate":    &domain.ConnectionRate,
+		"connectionBurst":   &domain.ConnectionBurst,
+		"rateLimitPerIp":    &domain.RateLimitPerIP,
+		"maxPendingTickets": &domain.MaxPendingTickets,
+		"uploadRate":        &domain.UploadRate,
+		"downloadRate":      &domain.DownloadRate,
+		"agentUploadRate":   &domain.AgentUploadRate,
+		"agentDownloadRate": &domain.AgentDownloadRate,
+		"monthlyQuota":      &domain.MonthlyQuota,
+		"quotaAction":       &domain.QuotaAction,
+		"quotaThrottleRate": &domain.QuotaThrottleRate,
+		"quotaPage":         &domain.QuotaPage,
+		"quotaWarnings":     &domain.QuotaWarnings,
+	}
+	for key, target := range fields {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		if err := decodeValue(value, target); err != nil {
+			return fmt.Errorf("invalid %s", key)
+		}
+	}
+	return nil
+}
+
+func validateLimits(domain *auth.Domain) error {
+	if domain.MaxConnections < 0 || domain.ConnectionBurst < 0 || domain.MaxPendingTickets < 0 {
+		return fmt.Errorf("connection limits must not be negative")
+	}
+	if domain.ConnectionRate < 0 {
+		return fmt.Errorf("connectionRate must not be negative")
+	}
+	if domain.UploadRate < 0 || domain.DownloadRate < 0 || domain.AgentUploadRate < 0 || domain.AgentDownloadRate < 0 {
+		return fmt.Errorf("bandwidth limits must not be negative")
+	}
+	return validateQuota(domain)
+}
+
+func validateQuota(domain *auth.Domain) error {
+	if domain.MonthlyQuota < 0 || domain.QuotaThrottleRate < 0 {
+		return fmt.Errorf("quota settings must not be negative")
+	}
+	switch domain.QuotaAction {
+	case "", auth.QuotaReject:
+	case auth.QuotaThrottle:
+		if domain.QuotaThrottleRate == 0 {
+			return fmt.Errorf("quotaThrottleRate is required to throttle")
+		}
+	default:
+		return fmt.Errorf("invalid quotaAction %q", domain.QuotaAction)
+	}
+	for _, threshold := range domain.QuotaWarnings {
+		if threshold <= 0 || threshold > 100 {
+			return fmt.Errorf("quota warnings must be percentages between 1 and 100")
+		}
+	}
+	return nil
+}
+
+func validateEdgeAuth(domain *auth.Domain) error {
+	for _, credential := range domain.BasicAuth {
+		if credential.Username == "" || strings.Contains(credential.Username, ":") {
+			return fmt.Errorf("invalid basic auth username %q", credential.Username)
+		}
+		if credential.Password == "" && credential.PasswordHash == "" {
+			return fmt.Errorf("missing password for basic auth user %q", credential.Username)
+		}
+	}
+
+	if domain.OIDC != nil {
+		issuer, err := url.Parse(domain.OIDC.Issuer)
+		if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && issuer.Scheme != "http") {
+			return fmt.Errorf("invalid oidc issuer %q", domain.OIDC.Issuer)
+		}
+		if domain.OIDC.ClientID == "" {
+			return fmt.Errorf("oidc clientId is required")
+		}
+	}
+	return nil
+}
+
+// hashCredentials replaces plain basic auth passwords with their hash so
+// they are never stored.
+func hashCredentials(domain *auth.Domain) error {
+	for i := range domain.BasicAuth {
+		credential := &domain.BasicAuth[i]
+		if credential.Password == "" {
+			continue
+		}
+		hash, err := edgeauth.HashPassword(credential.Password)
+		if err != nil {
+			return err
+		}
+		credential.PasswordHash = hash
+		credential.Password = ""
+	}
+	return nil
+}
+
+func validateCIDRs(cidrs []string) error {
+	for _, cidr := range cidrs {
+		if _, err := helper.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid CIDR %q", cidr)
+		}
+	}
+	return nil
+}
+
+func validateRoutes(routes []auth.Route) error {
+	for _, route := range routes {
+		if !strings.HasPrefix(route.PathPrefix, "/") {
+			return fmt.Errorf("invalid route path prefix %q, it must start with /", route.PathPrefix)
+		}
+		if route.Group == "" || strings.ContainsAny(route.Group, ":, ") {
+			return fmt.Errorf("invalid route group %q for prefix %s", route.Group, route.PathPrefix)
+		}
+		if route.Header == "" && route.HeaderValue != "" {
+			return fmt.Errorf("route %s sets headerValue without header", route.PathPrefix)
+		}
+	}
+	return nil
+}
+
+func validateHostnames(domain *auth.Domain) error {
+	for _, alias := range domain.Aliases {
+		if alias == "" || strings.ContainsAny(alias, "*:/ ") {
+			return fmt.Errorf("invalid alias %q", alias)
+		}
+	}
+	for _, pattern := range domain.Wildcards {
+		rest, ok := strings.CutPrefix(pattern, "*.")
+		if !ok || rest == "" || strings.ContainsAny(rest, "*:/ ") {
+			return fmt.Errorf("invalid wildcard %q, expected a pattern like *.example.com", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+// Package authtest holds the behaviour every domain store must have. A store
+// runs it from its own tests:
+//
+//	func TestSQLite(t *testing.T) {
+//		authtest.Run(t, func(t *testing.T, seed authtest.Seed) auth.AuthManager { ... })
+//	}
+//
+// Read-only stores must refuse every change with auth.ErrReadOnly; the other
+// stores must apply changes at once, without waiting for their caches.
+package authtest
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// Seed lists the domains and accounts a new store must hold.
+type Seed struct {
+	Domains  []*auth.Domain
+	Accounts []*auth.Account
+}
+
+// Factory returns a new store holding seed. The factory is responsible for
+// releasing it, for example with t.Cleanup.
+type Factory func(t *testing.T, seed Seed) auth.AuthManager
+
+// Timeout bounds how long OnChange listeners may take to be called.
+var Timeout = 5 * time.Second
+
+func defaultSeed() Seed {
+	return Seed{
+		Domains: []*auth.Domain{
+			{
+				Name:                     "example.com",
+				ApiKey:                   "example-key",
+				AllowMultipleConnections: true,
+				Aliases:                  []string{"www.example.com"},
+				Wildcards:                []string{"*.preview.example.com"},
+				AllowCIDRs:               []string{"10.0.0.0/8"},
+				Routes:                   []auth.Route{{PathPrefix: "/api", Group: "api"}},
+				MaxConnections:           10,
+				UploadRate:               1024,
+				Tokens: []auth.ApiToken{{
+					ID:     "t1",
+					Name:   "agents",
+					Hash:   auth.HashToken("agent-token"),
+					Scopes: []string{auth.ScopeAgentConnect},
+				}},
+			},
+			{Name: "other.example.org", ApiKey: "other-key"},
+		},
+		Accounts: []*auth.Account{{Name: "ci", ApiKey: "account-key"}},
+	}
+}
+
+func Run(t *testing.T, factory Factory) {
+	t.Run("Domains", func(t *testing.T) { testDomains(t, factory) })
+	t.Run("NotFound", func(t *testing.T) { testNotFound(t, factory) })
+	t.Run("Authorize", func(t *testing.T) { testAuthorize(t, factory) })
+	t.Run("Accounts", func(t *testing.T) { testAccounts(t, factory) })
+	t.Run("Changes", func(t *testing.T) { testChanges(t, factory) })
+}
+
+func getDomain(t *testing.T, store auth.AuthManager, name string) *auth.Domain {
+	t.Helper()
+
+	domain, err := store.GetDomain(name)
+	if err != nil {
+		t.Fatalf("GetDomain(%q): %v", name, err)
+	}
+	return domain
+}
+
+func testDomains(t *testing.T, factory Factory) {
+	seed := defaultSeed()
+	store := factory(t, seed)
+
+	domains, err := store.GetDomains()
+	if err != nil {
+		t.Fatalf("GetDomains: %v", err)
+	}
+	if len(domains) != len(seed.Domains) {
+		t.Fatalf("GetDomains returned %d domains, want %d", len(domains), len(seed.Domains))
+	}
+
+	want := seed.Domains[0]
+	got := getDomain(t, store, want.Name)
+	if got.ID == 0 {
+		t.Error("domain has no ID")
+	}
+	if got.ApiKey != want.ApiKey || !got.AllowMultipleConnections {
+		t.Errorf("got key %q and multiple connections %v", got.ApiKey, got.AllowMultipleConnections)
+	}
+	if !slices.Equal(got.Aliases, want.Aliases) || !slices.Equal(got.Wildcards, want.Wildcards) {
+		t.Errorf("got aliases %v and wildcards %v", got.Aliases, got.Wildcards)
+	}
+	if !slices.Equal(got.AllowCIDRs, want.AllowCIDRs) {
+		t.Errorf("got allowed CIDRs %v", got.AllowCIDRs)
+	}
+	if len(got.Routes) != 1 || got.Routes[0] != want.Routes[0] {
+		t.Errorf("got routes %v", got.Routes)
+	}
+	if got.MaxConnections != want.MaxConnections || got.UploadRate != want.UploadRate {
+		t.Errorf("got max connections %d and upload rate %d", got.MaxConnections, got.UploadRate)
+	}
+}
+
+func testNotFound(t *testing.T, factory Factory) {
+	store := factory(t, defaultSeed())
+
+	for i := 0; i < 2; i++ {
+		if _, err := store.GetDomain("missing.example.com"); !errors.Is(err, auth.ErrNotFound) {
+			t.Fatalf("GetDomain of a missing domain returned %v, want ErrNotFound", err)
+		}
+	}
+	if _, err := store.GetAccountByKey("missing-key"); !errors.Is(err, auth.ErrNotFound) {
+		t.Fatalf("GetAccountByKey of a missing key returned %v, want ErrNotFound", err)
+	}
+}
+
+func testAuthorize(t *testing.T, factory Factory) {
+	store := factory(t, defaultSeed())
+	domain := getDomain(t, store, "example.com")
+
+	cases := []struct {
+		credential, scope string
+		want              bool
+	}{
+		{"example-key", auth.ScopeAgentConnect, true},
+		{"example-key", auth.ScopeTrafficRead, true},
+		{"agent-token", auth.ScopeAgentConnect, true},
+		{"agent-token", auth.ScopeTrafficRead, false},
+		{"other-key", auth.ScopeAgentConnect, false},
+		{"", auth.ScopeAgentConnect, false},
+	}
+	for _, c := range cases {
+		if got := domain.Authorize(c.credential, c.scope); got != c.want {
+			t.Errorf("Authorize(%q, %q) = %v, want %v", c.credential, c.scope, got, c.want)
+		}
+	}
+}
+
+func testAccounts(t *testing.T, factory Factory) {
+	store := factory(t, defaultSeed())
+
+	accounts, err := store.GetAccounts()
+	if err != nil || len(accounts) != 1 {
+		t.Fatalf("GetAccounts returned %v, %v", accounts, err)
+	}
+	account, err := store.GetAccountByKey("account-key")
+	if err != nil || account.Name != "ci" {
+		t.Fatalf("GetAccountByKey returned %v, %v", account, err)
+	}
+	account, err = store.GetAccount("ci")
+	if err != nil || account.ApiKey != "account-key" {
+		t.Fatalf("GetAccount returned %v, %v", account, err)
+	}
+}
+
+// changes collects the names passed to OnChange listeners.
+type changes chan []string
+
+func (c changes) expect(t *testing.T, names ...string) {
+	t.Helper()
+
+	deadline := time.After(Timeout)
+	pending := slices.Clone(names)
+	for len(pending) > 0 {
+		select {
+		case changed := <-c:
+			pending = slices.DeleteFunc(pending, func(name string) bool {
+				return slices.Contains(changed, name)
+			})
+		case <-deadline:
+			t.Fatalf("OnChange not called for %v", pending)
+		}
+	}
+}
+
+func testChanges(t *testing.T, factory Factory) {
+	store := factory(t, defaultSeed())
+	changed := make(changes, 16)
+	store.OnChange(func(domains []string) { changed <- domains })
+
+	// Cache the absence of the new domain first, as a visitor would.
+	store.GetDomain("new.example.com")
+
+	err := store.AddDomain(&auth.Domain{Name: "new.example.com", ApiKey: "new-key"})
+	if errors.Is(err, auth.ErrReadOnly) {
+		testReadOnly(t, store)
+		return
+	}
+	if err != nil {
+		t.Fatalf("AddDomain: %v", err)
+	}
+	changed.expect(t, "new.example.com")
+	if got := getDomain(t, store, "new.example.com"); got.ApiKey != "new-key" {
+		t.Fatalf("added domain has key %q", got.ApiKey)
+	}
+
+	domain := getDomain(t, store, "example.com")
+	domain.Name = "renamed.example.com"
+	domain.ApiKey = "rotated-key"
+	if err := store.UpdateDomain(domain); err != nil {
+		t.Fatalf("UpdateDomain: %v", err)
+	}
+	changed.expect(t, "example.com", "renamed.example.com")
+	if _, err := store.GetDomain("example.com"); !errors.Is(err, auth.ErrNotFound) {
+		t.Fatalf("renamed domain still found by its old name: %v", err)
+	}
+	if got := getDomain(t, store, "renamed.example.com"); got.ApiKey != "rotated-key" {
+		t.Fatalf("updated domain has key %q", got.ApiKey)
+	}
+
+	if err := store.DelDomain(domain.ID); err != nil {
+		t.Fatalf("DelDomain: %v", err)
+	}
+	changed.expect(t, "renamed.example.com")
+	if _, err := store.GetDomain("renamed.example.com"); !errors.Is(err, auth.ErrNotFound) {
+		t.Fatalf("deleted domain still found: %v", err)
+	}
+
+	store.GetAccountByKey("new-account-key")
+	if err := store.AddAccount(&auth.Account{Name: "deploy", ApiKey: "new-account-key"}); err != nil {
+		t.Fatalf("AddAccount: %v", err)
+	}
+	account, err := store.GetAccountByKey("new-account-key")
+	if err != nil {
+		t.Fatalf("added account not found: %v", err)
+	}
+	if err := store.DelAccount(account.ID); err != nil {
+		t.Fatalf("DelAccount: %v", err)
+	}
+	if _, err := store.GetAccountByKey("new-account-key"); !errors.Is(err, auth.ErrNotFound) {
+		t.Fatalf("deleted account still found: %v", err)
+	}
+}
+
+func testReadOnly(t *testing.T, store auth.AuthManager) {
+	domain := getDomain(t, store, "example.com")
+	domain.ApiKey = "rotated-key"
+
+	writes := map[string]error{
+		"UpdateDomain": store.UpdateDomain(domain),
+		"DelDomain":    store.DelDomain(domain.ID),
+		"AddAccount":   store.AddAccount(&auth.Account{Name: "deploy", ApiKey: "new-account-key"}),
+		"DelAccount":   store.DelAccount(1),
+	}
+	for name, err := range writes {
+		if !errors.Is(err, auth.ErrReadOnly) {
+			t.Errorf("%s returned %v, want ErrReadOnly", name, err)
+		}
+	}
+	if got := getDomain(t, store, "example.com"); got.ApiKey != "example-key" {
+		t.Fatalf("refused change was applied: key %q", got.ApiKey)
+	}
+}
@@ -0,0 +1,522 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/backplane"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"gorm.io/gorm"
+)
+
+// invalidationTopic carries the domains and accounts changed through the
+// admin API of any server, so that every server drops them from its cache.
+const invalidationTopic = "auth.invalidate"
+
+// invalidation names the changed domains and the hashes of the changed
+// account keys, which are never broadcast in clear.
+type invalidation struct {
+	Domains  []string `json:"domains,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+}
+
+// DatabaseAuthManager keeps domains and accounts in a database through gorm:
+// the server database, PostgreSQL or SQLite, or a SQLite file of its own.
+type DatabaseAuthManager struct {
+	db          *gorm.DB
+	cache       sync.Map
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+	cacheMutex  sync.Mutex
+	backplane   backplane.Backplane
+	listenersMu sync.Mutex
+	listeners   []func(domains []string)
+}
+
+// cacheEntry holds a lookup result, or ErrNotFound for a negative entry.
+type cacheEntry struct {
+	data      interface{}
+	err       error
+	timestamp time.Time
+}
+
+// NewDatabaseAuthManager uses conn, whose domains and accounts tables must
+// exist. Changes are broadcast to the other servers over bp unless it is nil.
+func NewDatabaseAuthManager(conn *gorm.DB, conf config.AuthCacheConfig, bp backplane.Backplane) *DatabaseAuthManager {
+	p := &DatabaseAuthManager{
+		db:          conn,
+		cacheTTL:    time.Duration(conf.TTL) * time.Second,
+		negativeTTL: time.Duration(conf.NegativeTTL) * time.Second,
+	}
+	if bp != nil {
+		p.subscribe(bp)
+	}
+	go p.sweep()
+	return p
+}
+
+// NewSQLiteAuthManager keeps domains and accounts in the SQLite file at path,
+// apart from the server database.
+func NewSQLiteAuthManager(path string, conf config.AuthCacheConfig, bp backplane.Backplane) (*DatabaseAuthManager, error) {
+	conn, err := db.NewConnection(config.DatabaseConfig{Driver: config.DriverSQLite, Path: path})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.MigrateConnection(conn); err != nil {
+		return nil, err
+	}
+	return NewDatabaseAuthManager(conn, conf, bp), nil
+}
+
+// sweep drops expired entries every minute. Negative entries in particular
+// are keyed by whatever hostname visitors sent and are rarely looked up again.
+func (p *DatabaseAuthManager) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.cache.Range(func(key, _ any) bool {
+			p.lookupCache(key.(string))
+			return true
+		})
+	}
+}
+
+// subscribe listens for the changes made on other servers. Without a
+// backplane they only reach this server once its cache expires.
+func (p *DatabaseAuthManager) subscribe(bp backplane.Backplane) {
+	if _, err := bp.SubscribeBroadcast(invalidationTopic, p.receiveInvalidation); err != nil {
+		log.Printf("Auth cache invalidation disabled: %v", err)
+		return
+	}
+	p.backplane = bp
+}
+
+func (p *DatabaseAuthManager) OnChange(listener func(domains []string)) {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+
+	p.listeners = append(p.listeners, listener)
+}
+
+// invalidate drops the changed entries here and tells the other servers.
+// Listeners are called when the broadcast comes back, or right away when it
+// cannot be sent.
+func (p *DatabaseAuthManager) invalidate(event invalidation) {
+	p.evict(event)
+
+	if p.backplane != nil {
+		data, err := json.Marshal(event)
+		if err == nil {
+			err = p.backplane.Broadcast(invalidationTopic, data)
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("Error broadcasting auth cache invalidation: %v", err)
+	}
+	p.notify(event.Domains)
+}
+
+func (p *DatabaseAuthManager) receiveInvalidation(data []byte) {
+	var event invalidation
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Printf("Invalid auth cache invalidation: %v", err)
+		return
+	}
+	p.evict(event)
+	p.notify(event.Domains)
+}
+
+func (p *DatabaseAuthManager) evict(event invalidation) {
+	for _, name := range event.Domains {
+		p.cache.Delete("domain_" + name)
+	}
+	for _, hash := range event.Accounts {
+		p.cache.Delete("account_" + hash)
+	}
+	p.cache.Delete("all_domains")
+}
+
+func (p *DatabaseAuthManager) notify(domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+	p.listenersMu.Lock()
+	listeners := append([]func([]string){}, p.listeners...)
+	p.listenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(domains)
+	}
+}
+
+func (p *DatabaseAuthManager) getCached(key string, fallback func() (interface{}, error)) (interface{}, error) {
+	if cached, found := p.lookupCache(key); found {
+		return cached.data, cached.err
+	}
+
+	p.cacheMutex.Lock()
+	defer p.cacheMutex.Unlock()
+
+	if cached, found := p.lookupCache(key); found {
+		return cached.data, cached.err
+	}
+
+	data, err := fallback()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = ErrNotFound
+	}
+	if err == nil || (errors.Is(err, ErrNotFound) && p.negativeTTL > 0) {
+		p.cache.Store(key, cacheEntry{
+			data:      data,
+			err:       err,
+			timestamp: time.Now(),
+		})
+	}
+	return data, err
+}
+
+func (p *DatabaseAuthManager) lookupCache(key string) (cacheEntry, bool) {
+	entry, found := p.cache.Load(key)
+	if !found {
+		return cacheEntry{}, false
+	}
+	cached := entry.(cacheEntry)
+	ttl := p.cacheTTL
+	if cached.err != nil {
+		ttl = p.negativeTTL
+	}
+	if time.Since(cached.timestamp) >= ttl {
+		p.cache.Delete(key)
+		return cacheEntry{}, false
+	}
+	return cached, true
+}
+
+func toDomain(domain *db.Domain) *Domain {
+	return &Domain{
+		ID:                       domain.ID,
+		Name:                     domain.Name,
+		ApiKey:                   domain.ApiKey,
+		AllowMultipleConnections: domain.AllowMultipleConnections,
+		Aliases:                  domain.Aliases,
+		Wildcards:                domain.Wildcards,
+		Routes:                   toRoutes(domain.Routes),
+		AllowCIDRs:               domain.AllowCIDRs,
+		DenyCIDRs:                domain.DenyCIDRs,
+		BasicAuth:                toBasicCredentials(domain.BasicAuth),
+		Tokens:                   toTokens(domain.Tokens),
+		OIDC:                     (*OIDCSettings)(domain.OIDC),
+		MaxConnections:           domain.MaxConnections,
+		ConnectionRate:           domain.ConnectionRate,
+		ConnectionBurst:          domain.ConnectionBurst,
+		RateLimitPerIP:           domain.RateLimitPerIP,
+		MaxPendingTickets:        domain.MaxPendingTickets,
+		UploadRate:               domain.UploadRate,
+		DownloadRate:             domain.DownloadRate,
+		AgentUploadRate:          domain.AgentUploadRate,
+		AgentDownloadRate:        domain.AgentDownloadRate,
+		MonthlyQuota:             domain.MonthlyQuota,
+		QuotaAction:              domain.QuotaAction,
+		QuotaThrottleRate:        domain.QuotaThrottleRate,
+		QuotaPage:                domain.QuotaPage,
+		QuotaWarnings:            domain.QuotaWarnings,
+		QuotaResetMonth:          domain.QuotaResetMonth,
+		QuotaResetBytes:          domain.QuotaResetBytes,
+	}
+}
+
+func toBasicCredentials(credentials []db.BasicCredential) []BasicCredential {
+	if credentials == nil {
+		return nil
+	}
+	result := make([]BasicCredential, len(credentials))
+	for i, credential := range credentials {
+		result[i] = BasicCredential{
+			Username:     credential.Username,
+			PasswordHash: credential.PasswordHash,
+		}
+	}
+	return result
+}
+
+func fromBasicCredentials(credentials []BasicCredential) []db.BasicCredential {
+	if credentials == nil {
+		return nil
+	}
+	result := make([]db.BasicCredential, len(credentials))
+	for i, credential := range credentials {
+		result[i] = db.BasicCredential{
+			Username:     credential.Username,
+			PasswordHash: credential.PasswordHash,
+		}
+	}
+	return result
+}
+
+func toTokens(tokens []db.ApiToken) []ApiToken {
+	if tokens == nil {
+		return nil
+	}
+	result := make([]ApiToken, len(tokens))
+	for i, token := range tokens {
+		result[i] = ApiToken(token)
+	}
+	return result
+}
+
+func fromTokens(tokens []ApiToken) []db.ApiToken {
+	if tokens == nil {
+		return nil
+	}
+	result := make([]db.ApiToken, len(tokens))
+	for i, token := range tokens {
+		result[i] = db.ApiToken(token)
+	}
+	return result
+}
+
+func toRoutes(routes []db.Route) []Route {
+	if routes == nil {
+		return nil
+	}
+	result := make([]Route, len(routes))
+	for i, route := range routes {
+		result[i] = Route(route)
+	}
+	return result
+}
+
+func fromRoutes(routes []Route) []db.Route {
+	if routes == nil {
+		return nil
+	}
+	result := make([]db.Route, len(routes))
+	for i, route := range routes {
+		result[i] = db.Route(route)
+	}
+	return result
+}
+
+func (p *DatabaseAuthManager) GetDomains() ([]*Domain, error) {
+	key := "all_domains"
+	data, err := p.getCached(key, func() (interface{}, error) {
+		domains := []*db.Domain{}
+		if tx := p.db.Find(&domains); tx.Error != nil {
+			return nil, tx.Error
+		}
+
+		result := make([]*Domain, len(domains))
+		for i, domain := range domains {
+			result[i] = toDomain(domain)
+		}
+		return result, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data.([]*Domain), nil
+}
+
+func (p *DatabaseAuthManager) GetDomain(domain string) (*Domain, error) {
+	key := "domain_" + domain
+	data, err := p.getCached(key, func() (interface{}, error) {
+		result := &db.Domain{}
+		tx := p.db.Where("name = ?", domain).First(result)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		return toDomain(result), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data.(*Domain), nil
+}
+
+func (p *DatabaseAuthManager) AddDomain(domain *Domain) error {
+	tx := p.db.Create(&db.Domain{
+		Name:                     domain.Name,
+		ApiKey:                   domain.ApiKey,
+		AllowMultipleConnections: domain.AllowMultipleConnections,
+		Aliases:                  domain.Aliases,
+		Wildcards:                domain.Wildcards,
+		Routes:                   fromRoutes(domain.Routes),
+		AllowCIDRs:               domain.AllowCIDRs,
+		DenyCIDRs:                domain.DenyCIDRs,
+		BasicAuth:                fromBasicCredentials(domain.BasicAuth),
+		Tokens:                   fromTokens(domain.Tokens),
+		OIDC:                     (*db.OIDCSettings)(domain.OIDC),
+		MaxConnections:           domain.MaxConnections,
+		ConnectionRate:           domain.ConnectionRate,
+		ConnectionBurst:          domain.ConnectionBurst,
+		RateLimitPerIP:           domain.RateLimitPerIP,
+		MaxPendingTickets:        domain.MaxPendingTickets,
+		UploadRate:               domain.UploadRate,
+		DownloadRate:             domain.DownloadRate,
+		AgentUploadRate:          domain.AgentUploadRate,
+		AgentDownloadRate:        domain.AgentDownloadRate,
+		MonthlyQuota:             domain.MonthlyQuota,
+		QuotaAction:              domain.QuotaAction,
+		QuotaThrottleRate:        domain.QuotaThrottleRate,
+		QuotaPage:                domain.QuotaPage,
+		QuotaWarnings:            domain.QuotaWarnings,
+		QuotaResetMonth:          domain.QuotaResetMonth,
+		QuotaResetBytes:          domain.QuotaResetBytes,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	p.invalidate(invalidation{Domains: []string{domain.Name}})
+	return nil
+}
+
+func (p *DatabaseAuthManager) UpdateDomain(domain *Domain) error {
+	previous := &db.Domain{}
+	if tx := p.db.Select("name").First(previous, domain.ID); tx.Error != nil {
+		return tx.Error
+	}
+
+	tx := p.db.Model(&db.Domain{}).Where("id = ?", domain.ID).Select(
+		"name", "api_key", "allow_multiple_connections", "aliases", "wildcards", "routes",
+		"allow_cidrs", "deny_cidrs", "basic_auth", "oidc",
+		"max_connections", "connection_rate", "connection_burst", "rate_limit_per_ip", "max_pending_tickets",
+		"upload_rate", "download_rate", "agent_upload_rate", "agent_download_rate",
+		"monthly_quota", "quota_action", "quota_throttle_rate", "quota_page", "quota_warnings",
+		"quota_reset_month", "quota_reset_bytes", "tokens",
+	).Updates(&db.Domain{
+		Name:                     domain.Name,
+		ApiKey:                   domain.ApiKey,
+		AllowMultipleConnections: domain.AllowMultipleConnections,
+		Aliases:                  domain.Aliases,
+		Wildcards:                domain.Wildcards,
+		Routes:                   fromRoutes(domain.Routes),
+		AllowCIDRs:               domain.AllowCIDRs,
+		DenyCIDRs:                domain.DenyCIDRs,
+		BasicAuth:                fromBasicCredentials(domain.BasicAuth),
+		Tokens:                   fromTokens(domain.Tokens),
+		OIDC:                     (*db.OIDCSettings)(domain.OIDC),
+		MaxConnections:           domain.MaxConnections,
+		ConnectionRate:           domain.ConnectionRate,
+		ConnectionBurst:          domain.ConnectionBurst,
+		RateLimitPerIP:           domain.RateLimitPerIP,
+		MaxPendingTickets:        domain.MaxPendingTickets,
+		UploadRate:               domain.UploadRate,
+		DownloadRate:             domain.DownloadRate,
+		AgentUploadRate:          domain.AgentUploadRate,
+		AgentDownloadRate:        domain.AgentDownloadRate,
+		MonthlyQuota:             domain.MonthlyQuota,
+		QuotaAction:              domain.QuotaAction,
+		QuotaThrottleRate:        domain.QuotaThrottleRate,
+		QuotaPage:                domain.QuotaPage,
+		QuotaWarnings:            domain.QuotaWarnings,
+		QuotaResetMonth:          domain.QuotaResetMonth,
+		QuotaResetBytes:          domain.QuotaResetBytes,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	p.invalidate(invalidation{Domains: []string{previous.Name, domain.Name}})
+	return nil
+}
+
+func (p *DatabaseAuthManager) DelDomain(id uint) error {
+	result := &db.Domain{}
+	tx := p.db.First(result, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	tx = p.db.Delete(&db.Domain{}, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	p.invalidate(invalidation{Domains: []string{result.Name}})
+	return nil
+}
+
+func (p *DatabaseAuthManager) GetAccounts() ([]*Account, error) {
+	accounts := []*db.Account{}
+	if tx := p.db.Find(&accounts); tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	result := make([]*Account, len(accounts))
+	for i, account := range accounts {
+		result[i] = &Account{
+			ID:     account.ID,
+			Name:   account.Name,
+			ApiKey: account.ApiKey,
+		}
+	}
+	return result, nil
+}
+
+func (p *DatabaseAuthManager) GetAccount(name string) (*Account, error) {
+	result := &db.Account{}
+	if tx := p.db.Where("name = ?", name).First(result); tx.Error != nil {
+		return nil, tx.Error
+	}
+	return &Account{
+		ID:     result.ID,
+		Name:   result.Name,
+		ApiKey: result.ApiKey,
+	}, nil
+}
+
+func (p *DatabaseAuthManager) GetAccountByKey(apiKey string) (*Account, error) {
+	key := "account_" + HashToken(apiKey)
+	data, err := p.getCached(key, func() (interface{}, error) {
+		result := &db.Account{}
+		tx := p.db.Where("api_key = ?", apiKey).First(result)
+		if tx.Error != nil {
+			return nil, tx.Error
+		}
+		return &Account{
+			ID:     result.ID,
+			Name:   result.Name,
+			ApiKey: result.ApiKey,
+		}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data.(*Account), nil
+}
+
+func (p *DatabaseAuthManager) AddAccount(account *Account) error {
+	tx := p.db.Create(&db.Account{
+		Name:   account.Name,
+		ApiKey: account.ApiKey,
+	})
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	p.invalidate(invalidation{Accounts: []string{HashToken(account.ApiKey)}})
+	return nil
+}
+
+func (p *DatabaseAuthManager) DelAccount(id uint) error {
+	result := &db.Account{}
+	tx := p.db.First(result, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	tx = p.db.Delete(&db.Account{}, id)
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	p.invalidate(invalidation{Accounts: []string{HashToken(result.ApiKey)}})
+	return nil
+}
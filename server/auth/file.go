@@ -0,0 +1,311 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+// FileAuthManager serves the domains and accounts listed in a YAML or JSON
+// file, for installations that manage them as code. The file is read again
+// when it changes; changes through the admin API fail with ErrReadOnly.
+//
+//	domains:
+//	  - name: example.com
+//	    apiKey: "<key>"
+//	    aliases: [www.example.com]
+//	accounts:
+//	  - name: ci
+//	    apiKey: "<account key>"
+//
+// Fields are named as in the admin API. Basic auth credentials may give a
+// clear password instead of its hash; it is hashed when the file is read.
+type FileAuthManager struct {
+	path        string
+	mu          sync.RWMutex
+	domains     []*Domain
+	byName      map[string]*Domain
+	accounts    []*Account
+	modTime     time.Time
+	size        int64
+	listenersMu sync.Mutex
+	listeners   []func(domains []string)
+	stop        chan struct{}
+	stopOnce    sync.Once
+}
+
+type storeFile struct {
+	Domains  []*Domain  `json:"domains"`
+	Accounts []*Account `json:"accounts"`
+}
+
+// NewFileAuthManager reads the file at path and checks it for changes every
+// interval until Close.
+func NewFileAuthManager(path string, interval time.Duration) (*FileAuthManager, error) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	f := &FileAuthManager{path: path, stop: make(chan struct{})}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	go f.watch(interval)
+	return f, nil
+}
+
+func (f *FileAuthManager) Close() {
+	f.stopOnce.Do(func() { close(f.stop) })
+}
+
+func (f *FileAuthManager) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !f.changed() {
+				continue
+			}
+			if err := f.reload(); err != nil {
+				log.Printf("Keeping the previous domains, %v", err)
+			}
+		case <-f.stop:
+			return
+		}
+	}
+}
+
+// changed reports whether the file was modified since it was last read.
+func (f *FileAuthManager) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		log.Printf("Error checking domain store %s: %v", f.path, err)
+		return false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return !info.ModTime().Equal(f.modTime) || info.Size() != f.size
+}
+
+// reload replaces the domains and accounts with the contents of the file and
+// tells the listeners which domains changed. A file that cannot be used is
+// reported once, until it is modified again.
+func (f *FileAuthManager) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return fmt.Errorf("error reading domain store: %w", err)
+	}
+	f.mu.Lock()
+	f.modTime, f.size = info.ModTime(), info.Size()
+	f.mu.Unlock()
+
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("error reading domain store: %w", err)
+	}
+	contents, err := parseStoreFile(data)
+	if err != nil {
+		return fmt.Errorf("error parsing domain store %s: %w", f.path, err)
+	}
+
+	f.mu.RLock()
+	previous := f.byName
+	f.mu.RUnlock()
+
+	byName := make(map[string]*Domain, len(contents.Domains))
+	for i, domain := range contents.Domains {
+		if domain == nil || domain.Name == "" {
+			return fmt.Errorf("domain store %s: domain %d has no name", f.path, i+1)
+		}
+		if _, exists := byName[domain.Name]; exists {
+			return fmt.Errorf("domain store %s: domain %s is listed twice", f.path, domain.Name)
+		}
+		domain.ID = uint(i + 1)
+		if err := hashPasswords(domain, previous[domain.Name]); err != nil {
+			return fmt.Errorf("domain store %s: %w", f.path, err)
+		}
+		byName[domain.Name] = domain
+	}
+	for i, account := range contents.Accounts {
+		if account == nil || account.Name == "" || account.ApiKey == "" {
+			return fmt.Errorf("domain store %s: account %d needs a name and an apiKey", f.path, i+1)
+		}
+		account.ID = uint(i + 1)
+	}
+
+	f.mu.Lock()
+	f.domains, f.byName, f.accounts = contents.Domains, byName, contents.Accounts
+	f.mu.Unlock()
+
+	if previous != nil {
+		f.notify(changedDomains(previous, byName))
+	}
+	return nil
+}
+
+// parseStoreFile reads YAML, or JSON, which YAML includes, with the field
+// names of the admin API.
+func parseStoreFile(data []byte) (*storeFile, error) {
+	var document any
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, err
+	}
+
+	contents := &storeFile{}
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(contents); err != nil {
+		return nil, err
+	}
+	return contents, nil
+}
+
+// hashPasswords replaces clear passwords with their hash. The hash read for
+// the same user before is kept while it matches, so that reloading a file
+// does not report its domains as changed because of a new salt.
+func hashPasswords(domain, previous *Domain) error {
+	for i := range domain.BasicAuth {
+		credential := &domain.BasicAuth[i]
+		if credential.Password == "" {
+			continue
+		}
+		hash, err := previousHash(previous, credential)
+		if err != nil {
+			return err
+		}
+		credential.PasswordHash = hash
+		credential.Password = ""
+	}
+	return nil
+}
+
+func previousHash(previous *Domain, credential *BasicCredential) (string, error) {
+	if previous != nil {
+		for _, known := range previous.BasicAuth {
+			if known.Username == credential.Username &&
+				bcrypt.CompareHashAndPassword([]byte(known.PasswordHash), []byte(credential.Password)) == nil {
+				return known.PasswordHash, nil
+			}
+		}
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(credential.Password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+func changedDomains(previous, current map[string]*Domain) []string {
+	var names []string
+	for name, domain := range previous {
+		if !reflect.DeepEqual(domain, current[name]) {
+			names = append(names, name)
+		}
+	}
+	for name := range current {
+		if _, existed := previous[name]; !existed {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (f *FileAuthManager) OnChange(listener func(domains []string)) {
+	f.listenersMu.Lock()
+	defer f.listenersMu.Unlock()
+
+	f.listeners = append(f.listeners, listener)
+}
+
+func (f *FileAuthManager) notify(domains []string) {
+	if len(domains) == 0 {
+		return
+	}
+	f.listenersMu.Lock()
+	listeners := append([]func([]string){}, f.listeners...)
+	f.listenersMu.Unlock()
+
+	for _, listener := range listeners {
+		listener(domains)
+	}
+}
+
+// GetDomains and GetDomain return copies, which callers may modify.
+func (f *FileAuthManager) GetDomains() ([]*Domain, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	result := make([]*Domain, len(f.domains))
+	for i, domain := range f.domains {
+		clone := *domain
+		result[i] = &clone
+	}
+	return result, nil
+}
+
+func (f *FileAuthManager) GetDomain(name string) (*Domain, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	domain, ok := f.byName[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	clone := *domain
+	return &clone, nil
+}
+
+func (f *FileAuthManager) AddDomain(*Domain) error    { return ErrReadOnly }
+func (f *FileAuthManager) UpdateDomain(*Domain) error { return ErrReadOnly }
+func (f *FileAuthManager) DelDomain(uint) error       { return ErrReadOnly }
+
+func (f *FileAuthManager) GetAccounts() ([]*Account, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	result := make([]*Account, len(f.accounts))
+	for i, account := range f.accounts {
+		clone := *account
+		result[i] = &clone
+	}
+	return result, nil
+}
+
+func (f *FileAuthManager) GetAccount(name string) (*Account, error) {
+	return f.findAccount(func(account *Account) bool { return account.Name == name })
+}
+
+func (f *FileAuthManager) GetAccountByKey(apiKey string) (*Account, error) {
+	return f.findAccount(func(account *Account) bool {
+		return subtle.ConstantTimeCompare([]byte(account.ApiKey), []byte(apiKey)) == 1
+	})
+}
+
+func (f *FileAuthManager) findAccount(match func(account *Account) bool) (*Account, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for _, account := range f.accounts {
+		if match(account) {
+			clone := *account
+			return &clone, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (f *FileAuthManager) AddAccount(*Account) error { return ErrReadOnly }
+func (f *FileAuthManager) DelAccount(uint) error     { return ErrReadOnly }
@@ -0,0 +1,109 @@
+package auth_test
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/auth/authtest"
+)
+
+func writeStoreFile(t *testing.T, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newFileStore(t *testing.T, path string, interval time.Duration) *auth.FileAuthManager {
+	t.Helper()
+	store, err := auth.NewFileAuthManager(path, interval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestFileStore(t *testing.T) {
+	authtest.Run(t, func(t *testing.T, seed authtest.Seed) auth.AuthManager {
+		// JSON is also YAML, with the field names of the admin API.
+		contents, err := json.Marshal(map[string]interface{}{
+			"domains":  seed.Domains,
+			"accounts": seed.Accounts,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "domains.yml")
+		writeStoreFile(t, path, string(contents))
+		return newFileStore(t, path, time.Second)
+	})
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "domains.yml")
+	writeStoreFile(t, path, "domains:\n  - name: example.com\n    apiKey: old-key\n")
+	store := newFileStore(t, path, 50*time.Millisecond)
+
+	changed := make(chan []string, 1)
+	store.OnChange(func(domains []string) { changed <- domains })
+	writeStoreFile(t, path, "domains:\n  - name: example.com\n    apiKey: new-key\n  - name: other.example.org\n    apiKey: other-key\n")
+	select {
+	case <-changed:
+	case <-time.After(authtest.Timeout):
+		t.Fatal("the modified file was not reloaded")
+	}
+	if domain, err := store.GetDomain("example.com"); err != nil || domain.ApiKey != "new-key" {
+		t.Fatalf("GetDomain after the reload = %+v, %v", domain, err)
+	}
+
+	// A file that cannot be used keeps the domains read before.
+	writeStoreFile(t, path, "domains: [{name: example.com, apiKey: [not, a, key]}]\n")
+	time.Sleep(300 * time.Millisecond)
+	if _, err := store.GetDomain("other.example.org"); err != nil {
+		t.Fatalf("the invalid file replaced the domains: %v", err)
+	}
+}
+
+func TestFileStoreReloadKeepsPasswordHashes(t *testing.T) {
+	const basicAuth = "    basicAuth:\n      - username: alice\n        password: "
+	path := filepath.Join(t.TempDir(), "domains.yml")
+	writeStoreFile(t, path, "domains:\n  - name: example.com\n"+basicAuth+"first\n  - name: other.example.org\n    apiKey: old-key\n")
+	store := newFileStore(t, path, 50*time.Millisecond)
+	before, err := store.GetDomain("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan []string, 1)
+	store.OnChange(func(domains []string) { changed <- domains })
+	reload := func(contents string) []string {
+		t.Helper()
+		writeStoreFile(t, path, contents)
+		select {
+		case domains := <-changed:
+			return domains
+		case <-time.After(authtest.Timeout):
+			t.Fatal("the modified file was not reloaded")
+			return nil
+		}
+	}
+
+	domains := reload("domains:\n  - name: example.com\n" + basicAuth + "first\n  - name: other.example.org\n    apiKey: new-key\n")
+	if len(domains) != 1 || domains[0] != "other.example.org" {
+		t.Fatalf("changed domains = %v, want [other.example.org]", domains)
+	}
+	after, err := store.GetDomain("example.com")
+	if err != nil || after.BasicAuth[0].PasswordHash != before.BasicAuth[0].PasswordHash {
+		t.Fatalf("the password was hashed again: %+v, %v", after, err)
+	}
+
+	domains = reload("domains:\n  - name: example.com\n" + basicAuth + "second\n  - name: other.example.org\n    apiKey: new-key\n")
+	if len(domains) != 1 || domains[0] != "example.com" {
+		t.Fatalf("changed domains = %v, want [example.com]", domains)
+	}
+}
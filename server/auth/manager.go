@@ -1,10 +1,170 @@
 package auth
 
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/backplane"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+)
+
+// Domain is the unit agents connect to. Besides its name, a domain answers
+// for the exact hostnames listed in Aliases and for any hostname matching one
+// of its Wildcards patterns ("*.preview.example.com"). Visitors are checked
+// against DenyCIDRs and, when it is not empty, AllowCIDRs. HTTP visitors
+// must also authenticate when BasicAuth or OIDC are set.
+//
+// MaxConnections caps concurrent visitor connections and MaxPendingTickets
+// the visitors waiting for an agent. ConnectionRate and ConnectionBurst set
+// a token bucket for new connections, per source IP when RateLimitPerIP is
+// set. UploadRate and DownloadRate shape the bytes per second exchanged by
+// all of the domain's connections, and AgentUploadRate and AgentDownloadRate
+// those carried by each agent. Zero disables each limit.
+//
+// MonthlyQuota bounds the bytes a domain may transfer in a calendar month.
+// Once exceeded, QuotaAction decides whether new visitors are rejected with
+// QuotaPage ("reject", the default) or every connection is throttled to
+// QuotaThrottleRate ("throttle"). QuotaWarnings lists the percentages at which
+// a warning is logged. Usage up to QuotaResetBytes in QuotaResetMonth does not
+// count, which is how a quota is reset before the month ends.
 type Domain struct {
-	ID                       uint   `json:"id"`
-	Name                     string `json:"name"`
-	ApiKey                   string `json:"apiKey"`
-	AllowMultipleConnections bool   `json:"allowMultipleConnections"`
+	ID                       uint              `json:"id"`
+	Name                     string            `json:"name"`
+	ApiKey                   string            `json:"apiKey"`
+	AllowMultipleConnections bool              `json:"allowMultipleConnections"`
+	Aliases                  []string          `json:"aliases"`
+	Wildcards                []string          `json:"wildcards"`
+	Routes                   []Route           `json:"routes"`
+	AllowCIDRs               []string          `json:"allowCidrs"`
+	DenyCIDRs                []string          `json:"denyCidrs"`
+	BasicAuth                []BasicCredential `json:"basicAuth"`
+	OIDC                     *OIDCSettings     `json:"oidc"`
+	MaxConnections           int               `json:"maxConnections"`
+	ConnectionRate           float64           `json:"connectionRate"`
+	ConnectionBurst          int               `json:"connectionBurst"`
+	RateLimitPerIP           bool              `json:"rateLimitPerIp"`
+	MaxPendingTickets        int               `json:"maxPendingTickets"`
+	UploadRate               int64             `json:"uploadRate"`
+	DownloadRate             int64             `json:"downloadRate"`
+	AgentUploadRate          int64             `json:"agentUploadRate"`
+	AgentDownloadRate        int64             `json:"agentDownloadRate"`
+	MonthlyQuota             int64             `json:"monthlyQuota"`
+	QuotaAction              string            `json:"quotaAction"`
+	QuotaThrottleRate        int64             `json:"quotaThrottleRate"`
+	QuotaPage                string            `json:"quotaPage"`
+	QuotaWarnings            []int             `json:"quotaWarnings"`
+	QuotaResetMonth          string            `json:"quotaResetMonth"`
+	QuotaResetBytes          int64             `json:"quotaResetBytes"`
+	Tokens                   []ApiToken        `json:"tokens"`
+}
+
+// ApiToken grants the holder the listed scopes on a single domain. Only the
+// SHA-256 hash of the token is stored.
+type ApiToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ScopeTrafficRead allows reading the domain's traffic, and
+// ScopeAgentConnect connecting agents to the domain.
+const (
+	ScopeTrafficRead  = "traffic:read"
+	ScopeAgentConnect = "agent:connect"
+)
+
+var (
+	// ErrNotFound is returned for domains and accounts that do not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrReadOnly is returned by stores managed outside the admin API for
+	// every change.
+	ErrReadOnly = errors.New("domain store is read-only")
+)
+
+// HashToken returns the stored form of an API token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authorize reports whether credential is the domain API key, which is
+// allowed everything, or one of its tokens granted scope.
+func (d *Domain) Authorize(credential, scope string) bool {
+	if credential == "" {
+		return false
+	}
+	if d.ApiKey != "" && subtle.ConstantTimeCompare([]byte(credential), []byte(d.ApiKey)) == 1 {
+		return true
+	}
+
+	hash := HashToken(credential)
+	for _, token := range d.Tokens {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(token.Hash)) == 1 {
+			return slices.Contains(token.Scopes, scope)
+		}
+	}
+	return false
+}
+
+const (
+	QuotaReject   = "reject"
+	QuotaThrottle = "throttle"
+)
+
+// QuotaUsage discounts from the usage of month the bytes cleared by the
+// last quota reset.
+func (d *Domain) QuotaUsage(month string, used int64) int64 {
+	if d.QuotaResetMonth != month {
+		return used
+	}
+	return max(used-d.QuotaResetBytes, 0)
+}
+
+// BasicCredential is a user allowed through HTTP basic authentication.
+// Password is only accepted on input; the stored form is a bcrypt hash.
+type BasicCredential struct {
+	Username     string `json:"username"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"passwordHash"`
+}
+
+// OIDCSettings gates a domain behind an OpenID Connect login. When
+// AllowedEmailDomains is empty any account of the provider is accepted.
+type OIDCSettings struct {
+	Issuer              string   `json:"issuer"`
+	ClientID            string   `json:"clientId"`
+	ClientSecret        string   `json:"clientSecret"`
+	Scopes              []string `json:"scopes,omitempty"`
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+}
+
+// Route sends HTTP requests whose path starts with PathPrefix (and, when
+// Header is set, carry that header with HeaderValue) to the agents that
+// declared Group when connecting.
+type Route struct {
+	PathPrefix  string `json:"pathPrefix"`
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty"`
+	Group       string `json:"group"`
+	StripPrefix bool   `json:"stripPrefix,omitempty"`
+}
+
+// Account owns an account-level key that agents can use to request
+// ephemeral tunnels without a domain created beforehand.
+type Account struct {
+	ID     uint   `json:"id"`
+	Name   string `json:"name"`
+	ApiKey string `json:"apiKey"`
 }
 
 type AuthManager interface {
@@ -13,10 +173,72 @@ type AuthManager interface {
 	AddDomain(domain *Domain) error
 	UpdateDomain(domain *Domain) error
 	DelDomain(id uint) error
+
+	GetAccounts() ([]*Account, error)
+	GetAccount(name string) (*Account, error)
+	GetAccountByKey(apiKey string) (*Account, error)
+	AddAccount(account *Account) error
+	DelAccount(id uint) error
+
+	// OnChange registers a function called with the names of the domains
+	// changed on any server, once their cached settings have been dropped.
+	OnChange(listener func(domains []string))
 }
 
+const (
+	StoreDatabase = "database"
+	StoreSQLite   = "sqlite"
+	StoreFile     = "file"
+)
+
+var (
+	defaultManager     AuthManager
+	defaultManagerOnce sync.Once
+)
+
+// MakeAuthManager returns the process-wide AuthManager selected by
+// domain_store, so that changes made through the admin API are seen by the
+// proxy without waiting for the cache.
 func MakeAuthManager() AuthManager {
-	manager := NewPostgresAuthManager()
+	defaultManagerOnce.Do(func() {
+		manager, err := newAuthManager()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaultManager = manager
+	})
+
+	return defaultManager
+}
+
+func newAuthManager() (AuthManager, error) {
+	conf, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	store := conf.DomainStore
+	if store.Type != StoreDatabase && store.Path == "" {
+		return nil, fmt.Errorf("domain_store.path is required for the %s store", store.Type)
+	}
 
-	return manager
+	switch store.Type {
+	case StoreDatabase, StoreSQLite:
+		bp, err := backplane.Get()
+		if err != nil {
+			log.Printf("Auth cache invalidation disabled: %v", err)
+			bp = nil
+		}
+		if store.Type == StoreSQLite {
+			return NewSQLiteAuthManager(store.Path, conf.AuthCache, bp)
+		}
+		conn, err := db.GetConnection(conf.Database)
+		if err != nil {
+			return nil, err
+		}
+		return NewDatabaseAuthManager(conn, conf.AuthCache, bp), nil
+	case StoreFile:
+		return NewFileAuthManager(store.Path, time.Duration(store.ReloadInterval)*time.Second)
+	default:
+		return nil, fmt.Errorf("unknown domain store %q", store.Type)
+	}
 }
@@ -0,0 +1,45 @@
+package auth_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/auth/authtest"
+	"github.com/OnnaSoft/lipstick/server/backplane"
+	"github.com/OnnaSoft/lipstick/server/config"
+)
+
+func sqliteFactory(bp func() backplane.Backplane) authtest.Factory {
+	return func(t *testing.T, seed authtest.Seed) auth.AuthManager {
+		var b backplane.Backplane
+		if bp != nil {
+			b = bp()
+		}
+		store, err := auth.NewSQLiteAuthManager(filepath.Join(t.TempDir(), "domains.db"),
+			config.AuthCacheConfig{TTL: 300, NegativeTTL: 30}, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, domain := range seed.Domains {
+			if err := store.AddDomain(domain); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, account := range seed.Accounts {
+			if err := store.AddAccount(account); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return store
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	authtest.Run(t, sqliteFactory(nil))
+}
+
+// With a backplane, changes reach the listeners through its invalidations.
+func TestSQLiteStoreWithBackplane(t *testing.T) {
+	authtest.Run(t, sqliteFactory(func() backplane.Backplane { return backplane.NewMemory() }))
+}
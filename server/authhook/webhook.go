@@ -0,0 +1,195 @@
+package authhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/metrics"
+)
+
+const (
+	KindAgent   = "agent"
+	KindVisitor = "visitor"
+)
+
+var requests = metrics.NewCounter("lipstick_auth_webhook_requests_total",
+	"Calls to the authorization webhook, by kind (agent or visitor) and result (allow, deny or error).", "kind", "result")
+
+// Request is the body posted to the webhook. Agent is set for agents asking
+// to connect, with the credential they presented; Visitor for visitors.
+type Request struct {
+	Kind       string   `json:"kind"`
+	Domain     string   `json:"domain"`
+	Credential string   `json:"credential,omitempty"`
+	Agent      *Agent   `json:"agent,omitempty"`
+	Visitor    *Visitor `json:"visitor,omitempty"`
+}
+
+type Agent struct {
+	ID        string   `json:"id"`
+	Address   string   `json:"address"`
+	UserAgent string   `json:"userAgent,omitempty"`
+	Routes    []string `json:"routes,omitempty"`
+}
+
+// Visitor describes a new visitor connection. Address is the visitor IP,
+// without the port, since answers are cached by address.
+type Visitor struct {
+	Address  string `json:"address"`
+	Hostname string `json:"hostname"`
+	Protocol string `json:"protocol"`
+}
+
+// Response is the answer expected with a 200 status. 401 and 403 answers
+// deny as well; any other status is an error.
+type Response struct {
+	Allow bool `json:"allow"`
+}
+
+// Webhook asks an external service whether agents may connect and, when
+// Visitors is set, whether visitors may reach them. Answers are cached, so
+// reconnecting agents and returning visitors do not call it again until
+// the TTL of the answer expires. Errors deny and are not cached.
+type Webhook struct {
+	url      string
+	secret   string
+	client   *http.Client
+	allowTTL time.Duration
+	denyTTL  time.Duration
+	Visitors bool
+	cache    sync.Map
+}
+
+type cacheEntry struct {
+	allow   bool
+	expires time.Time
+}
+
+// New returns nil when no webhook URL is configured.
+func New(conf config.AuthWebhookConfig) *Webhook {
+	if conf.URL == "" {
+		return nil
+	}
+
+	w := &Webhook{
+		url:      conf.URL,
+		secret:   conf.Secret,
+		client:   &http.Client{Timeout: time.Duration(conf.Timeout) * time.Second},
+		allowTTL: time.Duration(conf.AllowTTL) * time.Second,
+		denyTTL:  time.Duration(conf.DenyTTL) * time.Second,
+		Visitors: conf.Visitors,
+	}
+	go w.sweep()
+	return w
+}
+
+// AuthorizeAgent asks whether agent may connect to domain with credential.
+// Answers are cached by domain and credential.
+func (w *Webhook) AuthorizeAgent(domain, credential string, agent Agent) (bool, error) {
+	key := strings.Join([]string{KindAgent, domain, auth.HashToken(credential)}, "\x00")
+	return w.authorize(key, &Request{
+		Kind:       KindAgent,
+		Domain:     domain,
+		Credential: credential,
+		Agent:      &agent,
+	})
+}
+
+// AuthorizeVisitor asks whether visitor may reach the agents of domain.
+// Answers are cached by domain, hostname, address and protocol.
+func (w *Webhook) AuthorizeVisitor(domain string, visitor Visitor) (bool, error) {
+	key := strings.Join([]string{KindVisitor, domain, visitor.Hostname, visitor.Address, visitor.Protocol}, "\x00")
+	return w.authorize(key, &Request{
+		Kind:    KindVisitor,
+		Domain:  domain,
+		Visitor: &visitor,
+	})
+}
+
+func (w *Webhook) authorize(key string, req *Request) (bool, error) {
+	if value, ok := w.cache.Load(key); ok {
+		entry := value.(cacheEntry)
+		if time.Now().Before(entry.expires) {
+			return entry.allow, nil
+		}
+		w.cache.Delete(key)
+	}
+
+	allow, err := w.call(req)
+	if err != nil {
+		requests.Inc(req.Kind, "error")
+		return false, err
+	}
+
+	ttl := w.denyTTL
+	result := "deny"
+	if allow {
+		ttl = w.allowTTL
+		result = "allow"
+	}
+	requests.Inc(req.Kind, result)
+	if ttl > 0 {
+		w.cache.Store(key, cacheEntry{allow: allow, expires: time.Now().Add(ttl)})
+	}
+	return allow, nil
+}
+
+func (w *Webhook) call(request *Request) (bool, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.secret != "" {
+		req.Header.Set("Authorization", "Bearer "+w.secret)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+		return false, nil
+	default:
+		return false, fmt.Errorf("authorization webhook answered %s", resp.Status)
+	}
+
+	var answer Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&answer); err != nil {
+		return false, fmt.Errorf("invalid authorization webhook answer: %w", err)
+	}
+	return answer.Allow, nil
+}
+
+// sweep drops expired answers every minute, so that the cache does not keep
+// every visitor address seen.
+func (w *Webhook) sweep() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		w.cache.Range(func(key, value any) bool {
+			if now.After(value.(cacheEntry).expires) {
+				w.cache.Delete(key)
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Package backplane carries tickets between the servers of a cluster: a hub
+// publishes a ticket on its domain and the server holding an agent of that
+// domain picks it up.
+package backplane
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/metrics"
+)
+
+const (
+	TypeNats     = "nats"
+	TypeRedis    = "redis"
+	TypePostgres = "postgres"
+	TypeMemory   = "memory"
+)
+
+// messageTTL bounds how long an undelivered message is kept by the
+// backplanes that store them. Tickets are useless long before.
+const messageTTL = time.Minute
+
+var ErrClosed = errors.New("backplane closed")
+
+var publishErrors = metrics.NewCounter("lipstick_backplane_publish_errors_total",
+	"Messages that could not be published to the backplane.")
+
+// Backplane delivers each message published on a topic to exactly one of the
+// handlers subscribed to it, on this server or another, and each message
+// broadcast on a topic to every handler subscribed with SubscribeBroadcast.
+// Broadcasts are not stored: servers that are not connected miss them.
+// Handlers may run concurrently and must not block for long.
+type Backplane interface {
+	Subscribe(topic string, handler func(data []byte)) (Subscription, error)
+	Publish(topic string, data []byte) error
+	SubscribeBroadcast(topic string, handler func(data []byte)) (Subscription, error)
+	Broadcast(topic string, data []byte) error
+	Close() error
+}
+
+type Subscription interface {
+	Unsubscribe() error
+}
+
+var (
+	defaultOnce      sync.Once
+	defaultBackplane Backplane
+	defaultErr       error
+)
+
+// Get returns the backplane selected by backplane.type, connecting on first
+// use.
+func Get() (Backplane, error) {
+	defaultOnce.Do(func() {
+		var conf config.AppConfig
+		conf, defaultErr = config.GetConfig()
+		if defaultErr != nil {
+			return
+		}
+		defaultBackplane, defaultErr = New(conf)
+	})
+	if defaultErr != nil {
+		return nil, defaultErr
+	}
+	return defaultBackplane, nil
+}
+
+func New(conf config.AppConfig) (Backplane, error) {
+	var bp Backplane
+	var err error
+	switch conf.Backplane.Type {
+	case TypeNats:
+		bp, err = NewNats(conf.Nats.URL)
+	case TypeRedis:
+		bp, err = NewRedis()
+	case TypePostgres:
+		bp, err = NewPostgres(conf.Database)
+	case TypeMemory:
+		bp = NewMemory()
+	default:
+		err = fmt.Errorf("unknown backplane %q", conf.Backplane.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Default.Info("Using ", conf.Backplane.Type, " backplane")
+	return bp, nil
+}
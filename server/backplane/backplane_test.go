@@ -0,0 +1,82 @@
+package backplane_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/backplane"
+	"github.com/OnnaSoft/lipstick/server/backplane/backplanetest"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// The networked backplanes run only against the servers named by these
+// variables, for example LIPSTICK_TEST_NATS_URL=nats://127.0.0.1:4222.
+const (
+	natsURLEnv     = "LIPSTICK_TEST_NATS_URL"
+	redisURLEnv    = "LIPSTICK_TEST_REDIS_URL"
+	postgresURLEnv = "LIPSTICK_TEST_POSTGRES_URL"
+)
+
+func testURL(t *testing.T, env string) string {
+	t.Helper()
+	url := os.Getenv(env)
+	if url == "" {
+		t.Skip(env + " is not set")
+	}
+	return url
+}
+
+func TestMemory(t *testing.T) {
+	memory := backplane.NewMemory()
+	backplanetest.Run(t, func(t *testing.T) backplane.Backplane {
+		return memory
+	})
+}
+
+func TestNats(t *testing.T) {
+	url := testURL(t, natsURLEnv)
+	backplanetest.Run(t, func(t *testing.T) backplane.Backplane {
+		nats, err := backplane.NewNats(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { nats.Close() })
+		return nats
+	})
+}
+
+func TestRedis(t *testing.T) {
+	options, err := redis.ParseURL(testURL(t, redisURLEnv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	backplanetest.Run(t, func(t *testing.T) backplane.Backplane {
+		r := backplane.NewRedisWithClient(redis.NewClient(options))
+		t.Cleanup(func() { r.Close() })
+		return r
+	})
+}
+
+func TestPostgres(t *testing.T) {
+	url := testURL(t, postgresURLEnv)
+	backplanetest.Run(t, func(t *testing.T) backplane.Backplane {
+		connection, err := gorm.Open(postgres.Open(url), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := backplane.NewPostgresWithConnection(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			p.Close()
+			if sqlDB, err := connection.DB(); err == nil {
+				sqlDB.Close()
+			}
+		})
+		return p
+	})
+}
@@ -0,0 +1,248 @@
+// Package backplanetest holds the behaviour every backplane must have. A
+// backplane implementation runs it from its own tests:
+//
+//	func TestRedis(t *testing.T) {
+//		backplanetest.Run(t, func(t *testing.T) backplane.Backplane { ... })
+//	}
+package backplanetest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/backplane"
+)
+
+// Factory returns a new node of the backplane under test. Nodes returned
+// during a test must share the same medium, as the servers of a cluster do,
+// and the factory is responsible for closing them, for example with
+// t.Cleanup.
+type Factory func(t *testing.T) backplane.Backplane
+
+// Timeout bounds how long a message may take to be delivered.
+var Timeout = 5 * time.Second
+
+// settle is how long to wait for duplicates once every message arrived.
+const settle = 500 * time.Millisecond
+
+func Run(t *testing.T, factory Factory) {
+	t.Run("Delivery", func(t *testing.T) { testDelivery(t, factory) })
+	t.Run("ExactlyOnce", func(t *testing.T) { testExactlyOnce(t, factory) })
+	t.Run("TopicIsolation", func(t *testing.T) { testTopicIsolation(t, factory) })
+	t.Run("Unsubscribe", func(t *testing.T) { testUnsubscribe(t, factory) })
+	t.Run("Payload", func(t *testing.T) { testPayload(t, factory) })
+	t.Run("Broadcast", func(t *testing.T) { testBroadcast(t, factory) })
+}
+
+// topic returns a name no earlier run used, since some backplanes keep
+// undelivered messages.
+func topic(t *testing.T) string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return "backplanetest-" + hex.EncodeToString(b) + ".example.com"
+}
+
+// inbox collects the messages received by the handlers it returns.
+type inbox struct {
+	mu       sync.Mutex
+	messages []received
+	arrived  chan struct{}
+}
+
+type received struct {
+	handler int
+	data    string
+}
+
+func newInbox() *inbox {
+	return &inbox{arrived: make(chan struct{}, 1024)}
+}
+
+func (in *inbox) handler(id int) func(data []byte) {
+	return func(data []byte) {
+		in.mu.Lock()
+		in.messages = append(in.messages, received{handler: id, data: string(data)})
+		in.mu.Unlock()
+		in.arrived <- struct{}{}
+	}
+}
+
+// wait returns the messages received once n arrived and no more came in
+// during settle.
+func (in *inbox) wait(t *testing.T, n int) []received {
+	t.Helper()
+
+	deadline := time.After(Timeout)
+	for i := 0; i < n; i++ {
+		select {
+		case <-in.arrived:
+		case <-deadline:
+			in.mu.Lock()
+			got := len(in.messages)
+			in.mu.Unlock()
+			t.Fatalf("received %d messages, want %d", got, n)
+		}
+	}
+	time.Sleep(settle)
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return append([]received(nil), in.messages...)
+}
+
+func subscribe(t *testing.T, bp backplane.Backplane, topic string, handler func([]byte)) backplane.Subscription {
+	t.Helper()
+
+	sub, err := bp.Subscribe(topic, handler)
+	if err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	t.Cleanup(func() { sub.Unsubscribe() })
+	return sub
+}
+
+func publish(t *testing.T, bp backplane.Backplane, topic string, data string) {
+	t.Helper()
+
+	if err := bp.Publish(topic, []byte(data)); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+}
+
+func testDelivery(t *testing.T, factory Factory) {
+	subscriber, publisher := factory(t), factory(t)
+	name := topic(t)
+	in := newInbox()
+	subscribe(t, subscriber, name, in.handler(0))
+
+	publish(t, publisher, name, "ticket")
+
+	got := in.wait(t, 1)
+	if len(got) != 1 || got[0].data != "ticket" {
+		t.Fatalf("received %v, want one \"ticket\"", got)
+	}
+}
+
+func testExactlyOnce(t *testing.T, factory Factory) {
+	first, second, publisher := factory(t), factory(t), factory(t)
+	name := topic(t)
+	in := newInbox()
+	subscribe(t, first, name, in.handler(0))
+	subscribe(t, second, name, in.handler(1))
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		publish(t, publisher, name, fmt.Sprint(i))
+	}
+
+	got := in.wait(t, count)
+	if len(got) != count {
+		t.Fatalf("received %d messages, want %d", len(got), count)
+	}
+	seen := make(map[string]bool)
+	for _, message := range got {
+		if seen[message.data] {
+			t.Fatalf("message %q delivered twice", message.data)
+		}
+		seen[message.data] = true
+	}
+}
+
+func testTopicIsolation(t *testing.T, factory Factory) {
+	subscriber, publisher := factory(t), factory(t)
+	a, b := topic(t), topic(t)
+	inA, inB := newInbox(), newInbox()
+	subscribe(t, subscriber, a, inA.handler(0))
+	subscribe(t, subscriber, b, inB.handler(0))
+
+	publish(t, publisher, a, "for a")
+	publish(t, publisher, b, "for b")
+
+	if got := inA.wait(t, 1); len(got) != 1 || got[0].data != "for a" {
+		t.Fatalf("topic a received %v", got)
+	}
+	if got := inB.wait(t, 1); len(got) != 1 || got[0].data != "for b" {
+		t.Fatalf("topic b received %v", got)
+	}
+}
+
+func testUnsubscribe(t *testing.T, factory Factory) {
+	leaving, staying, publisher := factory(t), factory(t), factory(t)
+	name := topic(t)
+	in := newInbox()
+	sub := subscribe(t, leaving, name, in.handler(0))
+	subscribe(t, staying, name, in.handler(1))
+
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Unsubscribe: %v", err)
+	}
+
+	const count = 10
+	for i := 0; i < count; i++ {
+		publish(t, publisher, name, fmt.Sprint(i))
+	}
+
+	for _, message := range in.wait(t, count) {
+		if message.handler != 1 {
+			t.Fatalf("message %q delivered after Unsubscribe", message.data)
+		}
+	}
+}
+
+func testPayload(t *testing.T, factory Factory) {
+	subscriber, publisher := factory(t), factory(t)
+	name := topic(t)
+	in := newInbox()
+	subscribe(t, subscriber, name, in.handler(0))
+
+	payload := "203.0.113.7:5051 ticket\x00\xff\nhost.example.com group"
+	publish(t, publisher, name, payload)
+
+	got := in.wait(t, 1)
+	if len(got) != 1 || !bytes.Equal([]byte(got[0].data), []byte(payload)) {
+		t.Fatalf("received %q, want %q", got, payload)
+	}
+}
+
+func testBroadcast(t *testing.T, factory Factory) {
+	first, second, publisher := factory(t), factory(t), factory(t)
+	name := topic(t)
+	in := newInbox()
+	for id, bp := range []backplane.Backplane{first, second} {
+		sub, err := bp.SubscribeBroadcast(name, in.handler(id))
+		if err != nil {
+			t.Fatalf("SubscribeBroadcast: %v", err)
+		}
+		t.Cleanup(func() { sub.Unsubscribe() })
+	}
+	tickets := newInbox()
+	subscribe(t, first, name, tickets.handler(0))
+
+	const count = 5
+	for i := 0; i < count; i++ {
+		if err := publisher.Broadcast(name, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("Broadcast: %v", err)
+		}
+	}
+
+	perHandler := make(map[int]int)
+	for _, message := range in.wait(t, 2*count) {
+		perHandler[message.handler]++
+	}
+	if perHandler[0] != count || perHandler[1] != count {
+		t.Fatalf("handlers received %v, want %d each", perHandler, count)
+	}
+
+	tickets.mu.Lock()
+	defer tickets.mu.Unlock()
+	if len(tickets.messages) != 0 {
+		t.Fatalf("broadcast delivered to a ticket subscription: %v", tickets.messages)
+	}
+}
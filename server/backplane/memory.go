@@ -0,0 +1,132 @@
+package backplane
+
+import (
+	"sync"
+)
+
+// Memory delivers messages within the process, for servers running alone.
+// Each message reaches one subscriber of the topic, taken in turns.
+type Memory struct {
+	mu         sync.Mutex
+	topics     map[string][]*memorySubscription
+	next       map[string]int
+	broadcasts map[string][]*memorySubscription
+	closed     bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		topics:     make(map[string][]*memorySubscription),
+		next:       make(map[string]int),
+		broadcasts: make(map[string][]*memorySubscription),
+	}
+}
+
+type memorySubscription struct {
+	memory    *Memory
+	topic     string
+	broadcast bool
+	handler   func(data []byte)
+}
+
+func (m *Memory) Subscribe(topic string, handler func(data []byte)) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+	sub := &memorySubscription{memory: m, topic: topic, handler: handler}
+	m.topics[topic] = append(m.topics[topic], sub)
+	return sub, nil
+}
+
+// Publish hands the message to a subscriber without waiting for it. Messages
+// on a topic nobody listens to are dropped.
+func (m *Memory) Publish(topic string, data []byte) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	subs := m.topics[topic]
+	if len(subs) == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	sub := subs[m.next[topic]%len(subs)]
+	m.next[topic]++
+	m.mu.Unlock()
+
+	data = append([]byte(nil), data...)
+	go sub.handler(data)
+	return nil
+}
+
+func (m *Memory) SubscribeBroadcast(topic string, handler func(data []byte)) (Subscription, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, ErrClosed
+	}
+	sub := &memorySubscription{memory: m, topic: topic, broadcast: true, handler: handler}
+	m.broadcasts[topic] = append(m.broadcasts[topic], sub)
+	return sub, nil
+}
+
+func (m *Memory) Broadcast(topic string, data []byte) error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return ErrClosed
+	}
+	subs := m.broadcasts[topic]
+	m.mu.Unlock()
+
+	for _, sub := range subs {
+		go sub.handler(append([]byte(nil), data...))
+	}
+	return nil
+}
+
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.topics = make(map[string][]*memorySubscription)
+	m.next = make(map[string]int)
+	m.broadcasts = make(map[string][]*memorySubscription)
+	return nil
+}
+
+func (s *memorySubscription) Unsubscribe() error {
+	m := s.memory
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if s.broadcast {
+		m.broadcasts[s.topic] = removeSubscription(m.broadcasts[s.topic], s)
+		if len(m.broadcasts[s.topic]) == 0 {
+			delete(m.broadcasts, s.topic)
+		}
+		return nil
+	}
+
+	m.topics[s.topic] = removeSubscription(m.topics[s.topic], s)
+	if len(m.topics[s.topic]) == 0 {
+		delete(m.topics, s.topic)
+		delete(m.next, s.topic)
+	}
+	return nil
+}
+
+func removeSubscription[S comparable](subs []S, s S) []S {
+	for i, sub := range subs {
+		if sub == s {
+			return append(subs[:i:i], subs[i+1:]...)
+		}
+	}
+	return subs
+}
@@ -0,0 +1,103 @@
+package backplane
+
+import (
+	"fmt"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/nats-io/nats.go"
+)
+
+// queueGroup makes NATS deliver each message to one subscriber only.
+// Broadcasts use plain subscriptions on subjects under broadcastPrefix,
+// apart from the tickets published on domain names.
+const (
+	queueGroup      = "all"
+	broadcastPrefix = "lipstick.broadcast."
+)
+
+// Nats uses a queue subscription per topic.
+type Nats struct {
+	conn *nats.Conn
+}
+
+// natsSubscription flushes on Unsubscribe, so that the server stops routing
+// messages to it before the caller goes on.
+type natsSubscription struct {
+	*nats.Subscription
+	conn *nats.Conn
+}
+
+func (s *natsSubscription) Unsubscribe() error {
+	if err := s.Subscription.Unsubscribe(); err != nil {
+		return err
+	}
+	return s.conn.Flush()
+}
+
+func NewNats(url string) (*Nats, error) {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to NATS: %v", err)
+	}
+
+	logger.Default.Info("Connected to NATS:", url)
+	return &Nats{conn: conn}, nil
+}
+
+func (n *Nats) Subscribe(topic string, handler func(data []byte)) (Subscription, error) {
+	sub, err := n.conn.QueueSubscribe(topic, queueGroup, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to topic %s: %v", topic, err)
+	}
+	// Make sure the server knows about the subscription before returning, so
+	// that messages published right after reach it.
+	if err := n.conn.Flush(); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("error subscribing to topic %s: %v", topic, err)
+	}
+
+	logger.Default.Debug("Subscribed to topic: ", topic)
+	return &natsSubscription{Subscription: sub, conn: n.conn}, nil
+}
+
+func (n *Nats) Publish(topic string, data []byte) error {
+	if err := n.conn.Publish(topic, data); err != nil {
+		publishErrors.Inc()
+		return fmt.Errorf("error publishing to topic %s: %v", topic, err)
+	}
+
+	logger.Default.Debug("Published message to topic: ", topic)
+	return nil
+}
+
+func (n *Nats) SubscribeBroadcast(topic string, handler func(data []byte)) (Subscription, error) {
+	sub, err := n.conn.Subscribe(broadcastPrefix+topic, func(msg *nats.Msg) {
+		handler(msg.Data)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to broadcast %s: %v", topic, err)
+	}
+	if err := n.conn.Flush(); err != nil {
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("error subscribing to broadcast %s: %v", topic, err)
+	}
+	return &natsSubscription{Subscription: sub, conn: n.conn}, nil
+}
+
+func (n *Nats) Broadcast(topic string, data []byte) error {
+	if err := n.conn.Publish(broadcastPrefix+topic, data); err != nil {
+		publishErrors.Inc()
+		return fmt.Errorf("error broadcasting to topic %s: %v", topic, err)
+	}
+	return nil
+}
+
+func (n *Nats) Close() error {
+	if err := n.conn.Drain(); err != nil {
+		n.conn.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,310 @@
+package backplane
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/gorm"
+)
+
+const (
+	postgresChannel          = "lipstick_backplane"
+	postgresBroadcastChannel = "lipstick_broadcast"
+	postgresPoll             = time.Second
+	postgresClaim            = 100
+	// postgresMaxNotify is the largest NOTIFY payload PostgreSQL accepts.
+	postgresMaxNotify = 8000
+)
+
+var errBroadcastTooLarge = errors.New("broadcast too large for NOTIFY")
+
+const claimQuery = `DELETE FROM backplane_messages WHERE id IN (
+	SELECT id FROM backplane_messages WHERE topic = ? ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED
+) RETURNING id, topic, payload, created_at`
+
+// Postgres stores messages in the backplane_messages table and announces
+// them with NOTIFY. Subscribers claim them with DELETE ... RETURNING, which
+// hands each message to a single server, and also poll in case a
+// notification was missed. Broadcasts travel in the NOTIFY payload itself
+// and are not stored.
+type Postgres struct {
+	connection *gorm.DB
+	mu         sync.Mutex
+	topics     map[string][]*postgresSubscription
+	next       map[string]int
+	broadcasts map[string][]*postgresSubscription
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+type postgresSubscription struct {
+	postgres  *Postgres
+	topic     string
+	broadcast bool
+	handler   func(data []byte)
+}
+
+// NewPostgres uses the database configured under database, which must be
+// PostgreSQL.
+func NewPostgres(conf config.DatabaseConfig) (*Postgres, error) {
+	connection, err := db.GetConnection(conf)
+	if err != nil {
+		return nil, err
+	}
+	return NewPostgresWithConnection(connection)
+}
+
+func NewPostgresWithConnection(connection *gorm.DB) (*Postgres, error) {
+	if connection.Dialector.Name() != "postgres" {
+		return nil, errors.New("the postgres backplane requires a PostgreSQL database")
+	}
+	if err := db.MigrateConnection(connection); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Postgres{
+		connection: connection,
+		topics:     make(map[string][]*postgresSubscription),
+		next:       make(map[string]int),
+		broadcasts: make(map[string][]*postgresSubscription),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go p.listen(ctx)
+	return p, nil
+}
+
+func (p *Postgres) Subscribe(topic string, handler func(data []byte)) (Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub := &postgresSubscription{postgres: p, topic: topic, handler: handler}
+	p.topics[topic] = append(p.topics[topic], sub)
+	return sub, nil
+}
+
+func (p *Postgres) Publish(topic string, data []byte) error {
+	err := p.connection.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&db.BackplaneMessage{Topic: topic, Payload: data}).Error; err != nil {
+			return err
+		}
+		return tx.Exec("SELECT pg_notify(?, ?)", postgresChannel, topic).Error
+	})
+	if err != nil {
+		publishErrors.Inc()
+	}
+	return err
+}
+
+func (p *Postgres) SubscribeBroadcast(topic string, handler func(data []byte)) (Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sub := &postgresSubscription{postgres: p, topic: topic, broadcast: true, handler: handler}
+	p.broadcasts[topic] = append(p.broadcasts[topic], sub)
+	return sub, nil
+}
+
+// Broadcast notifies every listening server with the topic and the data,
+// base64 encoded, as payload.
+func (p *Postgres) Broadcast(topic string, data []byte) error {
+	payload := topic + "\n" + base64.StdEncoding.EncodeToString(data)
+	if len(payload) > postgresMaxNotify {
+		publishErrors.Inc()
+		return errBroadcastTooLarge
+	}
+	err := p.connection.Exec("SELECT pg_notify(?, ?)", postgresBroadcastChannel, payload).Error
+	if err != nil {
+		publishErrors.Inc()
+	}
+	return err
+}
+
+func (p *Postgres) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+// listen keeps a connection in LISTEN mode, reconnecting when it fails.
+func (p *Postgres) listen(ctx context.Context) {
+	defer close(p.done)
+
+	sqlDB, err := p.connection.DB()
+	if err != nil {
+		logger.Default.Error("Error getting database connection for backplane:", err)
+		return
+	}
+
+	for ctx.Err() == nil {
+		err := p.listenOnce(ctx, sqlDB)
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Default.Error("Error listening on Postgres backplane:", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (p *Postgres) listenOnce(ctx context.Context, sqlDB *sql.DB) error {
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		pgxConn := driverConn.(*stdlib.Conn).Conn()
+		if _, err := pgxConn.Exec(ctx, "LISTEN "+postgresChannel+"; LISTEN "+postgresBroadcastChannel); err != nil {
+			return err
+		}
+		defer pgxConn.Exec(context.Background(), "UNLISTEN *")
+
+		lastCleanup := time.Now()
+		for {
+			p.claimAll()
+			if time.Since(lastCleanup) > messageTTL {
+				p.cleanup()
+				lastCleanup = time.Now()
+			}
+
+			waitCtx, cancel := context.WithTimeout(ctx, postgresPoll)
+			notification, err := pgxConn.WaitForNotification(waitCtx)
+			cancel()
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err != nil && !pgconn.Timeout(err) {
+				return err
+			}
+			switch {
+			case notification == nil:
+			case notification.Channel == postgresBroadcastChannel:
+				p.deliverBroadcast(notification.Payload)
+			default:
+				p.claim(notification.Payload)
+			}
+		}
+	})
+}
+
+func (p *Postgres) subscribedTopics() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	topics := make([]string, 0, len(p.topics))
+	for topic := range p.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (p *Postgres) claimAll() {
+	for _, topic := range p.subscribedTopics() {
+		p.claim(topic)
+	}
+}
+
+// claim takes the pending messages of topic while this server subscribes
+// to it.
+func (p *Postgres) claim(topic string) {
+	for {
+		p.mu.Lock()
+		subscribed := len(p.topics[topic]) > 0
+		p.mu.Unlock()
+		if !subscribed {
+			return
+		}
+
+		var messages []db.BackplaneMessage
+		if err := p.connection.Raw(claimQuery, topic, postgresClaim).Scan(&messages).Error; err != nil {
+			logger.Default.Error("Error claiming backplane messages:", err)
+			return
+		}
+		for _, message := range messages {
+			p.dispatch(message)
+		}
+		if len(messages) < postgresClaim {
+			return
+		}
+	}
+}
+
+func (p *Postgres) dispatch(message db.BackplaneMessage) {
+	p.mu.Lock()
+	subs := p.topics[message.Topic]
+	if len(subs) == 0 {
+		p.mu.Unlock()
+		if err := p.Publish(message.Topic, message.Payload); err != nil {
+			logger.Default.Error("Error requeuing backplane message:", err)
+		}
+		return
+	}
+	sub := subs[p.next[message.Topic]%len(subs)]
+	p.next[message.Topic]++
+	p.mu.Unlock()
+
+	go sub.handler(message.Payload)
+}
+
+func (p *Postgres) deliverBroadcast(payload string) {
+	topic, encoded, ok := strings.Cut(payload, "\n")
+	if !ok {
+		return
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		logger.Default.Error("Invalid broadcast on Postgres backplane:", err)
+		return
+	}
+
+	p.mu.Lock()
+	subs := p.broadcasts[topic]
+	p.mu.Unlock()
+	for _, sub := range subs {
+		go sub.handler(data)
+	}
+}
+
+// cleanup drops the messages no server claimed in time.
+func (p *Postgres) cleanup() {
+	cutoff := time.Now().Add(-messageTTL)
+	if err := p.connection.Where("created_at < ?", cutoff).Delete(&db.BackplaneMessage{}).Error; err != nil {
+		logger.Default.Error("Error deleting expired backplane messages:", err)
+	}
+}
+
+func (s *postgresSubscription) Unsubscribe() error {
+	p := s.postgres
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s.broadcast {
+		p.broadcasts[s.topic] = removeSubscription(p.broadcasts[s.topic], s)
+		if len(p.broadcasts[s.topic]) == 0 {
+			delete(p.broadcasts, s.topic)
+		}
+		return nil
+	}
+
+	p.topics[s.topic] = removeSubscription(p.topics[s.topic], s)
+	if len(p.topics[s.topic]) == 0 {
+		delete(p.topics, s.topic)
+		delete(p.next, s.topic)
+	}
+	return nil
+}
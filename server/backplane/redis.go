@@ -0,0 +1,226 @@
+package backplane
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix       = "lipstick:backplane:"
+	redisBroadcastPrefix = "lipstick:broadcast:"
+	redisBlock           = time.Second
+)
+
+// Redis queues the messages of each topic in a list. Every server pops the
+// lists of the topics it subscribed to with BLPOP, so each message is taken
+// by one of them; lists nobody pops expire after messageTTL. Broadcasts use
+// Redis pub/sub.
+type Redis struct {
+	client     *redis.Client
+	mu         sync.Mutex
+	topics     map[string][]*redisSubscription
+	next       map[string]int
+	broadcasts map[*redisBroadcast]bool
+	cancel     context.CancelFunc
+	done       chan struct{}
+}
+
+type redisBroadcast struct {
+	redis  *Redis
+	pubsub *redis.PubSub
+	done   chan struct{}
+}
+
+type redisSubscription struct {
+	redis   *Redis
+	topic   string
+	handler func(data []byte)
+}
+
+// NewRedis uses the client configured under redis.
+func NewRedis() (*Redis, error) {
+	client, err := db.GetRedisConnection()
+	if err != nil {
+		return nil, err
+	}
+	return NewRedisWithClient(client), nil
+}
+
+func NewRedisWithClient(client *redis.Client) *Redis {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Redis{
+		client:     client,
+		topics:     make(map[string][]*redisSubscription),
+		next:       make(map[string]int),
+		broadcasts: make(map[*redisBroadcast]bool),
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}
+	go r.consume(ctx)
+	return r
+}
+
+func (r *Redis) Subscribe(topic string, handler func(data []byte)) (Subscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub := &redisSubscription{redis: r, topic: topic, handler: handler}
+	r.topics[topic] = append(r.topics[topic], sub)
+	return sub, nil
+}
+
+func (r *Redis) Publish(topic string, data []byte) error {
+	key := redisKeyPrefix + topic
+	_, err := r.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.RPush(context.Background(), key, data)
+		pipe.Expire(context.Background(), key, messageTTL)
+		return nil
+	})
+	if err != nil {
+		publishErrors.Inc()
+	}
+	return err
+}
+
+// SubscribeBroadcast opens a pub/sub connection for the handler, and waits
+// for Redis to confirm the subscription.
+func (r *Redis) SubscribeBroadcast(topic string, handler func(data []byte)) (Subscription, error) {
+	ctx := context.Background()
+	pubsub := r.client.Subscribe(ctx, redisBroadcastPrefix+topic)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	sub := &redisBroadcast{redis: r, pubsub: pubsub, done: make(chan struct{})}
+	r.mu.Lock()
+	r.broadcasts[sub] = true
+	r.mu.Unlock()
+
+	go func() {
+		defer close(sub.done)
+		for message := range pubsub.Channel() {
+			handler([]byte(message.Payload))
+		}
+	}()
+	return sub, nil
+}
+
+func (r *Redis) Broadcast(topic string, data []byte) error {
+	err := r.client.Publish(context.Background(), redisBroadcastPrefix+topic, data).Err()
+	if err != nil {
+		publishErrors.Inc()
+	}
+	return err
+}
+
+func (r *Redis) Close() error {
+	r.cancel()
+	<-r.done
+
+	r.mu.Lock()
+	broadcasts := make([]*redisBroadcast, 0, len(r.broadcasts))
+	for sub := range r.broadcasts {
+		broadcasts = append(broadcasts, sub)
+	}
+	r.mu.Unlock()
+	for _, sub := range broadcasts {
+		sub.Unsubscribe()
+	}
+	return nil
+}
+
+func (s *redisBroadcast) Unsubscribe() error {
+	s.redis.mu.Lock()
+	delete(s.redis.broadcasts, s)
+	s.redis.mu.Unlock()
+
+	err := s.pubsub.Close()
+	<-s.done
+	return err
+}
+
+func (r *Redis) keys() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make([]string, 0, len(r.topics))
+	for topic := range r.topics {
+		keys = append(keys, redisKeyPrefix+topic)
+	}
+	return keys
+}
+
+// consume pops the lists of every subscribed topic over a single
+// connection. The block is short so that new subscriptions are picked up.
+func (r *Redis) consume(ctx context.Context) {
+	defer close(r.done)
+
+	for ctx.Err() == nil {
+		keys := r.keys()
+		if len(keys) == 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(100 * time.Millisecond):
+			}
+			continue
+		}
+
+		result, err := r.client.BLPop(ctx, redisBlock, keys...).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Default.Error("Error reading from Redis backplane:", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		r.dispatch(strings.TrimPrefix(result[0], redisKeyPrefix), []byte(result[1]))
+	}
+}
+
+func (r *Redis) dispatch(topic string, data []byte) {
+	r.mu.Lock()
+	subs := r.topics[topic]
+	if len(subs) == 0 {
+		r.mu.Unlock()
+		// The last subscriber left while the message was popped: give it
+		// back for another server.
+		if err := r.Publish(topic, data); err != nil {
+			logger.Default.Error("Error requeuing message on Redis backplane:", err)
+		}
+		return
+	}
+	sub := subs[r.next[topic]%len(subs)]
+	r.next[topic]++
+	r.mu.Unlock()
+
+	go sub.handler(data)
+}
+
+func (s *redisSubscription) Unsubscribe() error {
+	r := s.redis
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.topics[s.topic] = removeSubscription(r.topics[s.topic], s)
+	if len(r.topics[s.topic]) == 0 {
+		delete(r.topics, s.topic)
+		delete(r.next, s.topic)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/db"
+)
+
+// Node is a registered node as shown by the admin API.
+type Node struct {
+	db.ClusterNode
+	Alive  bool  `json:"alive"`
+	Agents int64 `json:"agents"`
+}
+
+// Nodes lists the registered nodes with the number of agents connected to
+// each. A node is alive while its heartbeats arrive every interval.
+func Nodes(interval time.Duration) ([]Node, error) {
+	connection, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []db.ClusterNode
+	if err := connection.Order("id").Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	var counts []struct {
+		NodeID string
+		Agents int64
+	}
+	err = connection.Model(&db.AgentSession{}).
+		Select("node_id, COUNT(*) AS agents").
+		Group("node_id").
+		Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	agents := make(map[string]int64, len(counts))
+	for _, count := range counts {
+		agents[count.NodeID] = count.Agents
+	}
+
+	cutoff := time.Now().Add(-missedHeartbeats * interval)
+	nodes := make([]Node, 0, len(rows))
+	for _, row := range rows {
+		nodes = append(nodes, Node{
+			ClusterNode: row,
+			Alive:       row.HeartbeatAt.After(cutoff),
+			Agents:      agents[row.ID],
+		})
+	}
+	return nodes, nil
+}
+
+// Sessions lists the agents connected across the cluster, optionally only
+// those of a domain or of a node.
+func Sessions(domain, nodeID string) ([]db.AgentSession, error) {
+	connection, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	query := connection.Model(&db.AgentSession{})
+	if domain != "" {
+		query = query.Where("domain = ?", domain)
+	}
+	if nodeID != "" {
+		query = query.Where("node_id = ?", nodeID)
+	}
+
+	var sessions []db.AgentSession
+	err = query.Order("domain").Order("connected_at").Find(&sessions).Error
+	return sessions, err
+}
+
+// peersTTL is how long the nodes serving a domain are remembered, so that a
+// burst of visitors does not query the database for each connection. Past
+// maxPeerEntries domains the expired entries are dropped.
+const (
+	peersTTL       = 2 * time.Second
+	maxPeerEntries = 1024
+)
+
+type peerEntry struct {
+	addresses []string
+	expires   time.Time
+}
+
+// Peers returns the relay addresses of the other live nodes holding agents
+// of domain.
+func (r *Registry) Peers(domain string) ([]string, error) {
+	now := time.Now()
+	r.peersMu.Lock()
+	entry, ok := r.peers[domain]
+	r.peersMu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.addresses, nil
+	}
+
+	connection, err := connect()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	err = connection.Model(&db.ClusterNode{}).
+		Distinct("relay_address").
+		Where("id <> ? AND relay_address <> '' AND heartbeat_at > ?",
+			r.node.ID, now.UTC().Add(-missedHeartbeats*r.interval)).
+		Where("id IN (?)", connection.Model(&db.AgentSession{}).Select("node_id").Where("domain = ?", domain)).
+		Pluck("relay_address", &addresses).Error
+	if err != nil {
+		return nil, err
+	}
+
+	r.peersMu.Lock()
+	if len(r.peers) >= maxPeerEntries {
+		for name, entry := range r.peers {
+			if !now.Before(entry.expires) {
+				delete(r.peers, name)
+			}
+		}
+	}
+	r.peers[domain] = peerEntry{addresses: addresses, expires: now.Add(peersTTL)}
+	r.peersMu.Unlock()
+	return addresses, nil
+}
@@ -0,0 +1,260 @@
+// Package cluster keeps the registry of the servers sharing the database and
+// the directory of the agents connected to each of them.
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// missedHeartbeats is how many heartbeats a node may miss before the others
+// consider it gone and drop its sessions.
+const missedHeartbeats = 3
+
+// Registry announces this node and the agents connected to it. The
+// sessions are kept in memory and written to the database on every
+// heartbeat and soon after they change, so the directory converges to what
+// the node holds even after database errors.
+type Registry struct {
+	node     db.ClusterNode
+	interval time.Duration
+	mu       sync.Mutex
+	sessions map[string]db.AgentSession
+	peersMu  sync.Mutex
+	peers    map[string]peerEntry
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewRegistry prepares the registration of this node. managerAddress is
+// the address the manager listens on, whose port other nodes use to relay
+// visitors unless the configuration sets a relay address.
+func NewRegistry(conf config.ClusterConfig, managerAddress string) *Registry {
+	id := conf.NodeID
+	if id == "" {
+		id = defaultNodeID()
+	}
+	address := conf.AdvertiseAddress
+	if address == "" {
+		address = helper.GetPublicIP()
+	}
+	relayAddress := conf.RelayAddress
+	if relayAddress == "" {
+		if _, port, err := net.SplitHostPort(managerAddress); err == nil {
+			relayAddress = net.JoinHostPort(address, port)
+		}
+	}
+	interval := time.Duration(conf.HeartbeatInterval) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	now := time.Now().UTC()
+	return &Registry{
+		node: db.ClusterNode{
+			ID:           id,
+			Address:      address,
+			RelayAddress: relayAddress,
+			StartedAt:    now,
+			HeartbeatAt:  now,
+		},
+		interval: interval,
+		sessions: make(map[string]db.AgentSession),
+		peers:    make(map[string]peerEntry),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func defaultNodeID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "node"
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// NodeID identifies this node in the registry.
+func (r *Registry) NodeID() string {
+	return r.node.ID
+}
+
+// Address is the host agents dial to reach this node.
+func (r *Registry) Address() string {
+	return r.node.Address
+}
+
+// RelayAddress is where the other nodes forward visitors to this node.
+func (r *Registry) RelayAddress() string {
+	return r.node.RelayAddress
+}
+
+// Start registers the node and keeps its heartbeat until Close.
+func (r *Registry) Start() {
+	logger.Default.Info("Cluster node ", r.node.ID, " advertising ", r.node.Address)
+	go r.run()
+}
+
+func (r *Registry) AddSession(session db.AgentSession) {
+	session.NodeID = r.node.ID
+	r.mu.Lock()
+	r.sessions[session.ID] = session
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *Registry) RemoveSession(id string) {
+	r.mu.Lock()
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	r.notify()
+}
+
+func (r *Registry) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Close removes the node and its sessions from the registry.
+func (r *Registry) Close() {
+	close(r.stop)
+	<-r.done
+
+	connection, err := connect()
+	if err != nil {
+		logger.Default.Error("Error connecting to database:", err)
+		return
+	}
+	err = connection.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("node_id = ?", r.node.ID).Delete(&db.AgentSession{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&db.ClusterNode{ID: r.node.ID}).Error
+	})
+	if err != nil {
+		logger.Default.Error("Error leaving the cluster:", err)
+	}
+}
+
+func (r *Registry) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	r.heartbeat()
+	for {
+		select {
+		case <-ticker.C:
+			r.heartbeat()
+			r.prune()
+		case <-r.wake:
+			r.sync()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *Registry) heartbeat() {
+	connection, err := connect()
+	if err != nil {
+		logger.Default.Error("Error connecting to database:", err)
+		return
+	}
+
+	r.node.HeartbeatAt = time.Now().UTC()
+	err = connection.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"address", "relay_address", "heartbeat_at"}),
+	}).Create(&r.node).Error
+	if err != nil {
+		logger.Default.Error("Error sending cluster heartbeat:", err)
+		return
+	}
+	r.sync()
+}
+
+// sync replaces the sessions stored for this node with the ones it holds.
+func (r *Registry) sync() {
+	r.mu.Lock()
+	sessions := make([]db.AgentSession, 0, len(r.sessions))
+	ids := make([]string, 0, len(r.sessions))
+	for id, session := range r.sessions {
+		sessions = append(sessions, session)
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	connection, err := connect()
+	if err != nil {
+		logger.Default.Error("Error connecting to database:", err)
+		return
+	}
+
+	err = connection.Transaction(func(tx *gorm.DB) error {
+		stale := tx.Where("node_id = ?", r.node.ID)
+		if len(ids) > 0 {
+			stale = stale.Where("id NOT IN ?", ids)
+		}
+		if err := stale.Delete(&db.AgentSession{}).Error; err != nil {
+			return err
+		}
+		if len(sessions) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"node_id", "domain", "remote_addr", "routes"}),
+		}).Create(&sessions).Error
+	})
+	if err != nil {
+		logger.Default.Error("Error updating agent sessions:", err)
+	}
+}
+
+// prune forgets the nodes that stopped sending heartbeats, and their
+// sessions.
+func (r *Registry) prune() {
+	connection, err := connect()
+	if err != nil {
+		return
+	}
+
+	cutoff := time.Now().UTC().Add(-missedHeartbeats * r.interval)
+	err = connection.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("heartbeat_at < ?", cutoff).Delete(&db.ClusterNode{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("node_id NOT IN (?)", tx.Model(&db.ClusterNode{}).Select("id")).
+			Delete(&db.AgentSession{}).Error
+	})
+	if err != nil {
+		logger.Default.Error("Error pruning cluster nodes:", err)
+	}
+}
+
+func connect() (*gorm.DB, error) {
+	conf, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	return db.GetConnection(conf.Database)
+}
@@ -4,16 +4,19 @@ import (
 	"crypto/tls"
 	"errors"
 	"flag"
-	"io"
+	"fmt"
+	"io/fs"
 	"log"
 	"os"
-	"strconv"
+	"sync"
 
+	"github.com/OnnaSoft/lipstick/helper"
 	"gopkg.in/yaml.v3"
 )
 
 type ProxyConfig struct {
-	Address string `yaml:"address"`
+	Address       string `yaml:"address"`
+	ProxyProtocol bool   `yaml:"proxy_protocol"`
 }
 
 type ManagerConfig struct {
@@ -28,6 +31,121 @@ type NatsConfig struct {
 	URL string `yaml:"url"`
 }
 
+// EphemeralConfig enables tunnels whose subdomain is assigned by the server
+// under BaseDomain. TTL is expressed in seconds.
+type EphemeralConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	BaseDomain string `yaml:"base_domain"`
+	Scheme     string `yaml:"scheme"`
+	TTL        int    `yaml:"ttl"`
+}
+
+// EdgeAuthConfig controls the sessions issued to visitors of domains gated by
+// OIDC. SessionSecret defaults to a value derived from the admin secret key;
+// SessionTTL is expressed in seconds. The Authorization header of a visitor
+// accepted by basic auth is removed before it reaches the agent unless
+// ForwardAuthorization is set.
+type EdgeAuthConfig struct {
+	SessionSecret        string `yaml:"session_secret"`
+	SessionTTL           int    `yaml:"session_ttl"`
+	ForwardAuthorization bool   `yaml:"forward_authorization"`
+}
+
+// TrafficConfig sets how long traffic records are kept: hourly and daily
+// buckets in days, monthly ones in months. Zero keeps them forever. Sinks
+// lists where the counters are sent; the database alone when empty.
+type TrafficConfig struct {
+	HourlyRetention  int                 `yaml:"hourly_retention"`
+	DailyRetention   int                 `yaml:"daily_retention"`
+	MonthlyRetention int                 `yaml:"monthly_retention"`
+	Sinks            []TrafficSinkConfig `yaml:"sinks"`
+}
+
+// TrafficSinkConfig describes one destination of the traffic counters. Type
+// is "database", "file" (Path), "webhook" (URL, Headers, Timeout in seconds)
+// or "nats" (Subject, and URL when it is not the server in nats.url).
+type TrafficSinkConfig struct {
+	Type    string            `yaml:"type"`
+	Path    string            `yaml:"path"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout int               `yaml:"timeout"`
+	Subject string            `yaml:"subject"`
+}
+
+// ConnectionLogConfig enables the per-connection log. Retention is expressed
+// in days; zero keeps the entries forever.
+type ConnectionLogConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	Retention int  `yaml:"retention"`
+}
+
+// AuthCacheConfig sets how long domain and account lookups are cached, in
+// seconds. Changes made through the admin API evict them on every server at
+// once, so TTL only bounds how long changes made elsewhere, such as directly
+// in the database, take to apply. NegativeTTL caches the names that do not
+// exist; zero disables it.
+type AuthCacheConfig struct {
+	TTL         int `yaml:"ttl"`
+	NegativeTTL int `yaml:"negative_ttl"`
+}
+
+// AuthWebhookConfig defers agent and, with Visitors, visitor authorization
+// to the HTTP endpoint at URL, which receives Secret as a bearer token.
+// Answers are cached for AllowTTL or DenyTTL seconds; Timeout bounds each
+// call, in seconds.
+type AuthWebhookConfig struct {
+	URL      string `yaml:"url"`
+	Secret   string `yaml:"secret"`
+	Timeout  int    `yaml:"timeout"`
+	AllowTTL int    `yaml:"allow_ttl"`
+	DenyTTL  int    `yaml:"deny_ttl"`
+	Visitors bool   `yaml:"visitors"`
+}
+
+// DomainStoreConfig selects where domains and accounts are kept: "database"
+// (the default, the server database), "sqlite" (the SQLite file at Path) or
+// "file" (the YAML or JSON file at Path, read-only and reloaded when it
+// changes). ReloadInterval is how often the file is checked, in seconds.
+type DomainStoreConfig struct {
+	Type           string `yaml:"type"`
+	Path           string `yaml:"path"`
+	ReloadInterval int    `yaml:"reload_interval"`
+}
+
+// MetricsConfig protects the admin /metrics endpoint with a bearer token
+// when Token is set.
+type MetricsConfig struct {
+	Token string `yaml:"token"`
+}
+
+// ClusterConfig identifies this server among those sharing the database.
+// AdvertiseAddress is the host agents dial, on the manager port, to claim
+// the tickets of visitors connected here; it defaults to the first
+// non-loopback IPv4 address. NodeID defaults to the host name with a random
+// suffix. HeartbeatInterval is expressed in seconds.
+//
+// With Relay set, a node receiving visitors of a domain whose agents are
+// connected elsewhere forwards them to that node instead of asking the
+// agents to dial back, so agents only need to reach the node they connect
+// to. Nodes reach each other at RelayAddress, the advertise address on the
+// manager port by default, and prove their membership with Secret.
+type ClusterConfig struct {
+	NodeID            string `yaml:"node_id"`
+	AdvertiseAddress  string `yaml:"advertise_address"`
+	HeartbeatInterval int    `yaml:"heartbeat_interval"`
+	Relay             bool   `yaml:"relay"`
+	RelayAddress      string `yaml:"relay_address"`
+	Secret            string `yaml:"secret"`
+}
+
+// BackplaneConfig selects how tickets reach the server holding an agent:
+// "nats", "redis", "postgres" or "memory" (a single server). It defaults to
+// "memory" in standalone mode and to "nats" otherwise.
+type BackplaneConfig struct {
+	Type string `yaml:"type"`
+}
+
 type TLSConfig struct {
 	CertificatePath string `yaml:"certificate_path"`
 	KeyPath         string `yaml:"key_path"`
@@ -46,15 +164,31 @@ func (t *TLSConfig) GetTLSConfig() *tls.Config {
 	}
 }
 
+// DatabaseConfig locates the server database. Driver is "postgres",
+// "mysql" (MySQL or MariaDB) or "sqlite", whose file is given by Path. Port
+// defaults to the driver's. SSLMode takes the PostgreSQL values (disable,
+// require, verify-ca, verify-full) for every server; SSLRootCert, SSLCert
+// and SSLKey are the PEM files of the CA and of the client certificate.
 type DatabaseConfig struct {
-	Host     string `yaml:"host"`
-	Port     int    `yaml:"port"`
-	User     string `yaml:"user"`
-	Password string `yaml:"password"`
-	Database string `yaml:"database"`
-	SSLMode  string `yaml:"ssl_mode"`
+	Driver      string `yaml:"driver"`
+	Path        string `yaml:"path"`
+	Host        string `yaml:"host"`
+	Port        int    `yaml:"port"`
+	User        string `yaml:"user"`
+	Password    string `yaml:"password"`
+	Database    string `yaml:"database"`
+	SSLMode     string `yaml:"ssl_mode"`
+	SSLRootCert string `yaml:"ssl_root_cert"`
+	SSLCert     string `yaml:"ssl_cert"`
+	SSLKey      string `yaml:"ssl_key"`
 }
 
+const (
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+	DriverSQLite   = "sqlite"
+)
+
 type RedisConfig struct {
 	Host         string `yaml:"host"`
 	Port         int    `yaml:"port"`
@@ -65,29 +199,48 @@ type RedisConfig struct {
 	PoolTimeout  int    `yaml:"pool_timeout"`
 }
 
+const (
+	// ModeCluster keeps domains and traffic in PostgreSQL by default and
+	// hands tickets to other servers over NATS.
+	ModeCluster = "cluster"
+	// ModeStandalone runs a single server, by default on an embedded SQLite
+	// database, with tickets distributed in process.
+	ModeStandalone = "standalone"
+)
+
+const defaultSQLitePath = "lipstick.db"
+
 type AppConfig struct {
-	AdminSecretKey string         `yaml:"admin_secret_key"`
-	Proxy          ProxyConfig    `yaml:"proxy"`
-	Manager        ManagerConfig  `yaml:"manager"`
-	Admin          AdminConfig    `yaml:"admin"`
-	TLS            TLSConfig      `yaml:"tls"`
-	Database       DatabaseConfig `yaml:"database"`
-	Redis          RedisConfig    `yaml:"redis"`
-	Nats           NatsConfig     `yaml:"nats"`
+	Mode           string              `yaml:"mode"`
+	AdminSecretKey string              `yaml:"admin_secret_key"`
+	Proxy          ProxyConfig         `yaml:"proxy"`
+	Manager        ManagerConfig       `yaml:"manager"`
+	Admin          AdminConfig         `yaml:"admin"`
+	TLS            TLSConfig           `yaml:"tls"`
+	Database       DatabaseConfig      `yaml:"database"`
+	Redis          RedisConfig         `yaml:"redis"`
+	Nats           NatsConfig          `yaml:"nats"`
+	Backplane      BackplaneConfig     `yaml:"backplane"`
+	Cluster        ClusterConfig       `yaml:"cluster"`
+	Ephemeral      EphemeralConfig     `yaml:"ephemeral"`
+	EdgeAuth       EdgeAuthConfig      `yaml:"edge_auth"`
+	Traffic        TrafficConfig       `yaml:"traffic"`
+	ConnectionLog  ConnectionLogConfig `yaml:"connection_log"`
+	Metrics        MetricsConfig       `yaml:"metrics"`
+	AuthCache      AuthCacheConfig     `yaml:"auth_cache"`
+	DomainStore    DomainStoreConfig   `yaml:"domain_store"`
+	AuthWebhook    AuthWebhookConfig   `yaml:"auth_webhook"`
 }
 
-var appConfig AppConfig
+var (
+	appConfig  AppConfig
+	configErr  error
+	configOnce sync.Once
+)
 
-func loadConfig() {
-	var configPath string
-	var adminAddress, managerAddress, proxyAddress, adminSecretKey, tlsCert, tlsKey string
-	var redisHost, redisPassword, rabbitMQHost, rabbitMQUser, rabbitMQPassword, rabbitMQVHost string
-	var redisPort, redisDatabase, redisPoolSize, redisMinIdleConns, redisPoolTimeout, rabbitMQPort int
-	var dbHost, dbUser, dbPassword, dbName, dbSSLMode string
-	var dbPort int
-	var natsURL string
-
-	defaultConfig := AppConfig{
+func defaultConfig() AppConfig {
+	return AppConfig{
+		Mode: ModeCluster,
 		Admin: AdminConfig{
 			Address: ":5052",
 		},
@@ -107,7 +260,6 @@ func loadConfig() {
 		},
 		Database: DatabaseConfig{
 			Host:     "localhost",
-			Port:     5432,
 			User:     "postgres",
 			Password: "",
 			Database: "app_db",
@@ -116,71 +268,160 @@ func loadConfig() {
 		Nats: NatsConfig{
 			URL: "nats://localhost:4222",
 		},
+		Ephemeral: EphemeralConfig{
+			Scheme: "https",
+			TTL:    24 * 60 * 60,
+		},
+		EdgeAuth: EdgeAuthConfig{
+			SessionTTL: 24 * 60 * 60,
+		},
+		Traffic: TrafficConfig{
+			HourlyRetention: 31,
+			DailyRetention:  400,
+		},
+		ConnectionLog: ConnectionLogConfig{
+			Retention: 30,
+		},
+		Cluster: ClusterConfig{
+			HeartbeatInterval: 10,
+		},
+		AuthCache: AuthCacheConfig{
+			TTL:         5 * 60,
+			NegativeTTL: 30,
+		},
+		DomainStore: DomainStoreConfig{
+			Type:           "database",
+			ReloadInterval: 5,
+		},
+		AuthWebhook: AuthWebhookConfig{
+			Timeout:  5,
+			AllowTTL: 5 * 60,
+			DenyTTL:  30,
+		},
 	}
+}
 
-	flag.StringVar(&configPath, "c", "/etc/lipstick/config.yml", "Path to the configuration file")
-	flag.StringVar(&adminAddress, "admin-addr", "", "Address for the admin API")
-	flag.StringVar(&managerAddress, "manager-addr", "", "Address for WebSocket manager connections")
-	flag.StringVar(&proxyAddress, "proxy-addr", "", "Address for the proxy")
-	flag.StringVar(&adminSecretKey, "admin-secret", "", "Secret key for admin API authorization")
-	flag.StringVar(&tlsCert, "tls-cert", "", "Path to the TLS certificate")
-	flag.StringVar(&tlsKey, "tls-key", "", "Path to the TLS key")
-	flag.StringVar(&redisHost, "redis-host", "", "Redis host")
-	flag.IntVar(&redisPort, "redis-port", 0, "Redis port")
-	flag.StringVar(&redisPassword, "redis-password", "", "Redis password")
-	flag.IntVar(&redisDatabase, "redis-db", 0, "Redis database index")
-	flag.IntVar(&redisPoolSize, "redis-pool-size", 0, "Redis pool size")
-	flag.IntVar(&redisMinIdleConns, "redis-min-idle-conns", 0, "Redis minimum idle connections")
-	flag.IntVar(&redisPoolTimeout, "redis-pool-timeout", 0, "Redis pool timeout in seconds")
-	flag.StringVar(&rabbitMQHost, "rabbitmq-host", "", "RabbitMQ host")
-	flag.IntVar(&rabbitMQPort, "rabbitmq-port", 0, "RabbitMQ port")
-	flag.StringVar(&rabbitMQUser, "rabbitmq-user", "", "RabbitMQ user")
-	flag.StringVar(&rabbitMQPassword, "rabbitmq-password", "", "RabbitMQ password")
-	flag.StringVar(&rabbitMQVHost, "rabbitmq-vhost", "", "RabbitMQ virtual host")
-	flag.StringVar(&dbHost, "db-host", "", "Database host")
-	flag.IntVar(&dbPort, "db-port", 0, "Database port")
-	flag.StringVar(&dbUser, "db-user", "", "Database user")
-	flag.StringVar(&dbPassword, "db-password", "", "Database password")
-	flag.StringVar(&dbName, "db-name", "", "Database name")
-	flag.StringVar(&dbSSLMode, "db-ssl-mode", "", "Database SSL mode")
-	flag.StringVar(&natsURL, "nats-url", "", "NATS URL")
+// bindSettings declares the fields that can also be set from the
+// environment and the command line.
+func bindSettings(s *helper.Settings, conf *AppConfig) {
+	s.String(&conf.Mode, "mode", "MODE", "Server mode, cluster or standalone")
+	s.String(&conf.Admin.Address, "admin-addr", "ADMIN_ADDR", "Address for the admin API")
+	s.String(&conf.Manager.Address, "manager-addr", "MANAGER_ADDR", "Address for WebSocket manager connections")
+	s.String(&conf.Proxy.Address, "proxy-addr", "PROXY_ADDR", "Address for the proxy")
+	s.Secret(&conf.AdminSecretKey, "admin-secret", "ADMIN_SECRET_KEY", "Secret key for admin API authorization")
+	s.String(&conf.TLS.CertificatePath, "tls-cert", "TLS_CERT", "Path to the TLS certificate")
+	s.String(&conf.TLS.KeyPath, "tls-key", "TLS_KEY", "Path to the TLS key")
 
-	flag.Parse()
+	s.String(&conf.Redis.Host, "redis-host", "REDIS_HOST", "Redis host")
+	s.Int(&conf.Redis.Port, "redis-port", "REDIS_PORT", "Redis port")
+	s.Secret(&conf.Redis.Password, "redis-password", "REDIS_PASSWORD", "Redis password")
+	s.Int(&conf.Redis.Database, "redis-db", "REDIS_DB", "Redis database index")
+	s.Int(&conf.Redis.PoolSize, "redis-pool-size", "REDIS_POOL_SIZE", "Redis pool size")
+	s.Int(&conf.Redis.MinIdleConns, "redis-min-idle-conns", "REDIS_MIN_IDLE_CONNS", "Redis minimum idle connections")
+	s.Int(&conf.Redis.PoolTimeout, "redis-pool-timeout", "REDIS_POOL_TIMEOUT", "Redis pool timeout in seconds")
 
-	f, err := os.Open(configPath)
-	if err == nil {
-		defer f.Close()
-		buff, err := io.ReadAll(f)
-		if err == nil {
-			err = yaml.Unmarshal(buff, &defaultConfig)
-			if err != nil {
-				log.Printf("Error parsing configuration file: %v", err)
-			}
-		}
-	}
+	s.String(&conf.Database.Driver, "db-driver", "DB_DRIVER", "Database driver, postgres, mysql or sqlite")
+	s.String(&conf.Database.Path, "db-path", "DB_PATH", "SQLite database file")
+	s.String(&conf.Database.Host, "db-host", "DB_HOST", "Database host")
+	s.Int(&conf.Database.Port, "db-port", "DB_PORT", "Database port")
+	s.String(&conf.Database.User, "db-user", "DB_USER", "Database user")
+	s.Secret(&conf.Database.Password, "db-password", "DB_PASSWORD", "Database password")
+	s.String(&conf.Database.Database, "db-name", "DB_NAME", "Database name")
+	s.String(&conf.Database.SSLMode, "db-ssl-mode", "DB_SSL_MODE", "Database SSL mode")
+	s.String(&conf.Database.SSLRootCert, "db-ssl-root-cert", "DB_SSL_ROOT_CERT", "CA certificate of the database server")
+	s.String(&conf.Database.SSLCert, "db-ssl-cert", "DB_SSL_CERT", "Client certificate for the database")
+	s.String(&conf.Database.SSLKey, "db-ssl-key", "DB_SSL_KEY", "Client key for the database")
 
-	appConfig = defaultConfig
+	s.String(&conf.Nats.URL, "nats-url", "NATS_URL", "NATS URL")
+	s.String(&conf.Backplane.Type, "backplane", "BACKPLANE", "Backplane, nats, redis, postgres or memory")
+
+	// Secrets that are rarely passed on the command line, where other users
+	// could read them.
+	s.Secret(&conf.Cluster.Secret, "", "CLUSTER_SECRET", "")
+	s.Secret(&conf.EdgeAuth.SessionSecret, "", "EDGE_AUTH_SESSION_SECRET", "")
+	s.Secret(&conf.AuthWebhook.Secret, "", "AUTH_WEBHOOK_SECRET", "")
+	s.Secret(&conf.Metrics.Token, "", "METRICS_TOKEN", "")
 }
 
-func parseEnvInt(key string, defaultValue int) int {
-	if value, ok := os.LookupEnv(key); ok {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// loadConfig builds the configuration from, in increasing precedence, the
+// defaults, the file given with -c, the environment and the command line,
+// and reports every problem found at once.
+func loadConfig() (AppConfig, error) {
+	var configPath string
+
+	conf := defaultConfig()
+	settings := helper.NewSettings(flag.CommandLine)
+	flag.StringVar(&configPath, "c", "/etc/lipstick/config.yml", "Path to the configuration file")
+	bindSettings(settings, &conf)
+	flag.Parse()
+
+	var errs []error
+	if err := readConfigFile(configPath, &conf); err != nil {
+		errs = append(errs, err)
+	}
+	if err := settings.Apply(); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch conf.Mode {
+	case ModeStandalone:
+		if conf.Database.Driver == "" {
+			conf.Database.Driver = DriverSQLite
+		}
+		if conf.Backplane.Type == "" {
+			conf.Backplane.Type = "memory"
+		}
+	case ModeCluster:
+		if conf.Database.Driver == "" {
+			conf.Database.Driver = DriverPostgres
 		}
+		if conf.Backplane.Type == "" {
+			conf.Backplane.Type = "nats"
+		}
+	}
+	if conf.Database.Driver == DriverSQLite && conf.Database.Path == "" {
+		conf.Database.Path = defaultSQLitePath
 	}
-	return defaultValue
+
+	if err := conf.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return conf, errors.Join(errs...)
 }
 
-func GetConfig() (AppConfig, error) {
-	if appConfig.AdminSecretKey != "" {
-		return appConfig, nil
+// readConfigFile merges the YAML file at path into conf. The default file
+// may be missing; one named with -c may not.
+func readConfigFile(path string, conf *AppConfig) error {
+	buff, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) && !flagGiven("c") {
+		return nil
 	}
+	if err != nil {
+		return fmt.Errorf("error reading configuration file: %w", err)
+	}
+	if err := yaml.Unmarshal(buff, conf); err != nil {
+		return fmt.Errorf("error parsing configuration file %s: %w", path, err)
+	}
+	return nil
+}
 
-	loadConfig()
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		given = given || f.Name == name
+	})
+	return given
+}
 
-	if appConfig.AdminSecretKey == "" {
-		log.Fatal(errors.New("failed to load configuration"))
-	}
+func (c AppConfig) Standalone() bool {
+	return c.Mode == ModeStandalone
+}
 
-	return appConfig, nil
+// GetConfig loads the configuration on first use. The error lists every
+// invalid setting; the configuration is not meant to be used with it.
+func GetConfig() (AppConfig, error) {
+	configOnce.Do(func() {
+		appConfig, configErr = loadConfig()
+	})
+	return appConfig, configErr
 }
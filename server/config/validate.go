@@ -0,0 +1,94 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// sslModes are the ssl_mode values each database driver understands.
+var sslModes = map[string][]string{
+	DriverPostgres: {"disable", "allow", "prefer", "require", "verify-ca", "verify-full"},
+	DriverMySQL:    {"disable", "prefer", "preferred", "require", "verify-ca", "verify-full"},
+}
+
+// Validate reports every setting the server cannot start with.
+func (c AppConfig) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Mode != ModeCluster && c.Mode != ModeStandalone {
+		invalid("mode: unknown mode %q, expected %q or %q", c.Mode, ModeCluster, ModeStandalone)
+	}
+	if c.AdminSecretKey == "" {
+		invalid("admin_secret_key is required")
+	}
+	for _, listener := range []struct{ name, address string }{
+		{"admin.address", c.Admin.Address},
+		{"manager.address", c.Manager.Address},
+		{"proxy.address", c.Proxy.Address},
+	} {
+		if _, _, err := net.SplitHostPort(listener.address); err != nil {
+			invalid("%s: %v", listener.name, err)
+		}
+	}
+	if (c.TLS.CertificatePath == "") != (c.TLS.KeyPath == "") {
+		invalid("tls: certificate_path and key_path must be set together")
+	}
+
+	switch c.Database.Driver {
+	case DriverSQLite:
+	case DriverPostgres, DriverMySQL:
+		if c.Database.Port < 0 || c.Database.Port > 65535 {
+			invalid("database.port: %d is not a port", c.Database.Port)
+		}
+		if c.Database.SSLMode != "" && !slices.Contains(sslModes[c.Database.Driver], c.Database.SSLMode) {
+			invalid("database.ssl_mode: unknown mode %q for %s", c.Database.SSLMode, c.Database.Driver)
+		}
+	default:
+		invalid("database.driver: unknown driver %q, expected %q, %q or %q",
+			c.Database.Driver, DriverPostgres, DriverMySQL, DriverSQLite)
+	}
+	if c.Redis.Port < 1 || c.Redis.Port > 65535 {
+		invalid("redis.port: %d is not a port", c.Redis.Port)
+	}
+
+	switch c.Backplane.Type {
+	case "nats", "redis", "memory":
+	case "postgres":
+		if c.Database.Driver != DriverPostgres {
+			invalid("backplane: the postgres backplane requires a PostgreSQL database")
+		}
+	default:
+		invalid("backplane.type: unknown backplane %q", c.Backplane.Type)
+	}
+
+	switch c.DomainStore.Type {
+	case "database":
+	case "sqlite", "file":
+		if c.DomainStore.Path == "" {
+			invalid("domain_store.path is required by the %s store", c.DomainStore.Type)
+		}
+	default:
+		invalid("domain_store.type: unknown store %q", c.DomainStore.Type)
+	}
+
+	// Tickets carry the advertise address in a line split on colons.
+	if strings.Contains(c.Cluster.AdvertiseAddress, ":") {
+		invalid("cluster.advertise_address: %q must be a host name or IPv4 address, without a port", c.Cluster.AdvertiseAddress)
+	}
+	if c.Cluster.Relay && c.Cluster.Secret == "" {
+		invalid("cluster.relay requires cluster.secret")
+	}
+	if c.AuthWebhook.URL != "" {
+		if u, err := url.Parse(c.AuthWebhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			invalid("auth_webhook.url: %q is not an HTTP URL", c.AuthWebhook.URL)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,30 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateAdvertiseAddress(t *testing.T) {
+	for address, valid := range map[string]bool{
+		"":                   true,
+		"edge-1.example.com": true,
+		"203.0.113.7":        true,
+		"203.0.113.7:5051":   false,
+		"2001:db8::1":        false,
+	} {
+		conf := defaultConfig()
+		conf.AdminSecretKey = "secret"
+		conf.Database.Driver = DriverPostgres
+		conf.Backplane.Type = "nats"
+		conf.Cluster.AdvertiseAddress = address
+
+		err := conf.Validate()
+		if valid && err != nil {
+			t.Errorf("Validate with advertise address %q: %v", address, err)
+		}
+		if !valid && (err == nil || !strings.Contains(err.Error(), "cluster.advertise_address")) {
+			t.Errorf("Validate with advertise address %q returned %v, want it rejected", address, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+type counterTable struct {
+	model interface{}
+	keys  []string
+	sums  []string
+}
+
+// counterTables are the tables whose rows are keyed by a unique index.
+// Servers that wrote them before the indexes existed may have left several
+// rows for the same key.
+var counterTables = []counterTable{
+	{&HourlyConsumption{}, []string{"domain", "hour"}, []string{"bytes_in", "bytes_out"}},
+	{&DailyConsumption{}, []string{"domain", "date"}, []string{"bytes_used", "bytes_in", "bytes_out"}},
+	{&MonthlyConsumption{}, []string{"domain", "month"}, []string{"bytes_used", "bytes_in", "bytes_out"}},
+	{&DailyRequests{}, []string{"domain", "date", "method", "status_class"}, []string{"requests", "latency_ms"}},
+	{&DailyLatency{}, []string{"domain", "date", "le_ms"}, []string{"requests"}},
+}
+
+// mergeDuplicateCounters folds duplicated counter rows into the oldest one
+// so that the unique indexes can be created.
+func mergeDuplicateCounters(connection *gorm.DB) error {
+	for _, table := range counterTables {
+		if err := mergeDuplicates(connection, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mergeDuplicates(connection *gorm.DB, table counterTable) error {
+	migrator := connection.Migrator()
+	if !migrator.HasTable(table.model) {
+		return nil
+	}
+	// Tables written by older servers may lack some of the counters.
+	var sums []string
+	for _, column := range table.sums {
+		if migrator.HasColumn(table.model, column) {
+			sums = append(sums, column)
+		}
+	}
+
+	columns := append([]string{"MIN(id) AS keep_id"}, table.keys...)
+	for _, column := range sums {
+		columns = append(columns, fmt.Sprintf("SUM(%s) AS %s", column, column))
+	}
+
+	var groups []map[string]interface{}
+	err := connection.Model(table.model).
+		Select(strings.Join(columns, ", ")).
+		Group(strings.Join(table.keys, ", ")).
+		Having("COUNT(*) > 1").
+		Find(&groups).Error
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		err := connection.Transaction(func(tx *gorm.DB) error {
+			keep := group["keep_id"]
+			if len(sums) > 0 {
+				values := make(map[string]interface{}, len(sums))
+				for _, column := range sums {
+					values[column] = group[column]
+				}
+				if err := tx.Model(table.model).Where("id = ?", keep).Updates(values).Error; err != nil {
+					return err
+				}
+			}
+
+			where := make(map[string]interface{}, len(table.keys))
+			for _, key := range table.keys {
+				where[key] = group[key]
+			}
+			return tx.Where(where).Where("id <> ?", keep).Delete(table.model).Error
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
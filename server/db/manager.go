@@ -1,11 +1,21 @@
 package db
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/glebarez/sqlite"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -13,12 +23,23 @@ import (
 var defaultConnection *gorm.DB
 
 func NewConnection(conf config.DatabaseConfig) (*gorm.DB, error) {
-	dsn := fmt.Sprintf(
-		"host=%s user=%s dbname=%s sslmode=%s password=%s",
-		conf.Host, conf.User, conf.Database, conf.SSLMode, conf.Password,
-	)
+	var dialector gorm.Dialector
+	switch conf.Driver {
+	case config.DriverSQLite:
+		return newSQLiteConnection(conf.Path)
+	case config.DriverPostgres, "":
+		dialector = postgres.Open(postgresDSN(conf))
+	case config.DriverMySQL:
+		dsn, err := mysqlDSN(conf)
+		if err != nil {
+			return nil, err
+		}
+		dialector = mysql.New(mysql.Config{DSN: dsn, DefaultStringSize: 255})
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", conf.Driver)
+	}
 
-	connection, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	connection, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -33,6 +54,149 @@ func NewConnection(conf config.DatabaseConfig) (*gorm.DB, error) {
 	return connection, nil
 }
 
+// postgresDSN builds a connection URL, so that credentials holding spaces or
+// quotes need no escaping by the user.
+func postgresDSN(conf config.DatabaseConfig) string {
+	port := conf.Port
+	if port == 0 {
+		port = 5432
+	}
+	query := url.Values{}
+	if conf.SSLMode != "" {
+		query.Set("sslmode", conf.SSLMode)
+	}
+	if conf.SSLRootCert != "" {
+		query.Set("sslrootcert", conf.SSLRootCert)
+	}
+	if conf.SSLCert != "" {
+		query.Set("sslcert", conf.SSLCert)
+	}
+	if conf.SSLKey != "" {
+		query.Set("sslkey", conf.SSLKey)
+	}
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(conf.User, conf.Password),
+		Host:     net.JoinHostPort(conf.Host, strconv.Itoa(port)),
+		Path:     "/" + conf.Database,
+		RawQuery: query.Encode(),
+	}
+	return dsn.String()
+}
+
+// mysqlTLSConfig is the name the TLS settings of verify-ca and verify-full
+// are registered under with the MySQL driver.
+const mysqlTLSConfig = "lipstick"
+
+// mysqlDSN builds the DSN of a MySQL or MariaDB server. Times are read back
+// as UTC and several statements may be sent at once, as migrations do.
+func mysqlDSN(conf config.DatabaseConfig) (string, error) {
+	port := conf.Port
+	if port == 0 {
+		port = 3306
+	}
+	dsn := mysqldriver.NewConfig()
+	dsn.Net = "tcp"
+	dsn.Addr = net.JoinHostPort(conf.Host, strconv.Itoa(port))
+	dsn.User = conf.User
+	dsn.Passwd = conf.Password
+	dsn.DBName = conf.Database
+	dsn.ParseTime = true
+	dsn.Loc = time.UTC
+	dsn.MultiStatements = true
+	dsn.Params = map[string]string{"charset": "utf8mb4"}
+
+	switch conf.SSLMode {
+	case "", "disable":
+	case "prefer", "preferred":
+		dsn.TLSConfig = "preferred"
+	case "require":
+		dsn.TLSConfig = "skip-verify"
+	case "verify-ca", "verify-full":
+		tlsConfig, err := mysqlTLS(conf)
+		if err != nil {
+			return "", err
+		}
+		if err := mysqldriver.RegisterTLSConfig(mysqlTLSConfig, tlsConfig); err != nil {
+			return "", err
+		}
+		dsn.TLSConfig = mysqlTLSConfig
+	default:
+		return "", fmt.Errorf("unknown database ssl_mode %q", conf.SSLMode)
+	}
+	return dsn.FormatDSN(), nil
+}
+
+// mysqlTLS verifies the server against SSLRootCert, or the system roots, and
+// presents the client certificate when one is configured. verify-ca skips
+// the host name check, as PostgreSQL does.
+func mysqlTLS(conf config.DatabaseConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: conf.Host}
+	if conf.SSLRootCert != "" {
+		pem, err := os.ReadFile(conf.SSLRootCert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", conf.SSLRootCert)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if conf.SSLCert != "" || conf.SSLKey != "" {
+		cert, err := tls.LoadX509KeyPair(conf.SSLCert, conf.SSLKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if conf.SSLMode == "verify-ca" {
+		roots := tlsConfig.RootCAs
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			certs := make([]*x509.Certificate, 0, len(rawCerts))
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if err != nil {
+					return err
+				}
+				certs = append(certs, cert)
+			}
+			if len(certs) == 0 {
+				return errors.New("the database server sent no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range certs[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	}
+	return tlsConfig, nil
+}
+
+// newSQLiteConnection opens the embedded database used in standalone mode.
+// SQLite allows a single writer, so the pool is limited to one connection
+// and times are stored in UTC to keep them comparable as text.
+func newSQLiteConnection(path string) (*gorm.DB, error) {
+	dsn := path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+	connection, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{
+		NowFunc: func() time.Time { return time.Now().UTC() },
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database %s: %w", path, err)
+	}
+
+	sqlDB, err := connection.DB()
+	if err != nil {
+		return nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+
+	return connection, nil
+}
+
 func GetConnection(conf config.DatabaseConfig) (*gorm.DB, error) {
 	if defaultConnection == nil {
 		connection, err := NewConnection(conf)
@@ -54,14 +218,3 @@ func CloseConnection() {
 		sqlDB.Close()
 	}
 }
-
-func Migrate(conf config.DatabaseConfig) {
-	connection, err := GetConnection(conf)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if err := connection.AutoMigrate(&Domain{}, &DailyConsumption{}); err != nil {
-		log.Fatal(err.Error())
-	}
-}
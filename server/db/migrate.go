@@ -0,0 +1,370 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"gorm.io/gorm"
+)
+
+// migrationFiles holds, for each supported database, the migrations named
+// <version>_<name>.up.sql and <version>_<name>.down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// baselineVersion is the migration describing the schema AutoMigrate used to
+// create. Counters duplicated by older servers are merged before it adds the
+// unique indexes.
+const baselineVersion = 1
+
+// migrationLockKey names the PostgreSQL advisory lock, or the MySQL named
+// lock, held while migrating, so that nodes starting together apply each
+// migration once.
+const migrationLockKey = "lipstick.schema_migrations"
+
+// migrationLockTimeout is how long, in seconds, MySQL waits for the lock.
+const migrationLockTimeout = 600
+
+type Migration struct {
+	Version int
+	Name    string
+	up      string
+	down    string
+}
+
+// MigrationStatus is a migration and when it was applied; AppliedAt is zero
+// while it is pending. Migrations recorded in the database but unknown to
+// this version are listed with Unknown set.
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+	Unknown   bool
+}
+
+// Migrator applies the migrations of the database behind a connection and
+// records them in the schema_migrations table.
+type Migrator struct {
+	connection *gorm.DB
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+func NewMigrator(connection *gorm.DB) (*Migrator, error) {
+	sqlDB, err := connection.DB()
+	if err != nil {
+		return nil, err
+	}
+	dialect := connection.Dialector.Name()
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{
+		connection: connection,
+		db:         sqlDB,
+		dialect:    dialect,
+		migrations: migrations,
+	}, nil
+}
+
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s databases", dialect)
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		base, direction, ok := cutDirection(entry.Name())
+		if !ok {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		number, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		contents, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, exists := byVersion[version]
+		if !exists {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		}
+		if direction == "up" {
+			migration.up = string(contents)
+		} else {
+			migration.down = string(contents)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.up == "" {
+			return nil, fmt.Errorf("migration %d has no up script", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+func cutDirection(name string) (string, string, bool) {
+	if base, ok := strings.CutSuffix(name, ".up.sql"); ok {
+		return base, "up", true
+	}
+	if base, ok := strings.CutSuffix(name, ".down.sql"); ok {
+		return base, "down", true
+	}
+	return "", "", false
+}
+
+// Up applies the pending migrations in order and returns them.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	var applied []Migration
+	err := m.locked(ctx, func() error {
+		done, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := done[migration.Version]; ok {
+				continue
+			}
+			if migration.Version == baselineVersion {
+				if err := mergeDuplicateCounters(m.connection); err != nil {
+					return err
+				}
+			}
+			if err := m.run(ctx, migration, true); err != nil {
+				return err
+			}
+			applied = append(applied, migration)
+		}
+		return nil
+	})
+	return applied, err
+}
+
+// Down rolls back the last steps applied migrations and returns them.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]Migration, error) {
+	var reverted []Migration
+	err := m.locked(ctx, func() error {
+		done, err := m.applied(ctx)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := done[migration.Version]; !ok {
+				continue
+			}
+			if migration.down == "" {
+				return fmt.Errorf("migration %d_%s cannot be rolled back", migration.Version, migration.Name)
+			}
+			if err := m.run(ctx, migration, false); err != nil {
+				return err
+			}
+			reverted = append(reverted, migration)
+		}
+		return nil
+	})
+	return reverted, err
+}
+
+// Status lists the known migrations, followed by those recorded in the
+// database by a newer version.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	if err := m.createTable(ctx); err != nil {
+		return nil, err
+	}
+	done, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if record, ok := done[migration.Version]; ok {
+			status.AppliedAt = record.AppliedAt
+			delete(done, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, record := range done {
+		record.Unknown = true
+		statuses = append(statuses, record)
+	}
+	sort.SliceStable(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// locked runs fn holding the migration lock. SQLite databases are written by
+// a single server, which SQLite's own locking already protects.
+func (m *Migrator) locked(ctx context.Context, fn func() error) error {
+	var lock, unlock string
+	switch m.dialect {
+	case "postgres":
+		lock, unlock = "SELECT pg_advisory_lock(hashtext($1))", "SELECT pg_advisory_unlock(hashtext($1))"
+	case "mysql":
+		lock, unlock = "SELECT GET_LOCK(?, "+strconv.Itoa(migrationLockTimeout)+")", "SELECT RELEASE_LOCK(?)"
+	default:
+		if err := m.createTable(ctx); err != nil {
+			return err
+		}
+		return fn()
+	}
+
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := m.lock(ctx, conn, lock); err != nil {
+		return fmt.Errorf("error locking migrations: %w", err)
+	}
+	defer func() {
+		if _, err := conn.ExecContext(context.Background(), unlock, migrationLockKey); err != nil {
+			log.Printf("Error unlocking migrations: %v", err)
+		}
+	}()
+
+	if err := m.createTable(ctx); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// lock waits for the migration lock on conn. GET_LOCK returns 1 once it holds
+// the lock and 0 when it timed out.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn, query string) error {
+	if m.dialect != "mysql" {
+		_, err := conn.ExecContext(ctx, query, migrationLockKey)
+		return err
+	}
+	var acquired sql.NullInt64
+	if err := conn.QueryRowContext(ctx, query, migrationLockKey).Scan(&acquired); err != nil {
+		return err
+	}
+	if acquired.Int64 != 1 {
+		return errors.New("timed out waiting for another node")
+	}
+	return nil
+}
+
+func (m *Migrator) createTable(ctx context.Context) error {
+	// MySQL timestamps are limited to 2038 and follow the session time zone.
+	appliedAt := "timestamp"
+	if m.dialect == "mysql" {
+		appliedAt = "datetime"
+	}
+	_, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version bigint PRIMARY KEY,
+		name varchar(255) NOT NULL,
+		applied_at `+appliedAt+` NOT NULL
+	)`)
+	return err
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]MigrationStatus, error) {
+	rows, err := m.db.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	done := make(map[int]MigrationStatus)
+	for rows.Next() {
+		var status MigrationStatus
+		if err := rows.Scan(&status.Version, &status.Name, &status.AppliedAt); err != nil {
+			return nil, err
+		}
+		done[status.Version] = status
+	}
+	return done, rows.Err()
+}
+
+// run applies a migration, or reverts it, together with its record. MySQL
+// commits DDL statements as it runs them, so there a failed migration may
+// leave part of its changes behind; the scripts are written to be rerun.
+func (m *Migrator) run(ctx context.Context, migration Migration, up bool) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	script, record, args := migration.up, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)",
+		[]any{migration.Version, migration.Name, time.Now().UTC()}
+	if !up {
+		script, record, args = migration.down, "DELETE FROM schema_migrations WHERE version = ?", []any{migration.Version}
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+	}
+	if _, err := tx.ExecContext(ctx, m.rebind(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// rebind turns the ? placeholders of query into the ones of the database.
+func (m *Migrator) rebind(query string) string {
+	if m.dialect != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Migrate brings the database up to date, as servers do on startup.
+func Migrate(conf config.DatabaseConfig) {
+	connection, err := GetConnection(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := MigrateConnection(connection); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// MigrateConnection applies the pending migrations of connection.
+func MigrateConnection(connection *gorm.DB) error {
+	migrator, err := NewMigrator(connection)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up(context.Background())
+	for _, migration := range applied {
+		log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestMigrator(t *testing.T) *Migrator {
+	t.Helper()
+	connection, err := newSQLiteConnection(filepath.Join(t.TempDir(), "lipstick.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := connection.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	migrator, err := NewMigrator(connection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return migrator
+}
+
+func TestMigrateUpDownUp(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMigrator(t)
+	m.migrations = append(m.migrations, Migration{
+		Version: 9999,
+		Name:    "notes",
+		up:      "CREATE TABLE notes (id integer PRIMARY KEY, body text)",
+		down:    "DROP TABLE notes",
+	})
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Version != baselineVersion || applied[1].Version != 9999 {
+		t.Fatalf("Up applied %v, want the baseline and 9999", applied)
+	}
+	if err := m.connection.Create(&Domain{Name: "example.com", ApiKey: "key"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	reverted, err := m.Down(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reverted) != 1 || reverted[0].Version != 9999 {
+		t.Fatalf("Down reverted %v, want 9999", reverted)
+	}
+	if m.connection.Migrator().HasTable("notes") {
+		t.Fatal("notes still exists after Down")
+	}
+
+	applied, err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 || applied[0].Version != 9999 {
+		t.Fatalf("second Up applied %v, want 9999", applied)
+	}
+	if applied, err := m.Up(ctx); err != nil || len(applied) != 0 {
+		t.Fatalf("Up on an up to date database applied %v: %v", applied, err)
+	}
+	assertDomainKept(t, m)
+}
+
+// The baseline adopts tables written by earlier versions, so rolling it back
+// must never drop them.
+func TestMigrateDownKeepsBaseline(t *testing.T) {
+	ctx := context.Background()
+	m := newTestMigrator(t)
+	if _, err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.connection.Create(&Domain{Name: "example.com", ApiKey: "key"}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	reverted, err := m.Down(ctx, 1)
+	if err == nil || !strings.Contains(err.Error(), "cannot be rolled back") {
+		t.Fatalf("Down of the baseline returned %v, want it refused", err)
+	}
+	if len(reverted) != 0 {
+		t.Fatalf("Down reverted %v", reverted)
+	}
+	assertDomainKept(t, m)
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 || statuses[0].AppliedAt.IsZero() {
+		t.Fatalf("Status = %+v, want the baseline applied", statuses)
+	}
+}
+
+func assertDomainKept(t *testing.T, m *Migrator) {
+	t.Helper()
+	var count int64
+	if err := m.connection.Model(&Domain{}).Where("name = ?", "example.com").Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("found %d domains, want the one created before", count)
+	}
+}
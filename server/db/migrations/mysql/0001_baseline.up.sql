@@ -0,0 +1,167 @@
+-- The schema the other databases reach with their baseline. Strings that are
+-- indexed are varchar(255), which keeps the unique keys within the utf8mb4
+-- index size limit.
+
+CREATE TABLE IF NOT EXISTS domains (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    name varchar(255) NOT NULL,
+    api_key text NOT NULL,
+    allow_multiple_connections boolean NOT NULL DEFAULT true,
+    aliases text,
+    wildcards text,
+    routes text,
+    allow_cidrs text,
+    deny_cidrs text,
+    basic_auth text,
+    oidc text,
+    max_connections bigint NOT NULL DEFAULT 0,
+    connection_rate double NOT NULL DEFAULT 0,
+    connection_burst bigint NOT NULL DEFAULT 0,
+    rate_limit_per_ip boolean NOT NULL DEFAULT false,
+    max_pending_tickets bigint NOT NULL DEFAULT 0,
+    upload_rate bigint NOT NULL DEFAULT 0,
+    download_rate bigint NOT NULL DEFAULT 0,
+    agent_upload_rate bigint NOT NULL DEFAULT 0,
+    agent_download_rate bigint NOT NULL DEFAULT 0,
+    monthly_quota bigint NOT NULL DEFAULT 0,
+    quota_action varchar(255) NOT NULL DEFAULT '',
+    quota_throttle_rate bigint NOT NULL DEFAULT 0,
+    quota_page text,
+    quota_warnings text,
+    quota_reset_month varchar(7),
+    quota_reset_bytes bigint NOT NULL DEFAULT 0,
+    tokens text,
+    PRIMARY KEY (id),
+    CONSTRAINT uni_domains_name UNIQUE (name)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS accounts (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    name varchar(255) NOT NULL,
+    api_key varchar(255) NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT uni_accounts_name UNIQUE (name),
+    CONSTRAINT uni_accounts_api_key UNIQUE (api_key)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS hourly_consumptions (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    domain varchar(255) NOT NULL,
+    hour datetime(3) NOT NULL,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    created_at datetime(3),
+    updated_at datetime(3),
+    PRIMARY KEY (id),
+    INDEX idx_hourly_consumptions_hour (hour),
+    UNIQUE INDEX idx_hourly_domain_hour (domain, hour)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS daily_consumptions (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    domain varchar(255) NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    bytes_used bigint NOT NULL DEFAULT 0,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    created_at datetime(3),
+    updated_at datetime(3),
+    PRIMARY KEY (id),
+    INDEX idx_daily_consumptions_domain (domain),
+    INDEX idx_daily_consumptions_month (month),
+    UNIQUE INDEX idx_daily_domain_date (domain, date)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS monthly_consumptions (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    domain varchar(255) NOT NULL,
+    month varchar(7) NOT NULL,
+    bytes_used bigint NOT NULL DEFAULT 0,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    created_at datetime(3),
+    updated_at datetime(3),
+    PRIMARY KEY (id),
+    INDEX idx_monthly_consumptions_month (month),
+    UNIQUE INDEX idx_monthly_domain_month (domain, month)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS daily_requests (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    domain varchar(255) NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    method varchar(16) NOT NULL,
+    status_class varchar(8) NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    latency_ms bigint NOT NULL DEFAULT 0,
+    created_at datetime(3),
+    updated_at datetime(3),
+    PRIMARY KEY (id),
+    INDEX idx_daily_requests_month (month),
+    UNIQUE INDEX idx_requests_key (domain, date, method, status_class)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS daily_latencies (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    domain varchar(255) NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    le_ms bigint NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    created_at datetime(3),
+    updated_at datetime(3),
+    PRIMARY KEY (id),
+    INDEX idx_daily_latencies_month (month),
+    UNIQUE INDEX idx_latency_key (domain, date, le_ms)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS connection_logs (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    domain varchar(255) NOT NULL,
+    visitor_addr text NOT NULL,
+    agent_id varchar(255),
+    protocol varchar(8) NOT NULL,
+    started_at datetime(3) NOT NULL,
+    ended_at datetime(3) NOT NULL,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    close_reason text,
+    PRIMARY KEY (id),
+    INDEX idx_connection_logs_domain (domain),
+    INDEX idx_connection_logs_agent_id (agent_id),
+    INDEX idx_connection_logs_started_at (started_at)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS cluster_nodes (
+    id varchar(64) NOT NULL,
+    address text NOT NULL,
+    relay_address varchar(255) NOT NULL DEFAULT '',
+    started_at datetime(3) NOT NULL,
+    heartbeat_at datetime(3) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_cluster_nodes_heartbeat_at (heartbeat_at)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS agent_sessions (
+    id varchar(64) NOT NULL,
+    domain varchar(255) NOT NULL,
+    node_id varchar(64) NOT NULL,
+    remote_addr text NOT NULL,
+    routes text,
+    connected_at datetime(3) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_agent_sessions_domain (domain),
+    INDEX idx_agent_sessions_node_id (node_id)
+) DEFAULT CHARSET = utf8mb4;
+
+CREATE TABLE IF NOT EXISTS backplane_messages (
+    id bigint unsigned NOT NULL AUTO_INCREMENT,
+    topic varchar(255) NOT NULL,
+    payload longblob NOT NULL,
+    created_at datetime(3) NOT NULL,
+    PRIMARY KEY (id),
+    INDEX idx_backplane_messages_topic (topic),
+    INDEX idx_backplane_messages_created_at (created_at)
+) DEFAULT CHARSET = utf8mb4;
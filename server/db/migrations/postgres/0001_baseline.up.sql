@@ -0,0 +1,168 @@
+-- The schema as AutoMigrate left it. Databases created by earlier versions
+-- are adopted as they are: missing tables, columns and indexes are added.
+
+CREATE TABLE IF NOT EXISTS domains (
+    id bigserial,
+    name text NOT NULL,
+    api_key text NOT NULL,
+    allow_multiple_connections boolean NOT NULL DEFAULT true,
+    PRIMARY KEY (id),
+    CONSTRAINT uni_domains_name UNIQUE (name)
+);
+ALTER TABLE domains
+    ADD COLUMN IF NOT EXISTS aliases text,
+    ADD COLUMN IF NOT EXISTS wildcards text,
+    ADD COLUMN IF NOT EXISTS routes text,
+    ADD COLUMN IF NOT EXISTS allow_cidrs text,
+    ADD COLUMN IF NOT EXISTS deny_cidrs text,
+    ADD COLUMN IF NOT EXISTS basic_auth text,
+    ADD COLUMN IF NOT EXISTS oidc text,
+    ADD COLUMN IF NOT EXISTS max_connections bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS connection_rate decimal NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS connection_burst bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS rate_limit_per_ip boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS max_pending_tickets bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS upload_rate bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS download_rate bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS agent_upload_rate bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS agent_download_rate bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS monthly_quota bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS quota_action text NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS quota_throttle_rate bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS quota_page text,
+    ADD COLUMN IF NOT EXISTS quota_warnings text,
+    ADD COLUMN IF NOT EXISTS quota_reset_month varchar(7),
+    ADD COLUMN IF NOT EXISTS quota_reset_bytes bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS tokens text;
+
+CREATE TABLE IF NOT EXISTS accounts (
+    id bigserial,
+    name text NOT NULL,
+    api_key text NOT NULL,
+    PRIMARY KEY (id),
+    CONSTRAINT uni_accounts_name UNIQUE (name),
+    CONSTRAINT uni_accounts_api_key UNIQUE (api_key)
+);
+
+CREATE TABLE IF NOT EXISTS hourly_consumptions (
+    id bigserial,
+    domain text NOT NULL,
+    hour timestamptz NOT NULL,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_hourly_consumptions_hour ON hourly_consumptions (hour);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_hourly_domain_hour ON hourly_consumptions (domain, hour);
+
+CREATE TABLE IF NOT EXISTS daily_consumptions (
+    id bigserial,
+    domain text NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    bytes_used bigint NOT NULL DEFAULT 0,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+ALTER TABLE daily_consumptions
+    ADD COLUMN IF NOT EXISTS bytes_in bigint NOT NULL DEFAULT 0,
+    ADD COLUMN IF NOT EXISTS bytes_out bigint NOT NULL DEFAULT 0;
+CREATE INDEX IF NOT EXISTS idx_daily_consumptions_domain ON daily_consumptions (domain);
+CREATE INDEX IF NOT EXISTS idx_daily_consumptions_month ON daily_consumptions (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_daily_domain_date ON daily_consumptions (domain, date);
+
+CREATE TABLE IF NOT EXISTS monthly_consumptions (
+    id bigserial,
+    domain text NOT NULL,
+    month varchar(7) NOT NULL,
+    bytes_used bigint NOT NULL DEFAULT 0,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_monthly_consumptions_month ON monthly_consumptions (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_monthly_domain_month ON monthly_consumptions (domain, month);
+
+CREATE TABLE IF NOT EXISTS daily_requests (
+    id bigserial,
+    domain text NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    method varchar(16) NOT NULL,
+    status_class varchar(8) NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    latency_ms bigint NOT NULL DEFAULT 0,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_daily_requests_month ON daily_requests (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_requests_key ON daily_requests (domain, date, method, status_class);
+
+CREATE TABLE IF NOT EXISTS daily_latencies (
+    id bigserial,
+    domain text NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    le_ms bigint NOT NULL,
+    requests bigint NOT NULL DEFAULT 0,
+    created_at timestamptz,
+    updated_at timestamptz,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_daily_latencies_month ON daily_latencies (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_latency_key ON daily_latencies (domain, date, le_ms);
+
+CREATE TABLE IF NOT EXISTS connection_logs (
+    id bigserial,
+    domain text NOT NULL,
+    visitor_addr text NOT NULL,
+    agent_id text,
+    protocol varchar(8) NOT NULL,
+    started_at timestamptz NOT NULL,
+    ended_at timestamptz NOT NULL,
+    bytes_in bigint NOT NULL DEFAULT 0,
+    bytes_out bigint NOT NULL DEFAULT 0,
+    close_reason text,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_connection_logs_domain ON connection_logs (domain);
+CREATE INDEX IF NOT EXISTS idx_connection_logs_agent_id ON connection_logs (agent_id);
+CREATE INDEX IF NOT EXISTS idx_connection_logs_started_at ON connection_logs (started_at);
+
+CREATE TABLE IF NOT EXISTS cluster_nodes (
+    id varchar(64),
+    address text NOT NULL,
+    started_at timestamptz NOT NULL,
+    heartbeat_at timestamptz NOT NULL,
+    PRIMARY KEY (id)
+);
+ALTER TABLE cluster_nodes ADD COLUMN IF NOT EXISTS relay_address text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_cluster_nodes_heartbeat_at ON cluster_nodes (heartbeat_at);
+
+CREATE TABLE IF NOT EXISTS agent_sessions (
+    id varchar(64),
+    domain text NOT NULL,
+    node_id varchar(64) NOT NULL,
+    remote_addr text NOT NULL,
+    routes text,
+    connected_at timestamptz NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_agent_sessions_domain ON agent_sessions (domain);
+CREATE INDEX IF NOT EXISTS idx_agent_sessions_node_id ON agent_sessions (node_id);
+
+CREATE TABLE IF NOT EXISTS backplane_messages (
+    id bigserial,
+    topic text NOT NULL,
+    payload bytea NOT NULL,
+    created_at timestamptz NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_backplane_messages_topic ON backplane_messages (topic);
+CREATE INDEX IF NOT EXISTS idx_backplane_messages_created_at ON backplane_messages (created_at);
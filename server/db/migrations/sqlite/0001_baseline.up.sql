@@ -0,0 +1,157 @@
+-- The schema as AutoMigrate left it, so that databases created by earlier
+-- versions are adopted as they are.
+
+CREATE TABLE IF NOT EXISTS domains (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text NOT NULL,
+    api_key text NOT NULL,
+    allow_multiple_connections numeric NOT NULL DEFAULT true,
+    aliases text,
+    wildcards text,
+    routes text,
+    allow_cidrs text,
+    deny_cidrs text,
+    basic_auth text,
+    oidc text,
+    max_connections integer NOT NULL DEFAULT 0,
+    connection_rate real NOT NULL DEFAULT 0,
+    connection_burst integer NOT NULL DEFAULT 0,
+    rate_limit_per_ip numeric NOT NULL DEFAULT false,
+    max_pending_tickets integer NOT NULL DEFAULT 0,
+    upload_rate integer NOT NULL DEFAULT 0,
+    download_rate integer NOT NULL DEFAULT 0,
+    agent_upload_rate integer NOT NULL DEFAULT 0,
+    agent_download_rate integer NOT NULL DEFAULT 0,
+    monthly_quota integer NOT NULL DEFAULT 0,
+    quota_action text NOT NULL DEFAULT '',
+    quota_throttle_rate integer NOT NULL DEFAULT 0,
+    quota_page text,
+    quota_warnings text,
+    quota_reset_month varchar(7),
+    quota_reset_bytes integer NOT NULL DEFAULT 0,
+    tokens text,
+    CONSTRAINT uni_domains_name UNIQUE (name)
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    name text NOT NULL,
+    api_key text NOT NULL,
+    CONSTRAINT uni_accounts_name UNIQUE (name),
+    CONSTRAINT uni_accounts_api_key UNIQUE (api_key)
+);
+
+CREATE TABLE IF NOT EXISTS hourly_consumptions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    domain text NOT NULL,
+    hour datetime NOT NULL,
+    bytes_in integer NOT NULL DEFAULT 0,
+    bytes_out integer NOT NULL DEFAULT 0,
+    created_at datetime,
+    updated_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_hourly_consumptions_hour ON hourly_consumptions (hour);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_hourly_domain_hour ON hourly_consumptions (domain, hour);
+
+CREATE TABLE IF NOT EXISTS daily_consumptions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    domain text NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    bytes_used integer NOT NULL DEFAULT 0,
+    bytes_in integer NOT NULL DEFAULT 0,
+    bytes_out integer NOT NULL DEFAULT 0,
+    created_at datetime,
+    updated_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_daily_consumptions_domain ON daily_consumptions (domain);
+CREATE INDEX IF NOT EXISTS idx_daily_consumptions_month ON daily_consumptions (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_daily_domain_date ON daily_consumptions (domain, date);
+
+CREATE TABLE IF NOT EXISTS monthly_consumptions (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    domain text NOT NULL,
+    month varchar(7) NOT NULL,
+    bytes_used integer NOT NULL DEFAULT 0,
+    bytes_in integer NOT NULL DEFAULT 0,
+    bytes_out integer NOT NULL DEFAULT 0,
+    created_at datetime,
+    updated_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_monthly_consumptions_month ON monthly_consumptions (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_monthly_domain_month ON monthly_consumptions (domain, month);
+
+CREATE TABLE IF NOT EXISTS daily_requests (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    domain text NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    method varchar(16) NOT NULL,
+    status_class varchar(8) NOT NULL,
+    requests integer NOT NULL DEFAULT 0,
+    latency_ms integer NOT NULL DEFAULT 0,
+    created_at datetime,
+    updated_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_daily_requests_month ON daily_requests (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_requests_key ON daily_requests (domain, date, method, status_class);
+
+CREATE TABLE IF NOT EXISTS daily_latencies (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    domain text NOT NULL,
+    date date NOT NULL,
+    month varchar(7) NOT NULL,
+    le_ms integer NOT NULL,
+    requests integer NOT NULL DEFAULT 0,
+    created_at datetime,
+    updated_at datetime
+);
+CREATE INDEX IF NOT EXISTS idx_daily_latencies_month ON daily_latencies (month);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_latency_key ON daily_latencies (domain, date, le_ms);
+
+CREATE TABLE IF NOT EXISTS connection_logs (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    domain text NOT NULL,
+    visitor_addr text NOT NULL,
+    agent_id text,
+    protocol varchar(8) NOT NULL,
+    started_at datetime NOT NULL,
+    ended_at datetime NOT NULL,
+    bytes_in integer NOT NULL DEFAULT 0,
+    bytes_out integer NOT NULL DEFAULT 0,
+    close_reason text
+);
+CREATE INDEX IF NOT EXISTS idx_connection_logs_domain ON connection_logs (domain);
+CREATE INDEX IF NOT EXISTS idx_connection_logs_agent_id ON connection_logs (agent_id);
+CREATE INDEX IF NOT EXISTS idx_connection_logs_started_at ON connection_logs (started_at);
+
+CREATE TABLE IF NOT EXISTS cluster_nodes (
+    id varchar(64),
+    address text NOT NULL,
+    relay_address text NOT NULL DEFAULT '',
+    started_at datetime NOT NULL,
+    heartbeat_at datetime NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_cluster_nodes_heartbeat_at ON cluster_nodes (heartbeat_at);
+
+CREATE TABLE IF NOT EXISTS agent_sessions (
+    id varchar(64),
+    domain text NOT NULL,
+    node_id varchar(64) NOT NULL,
+    remote_addr text NOT NULL,
+    routes text,
+    connected_at datetime NOT NULL,
+    PRIMARY KEY (id)
+);
+CREATE INDEX IF NOT EXISTS idx_agent_sessions_domain ON agent_sessions (domain);
+CREATE INDEX IF NOT EXISTS idx_agent_sessions_node_id ON agent_sessions (node_id);
+
+CREATE TABLE IF NOT EXISTS backplane_messages (
+    id integer PRIMARY KEY AUTOINCREMENT,
+    topic text NOT NULL,
+    payload blob NOT NULL,
+    created_at datetime NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_backplane_messages_topic ON backplane_messages (topic);
+CREATE INDEX IF NOT EXISTS idx_backplane_messages_created_at ON backplane_messages (created_at);
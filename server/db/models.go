@@ -3,18 +3,176 @@ package db
 import "time"
 
 type Domain struct {
-	ID                       uint   `gorm:"primary_key"`
-	Name                     string `gorm:"unique;not null"`
-	ApiKey                   string `gorm:"not null"`
-	AllowMultipleConnections bool   `gorm:"not null;default:true"`
+	ID                       uint              `gorm:"primary_key"`
+	Name                     string            `gorm:"unique;not null"`
+	ApiKey                   string            `gorm:"not null"`
+	AllowMultipleConnections bool              `gorm:"not null;default:true"`
+	Aliases                  []string          `gorm:"serializer:json;type:text"`
+	Wildcards                []string          `gorm:"serializer:json;type:text"`
+	Routes                   []Route           `gorm:"serializer:json;type:text"`
+	AllowCIDRs               []string          `gorm:"column:allow_cidrs;serializer:json;type:text"`
+	DenyCIDRs                []string          `gorm:"column:deny_cidrs;serializer:json;type:text"`
+	BasicAuth                []BasicCredential `gorm:"serializer:json;type:text"`
+	OIDC                     *OIDCSettings     `gorm:"column:oidc;serializer:json;type:text"`
+	MaxConnections           int               `gorm:"not null;default:0"`
+	ConnectionRate           float64           `gorm:"not null;default:0"`
+	ConnectionBurst          int               `gorm:"not null;default:0"`
+	RateLimitPerIP           bool              `gorm:"column:rate_limit_per_ip;not null;default:false"`
+	MaxPendingTickets        int               `gorm:"not null;default:0"`
+	UploadRate               int64             `gorm:"not null;default:0"`
+	DownloadRate             int64             `gorm:"not null;default:0"`
+	AgentUploadRate          int64             `gorm:"not null;default:0"`
+	AgentDownloadRate        int64             `gorm:"not null;default:0"`
+	MonthlyQuota             int64             `gorm:"not null;default:0"`
+	QuotaAction              string            `gorm:"not null;default:''"`
+	QuotaThrottleRate        int64             `gorm:"not null;default:0"`
+	QuotaPage                string            `gorm:"type:text"`
+	QuotaWarnings            []int             `gorm:"serializer:json;type:text"`
+	QuotaResetMonth          string            `gorm:"type:varchar(7)"`
+	QuotaResetBytes          int64             `gorm:"not null;default:0"`
+	Tokens                   []ApiToken        `gorm:"serializer:json;type:text"`
+}
+
+type ApiToken struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type BasicCredential struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"passwordHash"`
+}
+
+type OIDCSettings struct {
+	Issuer              string   `json:"issuer"`
+	ClientID            string   `json:"clientId"`
+	ClientSecret        string   `json:"clientSecret"`
+	Scopes              []string `json:"scopes,omitempty"`
+	AllowedEmailDomains []string `json:"allowedEmailDomains,omitempty"`
+}
+
+type Route struct {
+	PathPrefix  string `json:"pathPrefix"`
+	Header      string `json:"header,omitempty"`
+	HeaderValue string `json:"headerValue,omitempty"`
+	Group       string `json:"group"`
+	StripPrefix bool   `json:"stripPrefix,omitempty"`
+}
+
+type Account struct {
+	ID     uint   `gorm:"primary_key"`
+	Name   string `gorm:"unique;not null"`
+	ApiKey string `gorm:"unique;not null"`
+}
+
+// HourlyConsumption, DailyConsumption and MonthlyConsumption record the bytes
+// sent to agents (BytesIn) and to visitors (BytesOut). BytesUsed is their sum.
+type HourlyConsumption struct {
+	ID        uint      `gorm:"primary_key"`
+	Domain    string    `gorm:"not null;uniqueIndex:idx_hourly_domain_hour"`
+	Hour      time.Time `gorm:"not null;uniqueIndex:idx_hourly_domain_hour;index"`
+	BytesIn   int64     `gorm:"not null;default:0"`
+	BytesOut  int64     `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
 
 type DailyConsumption struct {
 	ID        uint      `gorm:"primary_key"`
-	Domain    string    `gorm:"not null;index"`
-	Date      time.Time `gorm:"type:date;not null"`
+	Domain    string    `gorm:"not null;index;uniqueIndex:idx_daily_domain_date"`
+	Date      time.Time `gorm:"type:date;not null;uniqueIndex:idx_daily_domain_date"`
 	Month     string    `gorm:"type:varchar(7);not null;index"`
 	BytesUsed int64     `gorm:"not null;default:0"`
+	BytesIn   int64     `gorm:"not null;default:0"`
+	BytesOut  int64     `gorm:"not null;default:0"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
+
+type MonthlyConsumption struct {
+	ID        uint   `gorm:"primary_key"`
+	Domain    string `gorm:"not null;uniqueIndex:idx_monthly_domain_month"`
+	Month     string `gorm:"type:varchar(7);not null;uniqueIndex:idx_monthly_domain_month;index"`
+	BytesUsed int64  `gorm:"not null;default:0"`
+	BytesIn   int64  `gorm:"not null;default:0"`
+	BytesOut  int64  `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// DailyRequests counts the HTTP requests answered for a domain by method and
+// status class ("2xx", "5xx", ...). LatencyMs is the sum of their latencies.
+type DailyRequests struct {
+	ID          uint      `gorm:"primary_key"`
+	Domain      string    `gorm:"not null;uniqueIndex:idx_requests_key"`
+	Date        time.Time `gorm:"type:date;not null;uniqueIndex:idx_requests_key"`
+	Month       string    `gorm:"type:varchar(7);not null;index"`
+	Method      string    `gorm:"type:varchar(16);not null;uniqueIndex:idx_requests_key"`
+	StatusClass string    `gorm:"type:varchar(8);not null;uniqueIndex:idx_requests_key"`
+	Requests    int64     `gorm:"not null;default:0"`
+	LatencyMs   int64     `gorm:"not null;default:0"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// DailyLatency is one bucket of a domain's daily latency histogram: the
+// requests answered within LeMs milliseconds (-1 for slower ones) that did
+// not fit a smaller bucket.
+type DailyLatency struct {
+	ID        uint      `gorm:"primary_key"`
+	Domain    string    `gorm:"not null;uniqueIndex:idx_latency_key"`
+	Date      time.Time `gorm:"type:date;not null;uniqueIndex:idx_latency_key"`
+	Month     string    `gorm:"type:varchar(7);not null;index"`
+	LeMs      int64     `gorm:"not null;uniqueIndex:idx_latency_key"`
+	Requests  int64     `gorm:"not null;default:0"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ClusterNode is a server sharing the database. Each node refreshes
+// HeartbeatAt while it runs; Address is where agents reach it and
+// RelayAddress where the other nodes forward visitors to it.
+type ClusterNode struct {
+	ID           string    `gorm:"primary_key;type:varchar(64)" json:"id"`
+	Address      string    `gorm:"not null" json:"address"`
+	RelayAddress string    `gorm:"not null;default:''" json:"relayAddress"`
+	StartedAt    time.Time `gorm:"not null" json:"startedAt"`
+	HeartbeatAt  time.Time `gorm:"not null;index" json:"heartbeatAt"`
+}
+
+// AgentSession is an agent connected to a node.
+type AgentSession struct {
+	ID          string    `gorm:"primary_key;type:varchar(64)" json:"id"`
+	Domain      string    `gorm:"not null;index" json:"domain"`
+	NodeID      string    `gorm:"not null;index;type:varchar(64)" json:"nodeId"`
+	RemoteAddr  string    `gorm:"not null" json:"remoteAddr"`
+	Routes      []string  `gorm:"serializer:json;type:text" json:"routes"`
+	ConnectedAt time.Time `gorm:"not null" json:"connectedAt"`
+}
+
+// BackplaneMessage is a message waiting in the PostgreSQL backplane for a
+// server to claim it.
+type BackplaneMessage struct {
+	ID        uint64    `gorm:"primary_key"`
+	Topic     string    `gorm:"not null;index"`
+	Payload   []byte    `gorm:"not null"`
+	CreatedAt time.Time `gorm:"not null;index"`
+}
+
+// ConnectionLog is one visitor connection, from the moment the hub accepted it
+// until it was closed. BytesIn went to the agent and BytesOut to the visitor.
+type ConnectionLog struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	Domain      string    `gorm:"not null;index" json:"domain"`
+	VisitorAddr string    `gorm:"not null" json:"visitorAddr"`
+	AgentID     string    `gorm:"index" json:"agentId"`
+	Protocol    string    `gorm:"type:varchar(8);not null" json:"protocol"`
+	StartedAt   time.Time `gorm:"not null;index" json:"startedAt"`
+	EndedAt     time.Time `gorm:"not null" json:"endedAt"`
+	BytesIn     int64     `gorm:"not null;default:0" json:"bytesIn"`
+	BytesOut    int64     `gorm:"not null;default:0" json:"bytesOut"`
+	CloseReason string    `json:"closeReason"`
+}
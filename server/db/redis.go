@@ -3,7 +3,9 @@ package db
 import (
 	"context"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/OnnaSoft/lipstick/server/config"
@@ -22,7 +24,7 @@ func NewRedisConnection() (*redis.Client, error) {
 	}
 
 	client := redis.NewClient(&redis.Options{
-		Addr:         conf.Redis.Host + ":" + string(rune(conf.Redis.Port)),
+		Addr:         net.JoinHostPort(conf.Redis.Host, strconv.Itoa(conf.Redis.Port)),
 		Password:     conf.Redis.Password,
 		DB:           conf.Redis.Database,
 		PoolSize:     conf.Redis.PoolSize,
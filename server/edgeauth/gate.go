@@ -0,0 +1,235 @@
+package edgeauth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	SessionCookie = "lipstick_session"
+	// NonceCookie binds a login to the browser that started it. It is only
+	// sent to the callback, which rejects states carrying another nonce.
+	NonceCookie  = "lipstick_nonce"
+	CallbackPath = "/.lipstick/auth/callback"
+	LogoutPath   = "/.lipstick/auth/logout"
+)
+
+// Gate authenticates visitors of HTTP tunnels before their requests reach
+// an agent. Sessions and OIDC state are signed with the gate's secret, so
+// any server node sharing the secret can validate them.
+type Gate struct {
+	secret               []byte
+	sessionTTL           time.Duration
+	forwardAuthorization bool
+	client               *http.Client
+	providers            sync.Map
+}
+
+// NewGate returns a gate signing with secret. Unless forwardAuthorization is
+// set, the basic auth credentials it accepts are removed from the request,
+// as they are the edge password rather than the agent's.
+func NewGate(secret []byte, sessionTTL time.Duration, forwardAuthorization bool) *Gate {
+	return &Gate{
+		secret:               secret,
+		sessionTTL:           sessionTTL,
+		forwardAuthorization: forwardAuthorization,
+		client:               &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Enabled reports whether a domain requires visitors to authenticate.
+func Enabled(domain *auth.Domain) bool {
+	return domain != nil && (len(domain.BasicAuth) > 0 || domain.OIDC != nil)
+}
+
+// Check decides whether req may be forwarded, removing the credentials it
+// accepted. When it may not, the returned bytes are the complete HTTP
+// response to send back to the visitor.
+func (g *Gate) Check(domain *auth.Domain, req *http.Request, secure bool) (bool, []byte) {
+	if len(domain.BasicAuth) > 0 && checkBasicAuth(domain.BasicAuth, req) {
+		if !g.forwardAuthorization {
+			req.Header.Del("Authorization")
+		}
+		return true, nil
+	}
+
+	if domain.OIDC != nil {
+		switch req.URL.Path {
+		case CallbackPath:
+			return false, g.handleCallback(domain, req, secure)
+		case LogoutPath:
+			return false, logoutResponse(secure)
+		}
+		if g.validSession(domain, req) {
+			return true, nil
+		}
+		return false, g.loginRedirect(domain, req, secure)
+	}
+
+	return false, response(http.StatusUnauthorized, http.Header{
+		"Www-Authenticate": {`Basic realm="` + domain.Name + `", charset="UTF-8"`},
+	}, "Unauthorized")
+}
+
+// StripSession removes the gate's cookies so that they never reach the agent.
+func StripSession(req *http.Request) bool {
+	cookies := req.Cookies()
+	kept := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		if cookie.Name != SessionCookie && cookie.Name != NonceCookie {
+			kept = append(kept, cookie.String())
+		}
+	}
+	if len(kept) == len(cookies) {
+		return false
+	}
+
+	req.Header.Del("Cookie")
+	if len(kept) > 0 {
+		req.Header.Set("Cookie", strings.Join(kept, "; "))
+	}
+	return true
+}
+
+// HashPassword returns the stored form of a basic auth password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+func checkBasicAuth(credentials []auth.BasicCredential, req *http.Request) bool {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return false
+	}
+	for _, credential := range credentials {
+		if credential.Username != username {
+			continue
+		}
+		return bcrypt.CompareHashAndPassword([]byte(credential.PasswordHash), []byte(password)) == nil
+	}
+	return false
+}
+
+type session struct {
+	Domain  string `json:"d"`
+	Email   string `json:"e"`
+	Expires int64  `json:"x"`
+}
+
+func (g *Gate) validSession(domain *auth.Domain, req *http.Request) bool {
+	cookie, err := req.Cookie(SessionCookie)
+	if err != nil {
+		return false
+	}
+
+	var s session
+	if !g.verify(cookie.Value, &s) {
+		logger.Default.Debug("Invalid session cookie for domain:", domain.Name)
+		return false
+	}
+	if s.Domain != domain.Name || time.Now().Unix() > s.Expires {
+		return false
+	}
+	return emailAllowed(domain.OIDC.AllowedEmailDomains, s.Email)
+}
+
+func emailAllowed(domains []string, email string) bool {
+	if len(domains) == 0 {
+		return email != ""
+	}
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	for _, domain := range domains {
+		if strings.EqualFold(email[at+1:], strings.TrimPrefix(domain, "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *Gate) sign(payload interface{}) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(b) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (g *Gate) verify(token string, payload interface{}) bool {
+	encoded, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, g.secret)
+	mac.Write(b)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return false
+	}
+	return json.Unmarshal(b, payload) == nil
+}
+
+func response(status int, header http.Header, body string) []byte {
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", fmt.Sprint(len(body)))
+	header.Set("Connection", "close")
+
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	header.Write(&buffer)
+	buffer.WriteString("\r\n")
+	buffer.WriteString(body)
+	return buffer.Bytes()
+}
+
+func redirect(location string, cookies ...*http.Cookie) []byte {
+	header := http.Header{"Location": {location}}
+	for _, cookie := range cookies {
+		header.Add("Set-Cookie", cookie.String())
+	}
+	return response(http.StatusFound, header, "Redirecting to "+location)
+}
+
+func logoutResponse(secure bool) []byte {
+	return redirect("/", &http.Cookie{
+		Name:     SessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,47 @@
+package edgeauth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+func TestBasicAuthRemovesCredentials(t *testing.T) {
+	hash, err := HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := &auth.Domain{Name: "example.com", BasicAuth: []auth.BasicCredential{{Username: "user", PasswordHash: hash}}}
+
+	for forward, want := range map[bool]bool{false: false, true: true} {
+		gate := NewGate([]byte("secret"), time.Hour, forward)
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.SetBasicAuth("user", "password")
+		if allowed, _ := gate.Check(domain, req, false); !allowed {
+			t.Fatal("valid credentials were refused")
+		}
+		if got := req.Header.Get("Authorization") != ""; got != want {
+			t.Errorf("with forwarding %v, Authorization forwarded = %v", forward, got)
+		}
+	}
+
+	// Credentials the gate did not accept belong to the agent.
+	oidcDomain := &auth.Domain{Name: "example.com", BasicAuth: domain.BasicAuth, OIDC: &auth.OIDCSettings{}}
+	gate := NewGate([]byte("secret"), time.Hour, false)
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("Authorization", "Bearer agent-token")
+	value, err := gate.sign(session{Domain: "example.com", Email: "user@example.com", Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(&http.Cookie{Name: SessionCookie, Value: value})
+	if allowed, _ := gate.Check(oidcDomain, req, false); !allowed {
+		t.Fatal("valid session was refused")
+	}
+	if req.Header.Get("Authorization") != "Bearer agent-token" {
+		t.Fatal("the agent's own Authorization header was removed")
+	}
+}
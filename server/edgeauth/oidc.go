@@ -0,0 +1,253 @@
+package edgeauth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+const stateTTL = 10 * time.Minute
+const discoveryTTL = time.Hour
+
+type providerMetadata struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	fetchedAt             time.Time
+}
+
+type loginState struct {
+	Domain  string `json:"d"`
+	Return  string `json:"r"`
+	Nonce   string `json:"n"`
+	Expires int64  `json:"x"`
+}
+
+// discover fetches and caches the provider's OpenID configuration.
+func (g *Gate) discover(issuer string) (*providerMetadata, error) {
+	if cached, ok := g.providers.Load(issuer); ok {
+		metadata := cached.(*providerMetadata)
+		if time.Since(metadata.fetchedAt) < discoveryTTL {
+			return metadata, nil
+		}
+	}
+
+	resp, err := g.client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("error fetching OIDC configuration: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching OIDC configuration: %s", resp.Status)
+	}
+
+	metadata := &providerMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, fmt.Errorf("error decoding OIDC configuration: %w", err)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("incomplete OIDC configuration for issuer %s", issuer)
+	}
+	metadata.fetchedAt = time.Now()
+	g.providers.Store(issuer, metadata)
+	return metadata, nil
+}
+
+func redirectURI(req *http.Request, secure bool) string {
+	scheme := "http"
+	if secure || strings.EqualFold(req.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + CallbackPath
+}
+
+func (g *Gate) loginRedirect(domain *auth.Domain, req *http.Request, secure bool) []byte {
+	metadata, err := g.discover(domain.OIDC.Issuer)
+	if err != nil {
+		logger.Default.Error("OIDC discovery failed for domain:", domain.Name, "Error:", err)
+		return response(http.StatusBadGateway, nil, "Authentication provider unavailable")
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return response(http.StatusInternalServerError, nil, "Internal error")
+	}
+	nonce := hex.EncodeToString(b)
+	state, err := g.sign(loginState{
+		Domain:  domain.Name,
+		Return:  req.URL.RequestURI(),
+		Nonce:   nonce,
+		Expires: time.Now().Add(stateTTL).Unix(),
+	})
+	if err != nil {
+		return response(http.StatusInternalServerError, nil, "Internal error")
+	}
+
+	scopes := domain.OIDC.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email"}
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {domain.OIDC.ClientID},
+		"redirect_uri":  {redirectURI(req, secure)},
+		"scope":         {strings.Join(scopes, " ")},
+		"state":         {state},
+	}
+
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return redirect(metadata.AuthorizationEndpoint+separator+query.Encode(), nonceCookie(nonce, stateTTL, secure))
+}
+
+// nonceCookie carries the nonce of a login in progress back to the callback.
+// It must survive the redirect from the provider's site, hence SameSite=Lax.
+func nonceCookie(nonce string, ttl time.Duration, secure bool) *http.Cookie {
+	maxAge := int(ttl.Seconds())
+	if ttl < 0 {
+		maxAge = -1
+	}
+	return &http.Cookie{
+		Name:     NonceCookie,
+		Value:    nonce,
+		Path:     CallbackPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// sameBrowser reports whether the callback comes from the browser the login
+// with state started in, so that a state and code obtained by someone else
+// cannot log the visitor into their account.
+func sameBrowser(state loginState, req *http.Request) bool {
+	cookie, err := req.Cookie(NonceCookie)
+	if err != nil || state.Nonce == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state.Nonce)) == 1
+}
+
+func (g *Gate) handleCallback(domain *auth.Domain, req *http.Request, secure bool) []byte {
+	query := req.URL.Query()
+	var state loginState
+	if !g.verify(query.Get("state"), &state) || state.Domain != domain.Name || time.Now().Unix() > state.Expires {
+		return response(http.StatusBadRequest, nil, "Invalid login state")
+	}
+	if !sameBrowser(state, req) {
+		logger.Default.Info("OIDC callback from another browser for domain:", domain.Name)
+		return response(http.StatusBadRequest, nil, "Invalid login state")
+	}
+	if errorCode := query.Get("error"); errorCode != "" {
+		return response(http.StatusForbidden, nil, "Login failed: "+errorCode)
+	}
+
+	email, err := g.exchange(domain.OIDC, query.Get("code"), redirectURI(req, secure))
+	if err != nil {
+		logger.Default.Error("OIDC login failed for domain:", domain.Name, "Error:", err)
+		return response(http.StatusForbidden, nil, "Login failed")
+	}
+	if !emailAllowed(domain.OIDC.AllowedEmailDomains, email) {
+		logger.Default.Info("OIDC login rejected for domain:", domain.Name, "Email:", email)
+		return response(http.StatusForbidden, nil, "Forbidden")
+	}
+
+	expires := time.Now().Add(g.sessionTTL)
+	value, err := g.sign(session{Domain: domain.Name, Email: email, Expires: expires.Unix()})
+	if err != nil {
+		return response(http.StatusInternalServerError, nil, "Internal error")
+	}
+
+	returnTo := state.Return
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	return redirect(returnTo, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secure,
+		SameSite: http.SameSiteLaxMode,
+	}, nonceCookie("", -1, secure))
+}
+
+// exchange trades an authorization code for the user's verified email,
+// read from the provider's userinfo endpoint.
+func (g *Gate) exchange(settings *auth.OIDCSettings, code, redirectURI string) (string, error) {
+	if code == "" {
+		return "", fmt.Errorf("missing authorization code")
+	}
+	metadata, err := g.discover(settings.Issuer)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {redirectURI},
+	}
+	tokenReq, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.SetBasicAuth(url.QueryEscape(settings.ClientID), url.QueryEscape(settings.ClientSecret))
+
+	tokenResp, err := g.client.Do(tokenReq)
+	if err != nil {
+		return "", fmt.Errorf("error requesting token: %w", err)
+	}
+	defer tokenResp.Body.Close()
+	if tokenResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", tokenResp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(tokenResp.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid token response")
+	}
+
+	userReq, err := http.NewRequest(http.MethodGet, metadata.UserinfoEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	userReq.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	userResp, err := g.client.Do(userReq)
+	if err != nil {
+		return "", fmt.Errorf("error requesting userinfo: %w", err)
+	}
+	defer userResp.Body.Close()
+	if userResp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("userinfo endpoint returned %s", userResp.Status)
+	}
+
+	var user struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err := json.NewDecoder(userResp.Body).Decode(&user); err != nil {
+		return "", fmt.Errorf("invalid userinfo response")
+	}
+	if user.EmailVerified != nil && !*user.EmailVerified {
+		return "", fmt.Errorf("email %s is not verified", user.Email)
+	}
+	return user.Email, nil
+}
@@ -0,0 +1,138 @@
+package edgeauth
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/edgeauth/oidctest"
+)
+
+func newTestDomain(t *testing.T) (*Gate, *auth.Domain) {
+	t.Helper()
+	provider := oidctest.NewProvider("lipstick", "client-secret")
+	t.Cleanup(provider.Close)
+	gate := NewGate([]byte("secret"), time.Hour, false)
+	return gate, &auth.Domain{Name: "app.example.com", OIDC: provider.Settings("example.com")}
+}
+
+// check runs req through the gate and parses the response it refuses with.
+func check(t *testing.T, gate *Gate, domain *auth.Domain, req *http.Request) *http.Response {
+	t.Helper()
+	allowed, raw := gate.Check(domain, req, false)
+	if allowed {
+		t.Fatalf("%s was let through", req.URL)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(raw)), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func cookie(resp *http.Response, name string) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// login starts a login to /private and follows it through the provider,
+// returning the callback request and the nonce cookie set for it.
+func login(t *testing.T, gate *Gate, domain *auth.Domain) (*http.Request, *http.Cookie) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/private", nil)
+	resp := check(t, gate, domain, req)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login status = %d, want 302", resp.StatusCode)
+	}
+	nonce := cookie(resp, NonceCookie)
+	if nonce == nil || nonce.Value == "" || !nonce.HttpOnly || nonce.Path != CallbackPath || nonce.MaxAge <= 0 {
+		t.Fatalf("nonce cookie = %v", nonce)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	authorized, err := client.Get(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized.Body.Close()
+	callback, err := url.Parse(authorized.Header.Get("Location"))
+	if err != nil || callback.Path != CallbackPath {
+		t.Fatalf("provider redirected to %q", authorized.Header.Get("Location"))
+	}
+
+	callbackReq, _ := http.NewRequest(http.MethodGet, callback.String(), nil)
+	return callbackReq, nonce
+}
+
+func TestOIDCLogin(t *testing.T) {
+	gate, domain := newTestDomain(t)
+	callback, nonce := login(t, gate, domain)
+	callback.AddCookie(&http.Cookie{Name: nonce.Name, Value: nonce.Value})
+
+	resp := check(t, gate, domain, callback)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/private" {
+		t.Fatalf("callback = %d to %q, want 302 to /private", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if cleared := cookie(resp, NonceCookie); cleared == nil || cleared.MaxAge >= 0 {
+		t.Fatalf("nonce cookie not cleared: %v", cleared)
+	}
+	session := cookie(resp, SessionCookie)
+	if session == nil {
+		t.Fatal("no session cookie")
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/private", nil)
+	req.AddCookie(&http.Cookie{Name: session.Name, Value: session.Value})
+	if allowed, _ := gate.Check(domain, req, false); !allowed {
+		t.Fatal("the session was not accepted")
+	}
+}
+
+// A state and code from a login started elsewhere, say the attacker's own,
+// must not log the visitor in.
+func TestOIDCCallbackFromAnotherBrowser(t *testing.T) {
+	gate, domain := newTestDomain(t)
+	callback, _ := login(t, gate, domain)
+	_, otherNonce := login(t, gate, domain)
+
+	for name, nonce := range map[string]*http.Cookie{
+		"without nonce":    nil,
+		"with other nonce": {Name: NonceCookie, Value: otherNonce.Value},
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := callback.Clone(callback.Context())
+			if nonce != nil {
+				req.AddCookie(nonce)
+			}
+			resp := check(t, gate, domain, req)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("callback status = %d, want 400", resp.StatusCode)
+			}
+			if cookie(resp, SessionCookie) != nil {
+				t.Fatal("a session was issued")
+			}
+		})
+	}
+}
+
+func TestStripSession(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.Header.Set("Cookie", SessionCookie+"=s; theme=dark; "+NonceCookie+"=n")
+	if !StripSession(req) {
+		t.Fatal("StripSession reported nothing removed")
+	}
+	if got := req.Header.Get("Cookie"); strings.TrimSpace(got) != "theme=dark" {
+		t.Fatalf("Cookie = %q, want only theme=dark", got)
+	}
+}
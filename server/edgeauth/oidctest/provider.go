@@ -0,0 +1,159 @@
+// Package oidctest provides an in-process OpenID Connect provider so that
+// the edge authentication flow can be exercised without a real identity
+// provider. Every authorization request logs in the current user without
+// showing any page.
+package oidctest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+type Provider struct {
+	*httptest.Server
+	ClientID     string
+	ClientSecret string
+
+	mu       sync.Mutex
+	email    string
+	verified bool
+	codes    map[string]string
+	tokens   map[string]string
+}
+
+func NewProvider(clientID, clientSecret string) *Provider {
+	p := &Provider{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		email:        "user@example.com",
+		verified:     true,
+		codes:        make(map[string]string),
+		tokens:       make(map[string]string),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/authorize", p.authorize)
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/userinfo", p.userinfo)
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// SetUser changes the account logged in by the next authorization request.
+func (p *Provider) SetUser(email string, verified bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.email = email
+	p.verified = verified
+}
+
+// Settings returns domain settings pointing at this provider.
+func (p *Provider) Settings(allowedEmailDomains ...string) *auth.OIDCSettings {
+	return &auth.OIDCSettings{
+		Issuer:              p.URL,
+		ClientID:            p.ClientID,
+		ClientSecret:        p.ClientSecret,
+		AllowedEmailDomains: allowedEmailDomains,
+	}
+}
+
+func (p *Provider) discovery(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 p.URL,
+		"authorization_endpoint": p.URL + "/authorize",
+		"token_endpoint":         p.URL + "/token",
+		"userinfo_endpoint":      p.URL + "/userinfo",
+	})
+}
+
+func (p *Provider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	redirectURI, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil || query.Get("client_id") != p.ClientID || query.Get("response_type") != "code" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	p.mu.Lock()
+	code := randomToken()
+	p.codes[code] = p.email
+	p.mu.Unlock()
+
+	values := redirectURI.Query()
+	values.Set("code", code)
+	values.Set("state", query.Get("state"))
+	redirectURI.RawQuery = values.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *Provider) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	clientID, _ = url.QueryUnescape(clientID)
+	clientSecret, _ = url.QueryUnescape(clientSecret)
+	if clientID != p.ClientID || clientSecret != p.ClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	p.mu.Lock()
+	email, exists := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code"))
+	token := randomToken()
+	if exists {
+		p.tokens[token] = email
+	}
+	p.mu.Unlock()
+
+	if !exists {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+	})
+}
+
+func (p *Provider) userinfo(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	p.mu.Lock()
+	email, exists := p.tokens[token]
+	verified := p.verified
+	p.mu.Unlock()
+
+	if !exists {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sub":            email,
+		"email":          email,
+		"email_verified": verified,
+	})
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
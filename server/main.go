@@ -1,11 +1,13 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"syscall"
 
 	"net/http"
 	_ "net/http/pprof"
@@ -28,18 +30,27 @@ func main() {
 
 	var conf, err = config.GetConfig()
 	if err != nil {
-		fmt.Println("Error al cargar la configuración", err)
-		return
+		fmt.Fprintln(os.Stderr, "Error al cargar la configuración:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if args := flag.Args(); len(args) > 0 {
+		if args[0] != "migrate" {
+			fmt.Fprintln(os.Stderr, migrateUsage)
+			os.Exit(2)
+		}
+		os.Exit(runMigrate(conf, args[1:]))
 	}
 
 	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
 
 	db.Migrate(conf.Database)
 
 	tlsConfig := conf.TLS.GetTLSConfig()
 
-	proxy := helper.NewListenerManagerTCP(conf.Proxy.Address, tlsConfig)
+	proxy := helper.NewListenerManagerTCP(conf.Proxy.Address, tlsConfig, conf.Proxy.ProxyProtocol)
 	manager := manager.SetupManager(tlsConfig)
 	admin := admin.SetupAdmin(conf.Admin.Address)
 
@@ -57,4 +68,6 @@ func main() {
 	go proxy.ListenAndServe()
 	<-interrupt
 	fmt.Println("Desconectando...")
+	manager.Shutdown()
+	db.CloseConnection()
 }
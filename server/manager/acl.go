@@ -0,0 +1,50 @@
+package manager
+
+import (
+	"net"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// visitorAllowed applies the domain's deny list and, when present, its allow
+// list to the visitor address. With PROXY protocol enabled on the proxy
+// listener, RemoteAddr already holds the address announced by the balancer.
+func visitorAllowed(domain *auth.Domain, addr net.Addr) bool {
+	if domain == nil || (len(domain.AllowCIDRs) == 0 && len(domain.DenyCIDRs) == 0) {
+		return true
+	}
+
+	ip, ok := helper.AddrIP(addr)
+	if !ok {
+		logger.Default.Error("Unable to get visitor IP for domain:", domain.Name, "Address:", addr)
+		return false
+	}
+
+	for _, cidr := range domain.DenyCIDRs {
+		prefix, err := helper.ParsePrefix(cidr)
+		if err != nil {
+			logger.Default.Error("Invalid deny CIDR for domain:", domain.Name, "CIDR:", cidr)
+			continue
+		}
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+
+	if len(domain.AllowCIDRs) == 0 {
+		return true
+	}
+	for _, cidr := range domain.AllowCIDRs {
+		prefix, err := helper.ParsePrefix(cidr)
+		if err != nil {
+			logger.Default.Error("Invalid allow CIDR for domain:", domain.Name, "CIDR:", cidr)
+			continue
+		}
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package manager
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/edgeauth"
+)
+
+var errStoreDown = errors.New("connection refused")
+
+// stubStore answers GetDomain and GetDomains from domains, or with err when
+// it is set. The other methods are not used by the visitor path.
+type stubStore struct {
+	auth.AuthManager
+	domains map[string]*auth.Domain
+	err     error
+}
+
+func (s *stubStore) GetDomain(name string) (*auth.Domain, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	if domain, ok := s.domains[name]; ok {
+		return domain, nil
+	}
+	return nil, auth.ErrNotFound
+}
+
+func (s *stubStore) GetDomains() ([]*auth.Domain, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+	domains := make([]*auth.Domain, 0, len(s.domains))
+	for _, domain := range s.domains {
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+func newTestManager(store auth.AuthManager, hubNames ...string) *Manager {
+	m := &Manager{authManager: store, hostnames: newHostRouter()}
+	for _, name := range hubNames {
+		m.AddHub(name, NewNetworkHub(name, nil, 0))
+	}
+	return m
+}
+
+func TestLookupDomain(t *testing.T) {
+	domain := &auth.Domain{Name: "example.com"}
+	m := newTestManager(&stubStore{domains: map[string]*auth.Domain{"example.com": domain}})
+
+	if settings, err := m.lookupDomain("example.com"); err != nil || settings != domain {
+		t.Fatalf("lookupDomain(example.com) = %v, %v", settings, err)
+	}
+	if settings, err := m.lookupDomain("unknown.com"); err != nil || settings != nil {
+		t.Fatalf("lookupDomain of an unknown domain = %v, %v, want no settings", settings, err)
+	}
+
+	m.authManager = &stubStore{err: errStoreDown}
+	if _, err := m.lookupDomain("example.com"); !errors.Is(err, errStoreDown) {
+		t.Fatalf("lookupDomain with the store down returned %v", err)
+	}
+}
+
+// A domain whose settings cannot be read must not be served without its
+// access lists.
+func TestHTTPVisitorRejectedWhenStoreFails(t *testing.T) {
+	m := newTestManager(&stubStore{err: errStoreDown}, "example.com")
+	hub, _ := m.GetHub("example.com")
+
+	if status := visitHTTP(t, m, "example.com"); status != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", status)
+	}
+	if hub.rejectedConnections.Load() != 1 {
+		t.Fatalf("rejected connections = %d, want 1", hub.rejectedConnections.Load())
+	}
+}
+
+func TestTCPVisitorRejectedWhenStoreFails(t *testing.T) {
+	m := newTestManager(&stubStore{err: errStoreDown}, "example.com")
+
+	visitor, server := net.Pipe()
+	defer visitor.Close()
+	go m.handleTCPVisitor(server, "example.com")
+
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := visitor.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read %d bytes, %v; want the connection closed", n, err)
+	}
+}
+
+// Basic auth and OIDC must not be skipped either when the settings that
+// enable them cannot be read.
+func TestEdgeAuthNotSkippedWhenStoreFails(t *testing.T) {
+	store := &stubStore{domains: map[string]*auth.Domain{
+		"example.com": {Name: "example.com", BasicAuth: []auth.BasicCredential{{Username: "user", PasswordHash: "x"}}},
+	}}
+	m := newTestManager(store, "example.com")
+	m.edgeAuth = edgeauth.NewGate([]byte("secret"), time.Hour, false)
+
+	if status := visitHTTP(t, m, "example.com"); status != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401 from the gate", status)
+	}
+	store.err = errStoreDown
+	if status := visitHTTP(t, m, "example.com"); status != http.StatusServiceUnavailable {
+		t.Fatalf("status with the store down = %d, want 503", status)
+	}
+}
+
+func visitHTTP(t *testing.T, m *Manager, host string) int {
+	t.Helper()
+	visitor, server := net.Pipe()
+	defer visitor.Close()
+	req, _ := http.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+	go m.HandleHTTPConn(server, req)
+
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(visitor), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode
+}
+
+// The gate checks the first request of a connection only, so the agent must
+// not keep it open for more.
+func TestEdgeAuthChecksEveryRequest(t *testing.T) {
+	hash, err := edgeauth.HashPassword("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &stubStore{domains: map[string]*auth.Domain{
+		"example.com": {Name: "example.com", BasicAuth: []auth.BasicCredential{{Username: "user", PasswordHash: hash}}},
+	}}
+	m := newTestManager(store)
+	m.edgeAuth = edgeauth.NewGate([]byte("secret"), time.Hour, false)
+	hub := startHub(t, m, "example.com")
+
+	var mu sync.Mutex
+	var seen []*http.Request
+	connectAgent(t, m, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r)
+		mu.Unlock()
+		io.WriteString(w, "ok")
+	}))
+
+	visitor := openHTTP(t, m, "GET /first HTTP/1.1\r\nHost: example.com\r\n"+
+		"Authorization: Basic "+base64.StdEncoding.EncodeToString([]byte("user:password"))+"\r\n"+
+		"Cookie: "+edgeauth.SessionCookie+"=forged; theme=dark\r\n\r\n")
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+	reader := bufio.NewReader(visitor)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first request answered %d, want 200", resp.StatusCode)
+	}
+
+	// Without credentials, the second request must not reach the agent.
+	visitor.Write([]byte("GET /second HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if resp, err := http.ReadResponse(reader, nil); err == nil {
+		t.Fatalf("second request on the connection answered %d", resp.StatusCode)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(seen) != 1 {
+		t.Fatalf("agent served %d requests, want 1", len(seen))
+	}
+	if cookie := seen[0].Header.Get("Cookie"); cookie != "theme=dark" {
+		t.Fatalf("agent received cookies %q, want theme=dark", cookie)
+	}
+	if authorization := seen[0].Header.Get("Authorization"); authorization != "" {
+		t.Fatalf("agent received the edge credentials %q", authorization)
+	}
+}
@@ -0,0 +1,117 @@
+package manager
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/server/backplane"
+	"github.com/OnnaSoft/lipstick/server/traffic"
+)
+
+// startHub runs a hub for name in m. Its backplane subscription is taken
+// in advance, so that agents can register without a configured backplane.
+func startHub(t *testing.T, m *Manager, name string) *NetworkHub {
+	t.Helper()
+	trafficManager := traffic.NewTrafficManagerWithSinks(1 << 20)
+	hub := NewNetworkHub(name, trafficManager, 1<<20)
+	sub, err := backplane.NewMemory().Subscribe(name, func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub.subscription = sub
+	m.AddHub(name, hub)
+	go hub.listen()
+	t.Cleanup(func() {
+		hub.Shutdown()
+		trafficManager.Close()
+	})
+	return hub
+}
+
+// connectAgent registers an agent on hub that claims every ticket and
+// serves the visitor behind it with handler, as a proxied HTTP service
+// would.
+func connectAgent(t *testing.T, m *Manager, hub *NetworkHub, handler http.Handler) {
+	t.Helper()
+	agent, server := net.Pipe()
+	t.Cleanup(func() { agent.Close() })
+	conn := &ProxyNotificationConn{
+		ID:                       newAgentID(),
+		Domain:                   hub.HubName,
+		AllowMultipleConnections: true,
+		bandwidth:                newBandwidth(0, 0),
+		ReadWriter:               bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+		conn:                     server,
+	}
+	if !hub.register(conn) {
+		t.Fatal("hub is shut down")
+	}
+
+	go func() {
+		reader := bufio.NewReader(agent)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Split(strings.TrimSpace(line), ":")
+			if len(fields) < 2 {
+				continue
+			}
+			tunnel, service := net.Pipe()
+			req, _ := http.NewRequest(http.MethodGet, "http://"+hub.HubName+"/"+fields[1], nil)
+			m.handleTunnel(tunnel, req, fields[1])
+			go (&http.Server{Handler: handler}).Serve(newSingleConnListener(service))
+		}
+	}()
+}
+
+// singleConnListener hands out one connection, then blocks until closed.
+type singleConnListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{conns: make(chan net.Conn, 1), closed: make(chan struct{})}
+	l.conns <- conn
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// openHTTP hands m a visitor connection whose first request is head, the
+// way CustomListener does, and returns the visitor's end.
+func openHTTP(t *testing.T, m *Manager, head string) net.Conn {
+	t.Helper()
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	visitor, server := net.Pipe()
+	t.Cleanup(func() { visitor.Close() })
+	go m.HandleHTTPConn(helper.NewConnWithBuffer(server, []byte(head)), req)
+	return visitor
+}
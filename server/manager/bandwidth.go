@@ -0,0 +1,67 @@
+package manager
+
+import (
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// bandwidth shapes the bytes sent to agents (upload) and to visitors
+// (download). Its buckets are shared by every connection it applies to, so
+// a new limit takes effect on connections already in progress.
+type bandwidth struct {
+	upload   *helper.TokenBucket
+	download *helper.TokenBucket
+}
+
+func newBandwidth(upload, download int64) *bandwidth {
+	return &bandwidth{
+		upload:   helper.NewTokenBucket(float64(upload), 0),
+		download: helper.NewTokenBucket(float64(download), 0),
+	}
+}
+
+// set changes the limits, in bytes per second. Zero removes a limit.
+func (b *bandwidth) set(upload, download int64) {
+	b.upload.SetLimit(float64(upload), 0)
+	b.download.SetLimit(float64(download), 0)
+}
+
+func waitUpload(limits []*bandwidth, n int) {
+	for _, limit := range limits {
+		limit.upload.WaitN(n)
+	}
+}
+
+func waitDownload(limits []*bandwidth, n int) {
+	for _, limit := range limits {
+		limit.download.WaitN(n)
+	}
+}
+
+// applyBandwidth brings the hub and its agents in line with the domain
+// settings. It runs on the hub goroutine.
+func (hub *NetworkHub) applyBandwidth(settings *auth.Domain) {
+	if settings == nil {
+		settings = &auth.Domain{}
+	}
+
+	hub.bandwidth.set(settings.UploadRate, settings.DownloadRate)
+	for conn := range hub.ProxyNotificationConns {
+		conn.bandwidth.set(settings.AgentUploadRate, settings.AgentDownloadRate)
+	}
+}
+
+// refreshSettings reloads the domain settings so that limits changed through
+// the admin API reach long-lived connections.
+func (hub *NetworkHub) refreshSettings() {
+	if hub.lookupSettings == nil {
+		return
+	}
+	settings, err := hub.lookupSettings()
+	if err != nil {
+		logger.Default.Error("Unable to refresh domain settings for hub:", hub.HubName, "Error:", err)
+		return
+	}
+	hub.applyBandwidth(settings)
+}
@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+func TestApplyBandwidth(t *testing.T) {
+	type limited struct{ upload, download, agentUpload, agentDownload bool }
+	tests := []struct {
+		name     string
+		settings *auth.Domain
+		want     limited
+	}{
+		{"no settings", nil, limited{}},
+		{"unlimited", &auth.Domain{}, limited{}},
+		{"domain upload", &auth.Domain{UploadRate: 1000}, limited{upload: true}},
+		{"domain download", &auth.Domain{DownloadRate: 1000}, limited{download: true}},
+		{"agents", &auth.Domain{AgentUploadRate: 10, AgentDownloadRate: 20}, limited{agentUpload: true, agentDownload: true}},
+	}
+
+	hub := NewNetworkHub("example.com", nil, 0)
+	agent := &ProxyNotificationConn{bandwidth: newBandwidth(0, 0)}
+	hub.ProxyNotificationConns[agent] = true
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Each case starts from the limits of the one before, so that
+			// limits removed by the settings are checked too.
+			hub.applyBandwidth(test.settings)
+			got := limited{
+				upload:        !hub.bandwidth.upload.Unlimited(),
+				download:      !hub.bandwidth.download.Unlimited(),
+				agentUpload:   !agent.bandwidth.upload.Unlimited(),
+				agentDownload: !agent.bandwidth.download.Unlimited(),
+			}
+			if got != test.want {
+				t.Errorf("limited = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWaitUploadAppliesEveryLimit(t *testing.T) {
+	limits := []*bandwidth{newBandwidth(0, 0), newBandwidth(1000, 0)}
+	waitUpload(limits, 1000)
+
+	start := time.Now()
+	waitUpload(limits, 100)
+	if elapsed := time.Since(start); elapsed < 80*time.Millisecond {
+		t.Errorf("waitUpload returned after %v, want about 100ms", elapsed)
+	}
+
+	start = time.Now()
+	waitDownload(limits, 1<<20)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("waitDownload without a download limit took %v", elapsed)
+	}
+}
@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/server/db"
+)
+
+// Reasons recorded in the connection log.
+const (
+	closeVisitorClosed = "visitor_closed"
+	closeVisitorError  = "visitor_error"
+	closeAgentClosed   = "agent_closed"
+	closeAgentError    = "agent_error"
+	closeAgentGone     = "agent_disconnected"
+	closeNoAgent       = "no_agent"
+	closeTicketExpired = "ticket_expired"
+	closeShutdown      = "shutdown"
+)
+
+// newAgentID identifies an agent control connection in logs.
+func newAgentID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+func visitorProtocol(v *visitor) string {
+	switch {
+	case v.http:
+		return "HTTP"
+	case helper.IsTLSConn(v.Conn):
+		return "TLS"
+	default:
+		return "TCP"
+	}
+}
+
+// logConnection records a finished visitor connection when the connection
+// log is enabled. The agent is only known when the ticket was delivered by
+// this server.
+func (hub *NetworkHub) logConnection(v *visitor, ingress, egress int64, reason string) {
+	if hub.connectionLog == nil {
+		return
+	}
+
+	entry := db.ConnectionLog{
+		Domain:      hub.HubName,
+		VisitorAddr: v.RemoteAddr().String(),
+		Protocol:    visitorProtocol(v),
+		StartedAt:   v.createdAt.UTC(),
+		EndedAt:     time.Now().UTC(),
+		BytesIn:     ingress,
+		BytesOut:    egress,
+		CloseReason: reason,
+	}
+	if v.agent != nil {
+		entry.AgentID = v.agent.ID
+	}
+	hub.connectionLog.Record(entry)
+}
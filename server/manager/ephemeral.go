@@ -0,0 +1,121 @@
+package manager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/config"
+)
+
+const ephemeralHeader = "X-Lipstick-Ephemeral"
+const publicURLHeader = "X-Lipstick-Public-URL"
+
+var ErrEphemeralDisabled = errors.New("ephemeral tunnels are disabled")
+
+type ephemeralTunnel struct {
+	name    string
+	account string
+	timer   *time.Timer
+}
+
+// ephemeralTunnels keeps the tunnels whose subdomain was assigned by the
+// server. They only live in memory: a tunnel is removed as soon as its last
+// agent disconnects or its TTL elapses, whichever happens first.
+type ephemeralTunnels struct {
+	mu         sync.Mutex
+	manager    *Manager
+	baseDomain string
+	scheme     string
+	ttl        time.Duration
+	tunnels    map[string]*ephemeralTunnel
+}
+
+func newEphemeralTunnels(manager *Manager, conf config.EphemeralConfig) *ephemeralTunnels {
+	return &ephemeralTunnels{
+		manager:    manager,
+		baseDomain: conf.BaseDomain,
+		scheme:     conf.Scheme,
+		ttl:        time.Duration(conf.TTL) * time.Second,
+		tunnels:    make(map[string]*ephemeralTunnel),
+	}
+}
+
+func (e *ephemeralTunnels) create(account *auth.Account) (*auth.Domain, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var name string
+	for {
+		label, err := randomLabel()
+		if err != nil {
+			return nil, err
+		}
+		name = label + "." + e.baseDomain
+		if _, exists := e.tunnels[name]; exists {
+			continue
+		}
+		if _, exists := e.manager.GetHub(name); exists {
+			continue
+		}
+		break
+	}
+
+	tunnel := &ephemeralTunnel{name: name, account: account.Name}
+	if e.ttl > 0 {
+		tunnel.timer = time.AfterFunc(e.ttl, func() {
+			logger.Default.Info("Ephemeral tunnel expired:", name)
+			e.remove(name)
+		})
+	}
+	e.tunnels[name] = tunnel
+	logger.Default.Info("Ephemeral tunnel ", name, " assigned to account ", account.Name)
+
+	return &auth.Domain{Name: name}, nil
+}
+
+func (e *ephemeralTunnels) has(name string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, exists := e.tunnels[name]
+	return exists
+}
+
+func (e *ephemeralTunnels) remove(name string) {
+	e.mu.Lock()
+	tunnel, exists := e.tunnels[name]
+	if exists {
+		delete(e.tunnels, name)
+	}
+	e.mu.Unlock()
+
+	if !exists {
+		return
+	}
+	if tunnel.timer != nil {
+		tunnel.timer.Stop()
+	}
+
+	if hub, ok := e.manager.GetHub(name); ok {
+		e.manager.RemoveHub(name)
+		hub.Shutdown()
+	}
+	logger.Default.Info("Ephemeral tunnel removed:", name)
+}
+
+func (e *ephemeralTunnels) publicURL(name string) string {
+	return e.scheme + "://" + name
+}
+
+func randomLabel() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
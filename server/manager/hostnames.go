@@ -0,0 +1,128 @@
+package manager
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// hostRouter maps visitor hostnames to hub names. Exact aliases win over
+// wildcard patterns, and among wildcards the one with the longest suffix wins,
+// so "*.preview.example.com" takes precedence over "*.example.com".
+type hostRouter struct {
+	mu        sync.RWMutex
+	aliases   map[string]string
+	wildcards map[string]string
+	byHub     map[string][]string
+}
+
+func newHostRouter() *hostRouter {
+	return &hostRouter{
+		aliases:   make(map[string]string),
+		wildcards: make(map[string]string),
+		byHub:     make(map[string][]string),
+	}
+}
+
+// register replaces the hostnames a hub answers for.
+func (r *hostRouter) register(hubName string, aliases, wildcards []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unregisterLocked(hubName)
+
+	keys := make([]string, 0, len(aliases)+len(wildcards))
+	for _, alias := range aliases {
+		alias = normalizeHostname(alias)
+		if owner, exists := r.aliases[alias]; exists && owner != hubName {
+			logger.Default.Warning("Alias ", alias, " moved from hub ", owner, " to hub ", hubName)
+		}
+		r.aliases[alias] = hubName
+		keys = append(keys, alias)
+	}
+	for _, pattern := range wildcards {
+		suffix := strings.TrimPrefix(normalizeHostname(pattern), "*")
+		if !strings.HasPrefix(suffix, ".") {
+			logger.Default.Warning("Ignoring invalid wildcard pattern for hub ", hubName, ": ", pattern)
+			continue
+		}
+		if owner, exists := r.wildcards[suffix]; exists && owner != hubName {
+			logger.Default.Warning("Wildcard *", suffix, " moved from hub ", owner, " to hub ", hubName)
+		}
+		r.wildcards[suffix] = hubName
+		keys = append(keys, "*"+suffix)
+	}
+	r.byHub[hubName] = keys
+}
+
+func (r *hostRouter) unregister(hubName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unregisterLocked(hubName)
+}
+
+func (r *hostRouter) unregisterLocked(hubName string) {
+	for _, key := range r.byHub[hubName] {
+		if suffix, ok := strings.CutPrefix(key, "*"); ok {
+			if r.wildcards[suffix] == hubName {
+				delete(r.wildcards, suffix)
+			}
+			continue
+		}
+		if r.aliases[key] == hubName {
+			delete(r.aliases, key)
+		}
+	}
+	delete(r.byHub, hubName)
+}
+
+func (r *hostRouter) resolve(hostname string) (string, bool) {
+	hostname = normalizeHostname(hostname)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if hubName, ok := r.aliases[hostname]; ok {
+		return hubName, true
+	}
+
+	var match, best string
+	for suffix, hubName := range r.wildcards {
+		if len(hostname) > len(suffix) && strings.HasSuffix(hostname, suffix) && len(suffix) > len(best) {
+			best = suffix
+			match = hubName
+		}
+	}
+	return match, match != ""
+}
+
+// matchDomain finds among domains the one answering for hostname, with the
+// precedence of hostRouter.resolve, for hostnames no local hub registered.
+func matchDomain(domains []*auth.Domain, hostname string) (string, bool) {
+	hostname = normalizeHostname(hostname)
+
+	var match, best string
+	for _, domain := range domains {
+		for _, alias := range domain.Aliases {
+			if normalizeHostname(alias) == hostname {
+				return domain.Name, true
+			}
+		}
+		for _, pattern := range domain.Wildcards {
+			suffix := strings.TrimPrefix(normalizeHostname(pattern), "*")
+			if strings.HasPrefix(suffix, ".") && len(hostname) > len(suffix) &&
+				strings.HasSuffix(hostname, suffix) && len(suffix) > len(best) {
+				best = suffix
+				match = domain.Name
+			}
+		}
+	}
+	return match, match != ""
+}
+
+func normalizeHostname(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(hostname)), ".")
+}
@@ -0,0 +1,70 @@
+package manager
+
+import (
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+var hostnameTests = []struct {
+	hostname string
+	hub      string
+}{
+	{"example.com", ""},
+	{"www.example.com", "site"},
+	{"WWW.Example.COM.", "site"},
+	{"api.example.com", "wild"},
+	{"a.b.example.com", "wild"},
+	{"pr-1.preview.example.com", "preview"},
+	{"x.pr-1.preview.example.com", "preview"},
+	{"preview.example.com", "wild"},
+	{"static.preview.example.com", "static"},
+	{"example.org", ""},
+	{"notexample.com", ""},
+}
+
+func TestHostRouterResolve(t *testing.T) {
+	r := newHostRouter()
+	r.register("site", []string{"www.example.com", " static.preview.example.com "}, nil)
+	r.register("wild", nil, []string{"*.example.com", "example.net"})
+	r.register("preview", nil, []string{"*.Preview.Example.com."})
+	r.register("static", []string{"static.preview.example.com"}, nil)
+
+	for _, test := range hostnameTests {
+		hub, ok := r.resolve(test.hostname)
+		if hub != test.hub || ok != (test.hub != "") {
+			t.Errorf("resolve(%q) = %q, %v, want %q", test.hostname, hub, ok, test.hub)
+		}
+	}
+	if hub, ok := r.resolve("example.net"); ok {
+		t.Errorf("invalid pattern resolved to %q", hub)
+	}
+
+	r.unregister("preview")
+	if hub, _ := r.resolve("pr-1.preview.example.com"); hub != "wild" {
+		t.Errorf("resolve after unregistering = %q, want wild", hub)
+	}
+	r.register("site", nil, nil)
+	if hub, ok := r.resolve("www.example.com"); hub != "wild" || !ok {
+		t.Errorf("resolve of a dropped alias = %q, %v, want wild", hub, ok)
+	}
+}
+
+func TestMatchDomain(t *testing.T) {
+	domains := []*auth.Domain{
+		{Name: "wild", Wildcards: []string{"*.example.com", "example.net"}},
+		{Name: "site", Aliases: []string{"www.example.com"}},
+		{Name: "preview", Wildcards: []string{"*.Preview.Example.com."}},
+		{Name: "static", Aliases: []string{"static.preview.example.com"}},
+	}
+
+	for _, test := range hostnameTests {
+		hub, ok := matchDomain(domains, test.hostname)
+		if hub != test.hub || ok != (test.hub != "") {
+			t.Errorf("matchDomain(%q) = %q, %v, want %q", test.hostname, hub, ok, test.hub)
+		}
+	}
+	if hub, ok := matchDomain(domains, "example.net"); ok {
+		t.Errorf("invalid pattern matched %q", hub)
+	}
+}
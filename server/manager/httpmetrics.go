@@ -0,0 +1,157 @@
+package manager
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// observerBuffer is how many chunks each direction may queue before the
+// observer falls behind and gives up.
+const observerBuffer = 256
+
+type observedRequest struct {
+	req *http.Request
+	at  time.Time
+}
+
+// httpObserver follows the requests and responses of an HTTP tunnel without
+// altering or delaying them: it works on copies of the chunks relayed by
+// syncConnections. It stops on the first parse error, on protocol upgrades
+// and when it cannot keep up.
+type httpObserver struct {
+	requests  chan []byte
+	responses chan []byte
+	pending   chan observedRequest
+	done      chan struct{}
+	closeOnce sync.Once
+	stopped   atomic.Bool
+	report    func(method string, status int, latency time.Duration)
+}
+
+func newHTTPObserver(report func(method string, status int, latency time.Duration)) *httpObserver {
+	o := &httpObserver{
+		requests:  make(chan []byte, observerBuffer),
+		responses: make(chan []byte, observerBuffer),
+		pending:   make(chan observedRequest, observerBuffer),
+		done:      make(chan struct{}),
+		report:    report,
+	}
+	go o.readRequests()
+	go o.readResponses()
+	return o
+}
+
+// request feeds bytes relayed to the agent.
+func (o *httpObserver) request(b []byte) {
+	o.feed(o.requests, b)
+}
+
+// response feeds bytes relayed to the visitor.
+func (o *httpObserver) response(b []byte) {
+	o.feed(o.responses, b)
+}
+
+func (o *httpObserver) feed(chunks chan []byte, b []byte) {
+	if o == nil || o.stopped.Load() {
+		return
+	}
+	select {
+	case chunks <- append([]byte(nil), b...):
+	default:
+		o.stopped.Store(true)
+	}
+}
+
+// close releases the parsers. It must be called once no more bytes are fed.
+func (o *httpObserver) close() {
+	if o == nil {
+		return
+	}
+	o.closeOnce.Do(func() {
+		o.stopped.Store(true)
+		close(o.requests)
+		close(o.responses)
+		close(o.done)
+	})
+}
+
+func (o *httpObserver) readRequests() {
+	br := bufio.NewReader(&chunkReader{chunks: o.requests})
+	for !o.stopped.Load() {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			o.stopped.Store(true)
+			break
+		}
+		select {
+		case o.pending <- observedRequest{req: req, at: time.Now()}:
+		default:
+			o.stopped.Store(true)
+		}
+		if _, err := io.Copy(io.Discard, req.Body); err != nil {
+			o.stopped.Store(true)
+		}
+	}
+	drain(o.requests)
+}
+
+func (o *httpObserver) readResponses() {
+	br := bufio.NewReader(&chunkReader{chunks: o.responses})
+	for !o.stopped.Load() {
+		var observed observedRequest
+		select {
+		case observed = <-o.pending:
+		case <-o.done:
+			return
+		}
+
+		resp, err := http.ReadResponse(br, observed.req)
+		for err == nil && resp.StatusCode >= 100 && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+			resp, err = http.ReadResponse(br, observed.req)
+		}
+		if err != nil {
+			o.stopped.Store(true)
+			break
+		}
+
+		o.report(observed.req.Method, resp.StatusCode, time.Since(observed.at))
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			o.stopped.Store(true)
+			break
+		}
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			o.stopped.Store(true)
+		}
+	}
+	drain(o.responses)
+}
+
+// drain consumes chunks until the channel is closed, so that feeders never
+// find it full after a parser stopped.
+func drain(chunks chan []byte) {
+	for range chunks {
+	}
+}
+
+// chunkReader reads the chunks sent over a channel as one stream.
+type chunkReader struct {
+	chunks  <-chan []byte
+	current []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.current) == 0 {
+		chunk, ok := <-r.chunks
+		if !ok {
+			return 0, io.EOF
+		}
+		r.current = chunk
+	}
+	n := copy(p, r.current)
+	r.current = r.current[n:]
+	return n, nil
+}
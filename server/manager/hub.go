@@ -3,45 +3,74 @@ package manager
 import (
 	"fmt"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/OnnaSoft/lipstick/helper"
 	"github.com/OnnaSoft/lipstick/logger"
-	"github.com/OnnaSoft/lipstick/server/subscriptions"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/backplane"
+	"github.com/OnnaSoft/lipstick/server/cluster"
+	"github.com/OnnaSoft/lipstick/server/db"
 	"github.com/OnnaSoft/lipstick/server/traffic"
-	"github.com/nats-io/nats.go"
 )
 
 var rng = helper.NewXORShift(uint32(time.Now().UnixNano()))
 
 type NetworkHub struct {
 	HubName                         string
-	incomingClientConns             map[string]net.Conn
+	incomingClientConns             map[string]*visitor
 	ProxyNotificationConns          map[*ProxyNotificationConn]bool
 	registerProxyNotificationConn   chan *ProxyNotificationConn
 	unregisterProxyNotificationConn chan *ProxyNotificationConn
-	incomingClientConn              chan *helper.RemoteConn
+	incomingClientConn              chan *visitor
 	serverRequests                  chan *request
+	revalidations                   chan *auth.Domain
 	trafficManager                  *traffic.TrafficManager
+	connectionLog                   *traffic.ConnectionLog
 	dataUsageAccumulator            int64
+	ingressAccumulator              int64
+	egressAccumulator               int64
 	threshold                       int64
 	mu                              sync.Mutex
 	totalDataTransferred            int64
+	rejectedConnections             atomic.Int64
+	activeVisitors                  atomic.Int64
+	agentCount                      atomic.Int64
+	pendingCount                    atomic.Int64
+	ingressTotal                    atomic.Int64
+	egressTotal                     atomic.Int64
+	connectionBucket                *helper.TokenBucket
+	ipBuckets                       map[netip.Addr]*helper.TokenBucket
+	bandwidth                       *bandwidth
+	quotaBandwidth                  *bandwidth
+	quotaExceeded                   atomic.Bool
+	quotaWarned                     int
+	quotaWarnedMonth                string
+	lookupSettings                  func() (*auth.Domain, error)
+	registry                        *cluster.Registry
 	tickerManager                   *TickerManager
 	shutdownSignal                  chan struct{}
-	subscription                    *nats.Subscription
+	shutdownOnce                    sync.Once
+	subscription                    backplane.Subscription
+	onIdle                          func(hub *NetworkHub)
 }
 
 func NewNetworkHub(name string, trafficManager *traffic.TrafficManager, threshold int64) *NetworkHub {
 	return &NetworkHub{
 		HubName:                         name,
-		incomingClientConns:             make(map[string]net.Conn),
+		incomingClientConns:             make(map[string]*visitor),
+		ipBuckets:                       make(map[netip.Addr]*helper.TokenBucket),
+		bandwidth:                       newBandwidth(0, 0),
+		quotaBandwidth:                  newBandwidth(0, 0),
 		ProxyNotificationConns:          make(map[*ProxyNotificationConn]bool),
 		registerProxyNotificationConn:   make(chan *ProxyNotificationConn),
 		unregisterProxyNotificationConn: make(chan *ProxyNotificationConn),
-		incomingClientConn:              make(chan *helper.RemoteConn),
+		incomingClientConn:              make(chan *visitor),
 		serverRequests:                  make(chan *request),
+		revalidations:                   make(chan *auth.Domain),
 		trafficManager:                  trafficManager,
 		dataUsageAccumulator:            0,
 		threshold:                       threshold,
@@ -50,26 +79,39 @@ func NewNetworkHub(name string, trafficManager *traffic.TrafficManager, threshol
 	}
 }
 
-func (hub *NetworkHub) syncConnections(pipe net.Conn, destination net.Conn) {
-	defer pipe.Close()
-	defer destination.Close()
-
+// syncConnections copies between a visitor (pipe) and an agent (destination)
+// within the given bandwidth limits, showing the traffic to observer when it
+// is not nil. It returns the bytes sent to the agent and to the visitor, and
+// why the connection ended.
+func (hub *NetworkHub) syncConnections(pipe net.Conn, destination net.Conn, observer *httpObserver, limits ...*bandwidth) (int64, int64, string) {
 	var originToDest int64
 	var destToOrigin int64
 
+	var reason string
+	var reasonOnce sync.Once
+	closedBy := func(r string) {
+		reasonOnce.Do(func() { reason = r })
+	}
+
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		buffer := make([]byte, 4096)
 		for {
 			n, err := pipe.Read(buffer)
 			if err != nil {
+				closedBy(closeVisitorClosed)
 				break
 			}
+			waitUpload(limits, n)
 			written, err := destination.Write(buffer[:n])
 			if err != nil {
+				closedBy(closeAgentError)
 				break
 			}
+			observer.request(buffer[:written])
 			originToDest += int64(written)
-			hub.addDataUsage(int64(written))
+			hub.addDataUsage(int64(written), 0)
 		}
 		logger.Default.Debug("Finished transferring from origin to destination, total bytes:", originToDest)
 	}()
@@ -78,40 +120,108 @@ func (hub *NetworkHub) syncConnections(pipe net.Conn, destination net.Conn) {
 	for {
 		n, err := destination.Read(buffer)
 		if err != nil {
+			closedBy(closeAgentClosed)
 			break
 		}
+		waitDownload(limits, n)
 		written, err := pipe.Write(buffer[:n])
 		if err != nil {
+			closedBy(closeVisitorError)
 			break
 		}
+		observer.response(buffer[:written])
 		destToOrigin += int64(written)
-		hub.addDataUsage(int64(written))
+		hub.addDataUsage(0, int64(written))
 	}
 	logger.Default.Debug("Finished transferring from destination to origin, total bytes:", destToOrigin)
 
+	pipe.Close()
+	destination.Close()
+	<-done
+	observer.close()
+
 	logger.Default.Debug("Connection data usage:",
 		"origin → destination:", originToDest, "bytes,",
 		"destination → origin:", destToOrigin, "bytes",
 		"Hub:", hub.HubName,
 	)
+	return originToDest, destToOrigin, reason
 }
 
-func (hub *NetworkHub) addDataUsage(bytes int64) {
+// addDataUsage counts bytes sent to the agent (ingress) and to the visitor
+// (egress).
+func (hub *NetworkHub) addDataUsage(ingress, egress int64) {
 	hub.mu.Lock()
 	defer hub.mu.Unlock()
 
-	hub.dataUsageAccumulator += bytes
-	hub.totalDataTransferred += bytes
+	hub.ingressTotal.Add(ingress)
+	hub.egressTotal.Add(egress)
+	hub.ingressAccumulator += ingress
+	hub.egressAccumulator += egress
+	hub.dataUsageAccumulator += ingress + egress
+	hub.totalDataTransferred += ingress + egress
 
 	if hub.dataUsageAccumulator >= hub.threshold {
-		hub.trafficManager.AddTraffic(hub.HubName, hub.dataUsageAccumulator)
+		hub.trafficManager.AddTraffic(hub.HubName, hub.ingressAccumulator, hub.egressAccumulator)
 		hub.dataUsageAccumulator = 0
+		hub.ingressAccumulator = 0
+		hub.egressAccumulator = 0
 	}
 	logger.Default.Debug("Data usage updated for hub:", hub.HubName, "Total transferred:", hub.totalDataTransferred)
 }
 
+// flushDataUsage hands the bytes still below the threshold to the traffic
+// manager.
+func (hub *NetworkHub) flushDataUsage() {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	if hub.dataUsageAccumulator == 0 {
+		return
+	}
+	hub.trafficManager.AddTraffic(hub.HubName, hub.ingressAccumulator, hub.egressAccumulator)
+	hub.dataUsageAccumulator = 0
+	hub.ingressAccumulator = 0
+	hub.egressAccumulator = 0
+}
+
+// advertiseAddress is the host agents dial to claim this node's tickets.
+func (hub *NetworkHub) advertiseAddress() string {
+	if hub.registry == nil {
+		return helper.GetPublicIP()
+	}
+	return hub.registry.Address()
+}
+
+// addSession lists an agent in the cluster directory.
+func (hub *NetworkHub) addSession(conn *ProxyNotificationConn) {
+	if hub.registry == nil {
+		return
+	}
+	hub.registry.AddSession(db.AgentSession{
+		ID:          conn.ID,
+		Domain:      hub.HubName,
+		RemoteAddr:  conn.conn.RemoteAddr().String(),
+		Routes:      conn.Routes,
+		ConnectedAt: time.Now().UTC(),
+	})
+}
+
+func (hub *NetworkHub) removeSession(conn *ProxyNotificationConn) {
+	if hub.registry != nil {
+		hub.registry.RemoveSession(conn.ID)
+	}
+}
+
+// countRejected records a visitor connection refused before reaching an agent.
+func (hub *NetworkHub) countRejected() {
+	hub.rejectedConnections.Add(1)
+}
+
 func (hub *NetworkHub) listen() {
-	shutdownComplete := make(chan struct{})
+	maintenance := time.NewTicker(5 * time.Second)
+	defer maintenance.Stop()
+
 	for {
 		select {
 		case conn := <-hub.registerProxyNotificationConn:
@@ -122,10 +232,18 @@ func (hub *NetworkHub) listen() {
 			hub.handleServerRequest(request)
 		case remoteConn := <-hub.incomingClientConn:
 			hub.handleIncomingClientConn(remoteConn)
+		case settings := <-hub.revalidations:
+			hub.handleRevalidation(settings)
+		case now := <-maintenance.C:
+			hub.expireTickets(now)
+			hub.pruneIPBuckets()
+			hub.refreshSettings()
 		case <-hub.shutdownSignal:
-			hub.handleShutdown(shutdownComplete)
+			hub.handleShutdown()
 			return
 		}
+		hub.agentCount.Store(int64(len(hub.ProxyNotificationConns)))
+		hub.pendingCount.Store(int64(len(hub.incomingClientConns)))
 	}
 }
 
@@ -137,17 +255,17 @@ func (hub *NetworkHub) handleRegisterProxyNotificationConn(conn *ProxyNotificati
 	}
 
 	if hub.subscription == nil {
-		mgr, err := subscriptions.GetSubscriptionManager()
+		bp, err := backplane.Get()
 		if err != nil {
-			logger.Default.Error("Error getting SubscriptionManager: " + err.Error())
+			logger.Default.Error("Error getting backplane: " + err.Error())
 			conn.Close()
 			return
 		}
 
-		sub, err := mgr.Subscribe(hub.HubName, func(message *nats.Msg) {
-			msg := string(message.Data)
+		sub, err := bp.Subscribe(hub.HubName, func(data []byte) {
+			msg := string(data)
 
-			ws := hub.getProxyNotificationConn()
+			ws := hub.getProxyNotificationConn(parseTicketGroup(msg))
 			if ws == nil {
 				logger.Default.Error("No ProxyNotificationConns available for hub: ", hub.HubName)
 				return
@@ -161,7 +279,7 @@ func (hub *NetworkHub) handleRegisterProxyNotificationConn(conn *ProxyNotificati
 		})
 
 		if err != nil {
-			logger.Default.Error("Error subscribing to NATS:", err)
+			logger.Default.Error("Error subscribing to tickets:", err)
 			conn.Close()
 			return
 		}
@@ -170,23 +288,28 @@ func (hub *NetworkHub) handleRegisterProxyNotificationConn(conn *ProxyNotificati
 	}
 
 	hub.ProxyNotificationConns[conn] = true
-	logger.Default.Debug("ProxyNotificationConn registered for hub:", hub.HubName)
+	hub.addSession(conn)
+	logger.Default.Debug("ProxyNotificationConn registered for hub:", hub.HubName, "Agent:", conn.ID)
 	go hub.checkConnection(conn)
 }
 
+// handleUnregisterProxyNotificationConn drops an agent and the visitors
+// waiting for one. An agent dropped on revalidation is unregistered again once
+// its connection check sees the close, which changes nothing.
 func (hub *NetworkHub) handleUnregisterProxyNotificationConn(ws *ProxyNotificationConn) {
+	if _, exists := hub.ProxyNotificationConns[ws]; !exists {
+		return
+	}
 	go func() {
 		ws.Write([]byte("close"))
 		ws.Close()
 	}()
-	if _, exists := hub.ProxyNotificationConns[ws]; exists {
-		delete(hub.ProxyNotificationConns, ws)
-		logger.Default.Debug("ProxyNotificationConn unregistered for hub:", hub.HubName)
-	}
+	delete(hub.ProxyNotificationConns, ws)
+	hub.removeSession(ws)
+	logger.Default.Debug("ProxyNotificationConn unregistered for hub:", hub.HubName)
 	for ticket, conn := range hub.incomingClientConns {
 		delete(hub.incomingClientConns, ticket)
-		fmt.Fprintf(conn, helper.BadGatewayResponse)
-		conn.Close()
+		hub.closeVisitor(conn, helper.BadGatewayResponse, closeAgentGone)
 		logger.Default.Debug("Incoming client connection unregistered for hub:", hub.HubName)
 	}
 
@@ -195,6 +318,26 @@ func (hub *NetworkHub) handleUnregisterProxyNotificationConn(ws *ProxyNotificati
 		hub.subscription = nil
 		logger.Default.Debug("Unsubscribed from NATS for hub:", hub.HubName)
 	}
+
+	if len(hub.ProxyNotificationConns) == 0 && hub.onIdle != nil {
+		hub.onIdle(hub)
+	}
+}
+
+// handleRevalidation applies settings changed by an administrator and drops
+// the agents their credentials no longer admit. Nil settings mean the domain
+// is gone.
+func (hub *NetworkHub) handleRevalidation(settings *auth.Domain) {
+	if settings != nil {
+		hub.applyBandwidth(settings)
+	}
+	for conn := range hub.ProxyNotificationConns {
+		if conn.webhook || (settings != nil && settings.Authorize(conn.credential, auth.ScopeAgentConnect)) {
+			continue
+		}
+		logger.Default.Info("Disconnecting agent no longer authorized for hub:", hub.HubName, "Agent:", conn.ID)
+		hub.handleUnregisterProxyNotificationConn(conn)
+	}
 }
 
 func (hub *NetworkHub) handleServerRequest(request *request) {
@@ -211,50 +354,77 @@ func (hub *NetworkHub) handleServerRequest(request *request) {
 	}
 	delete(hub.incomingClientConns, request.ticket)
 	logger.Default.Debug("Server request handled for ticket:", request.ticket, "Hub:", hub.HubName)
-	go hub.syncConnections(pipe, destination)
+	limits := []*bandwidth{hub.bandwidth, hub.quotaBandwidth}
+	if pipe.agent != nil {
+		limits = append(limits, pipe.agent.bandwidth)
+	}
+	var observer *httpObserver
+	if pipe.http {
+		observer = newHTTPObserver(func(method string, status int, latency time.Duration) {
+			hub.trafficManager.AddRequest(hub.HubName, method, status, latency)
+		})
+	}
+	go func() {
+		ingress, egress, reason := hub.syncConnections(pipe, destination, observer, limits...)
+		hub.releaseVisitor(pipe)
+		hub.logConnection(pipe, ingress, egress, reason)
+	}()
 }
 
-func (hub *NetworkHub) handleIncomingClientConn(remoteConn *helper.RemoteConn) {
+func (hub *NetworkHub) handleIncomingClientConn(remoteConn *visitor) {
+	if verdict := hub.checkLimits(remoteConn); verdict != limitOK {
+		hub.rejectVisitor(remoteConn, verdict)
+		return
+	}
+	hub.trackVisitor(remoteConn)
+	hub.applyBandwidth(remoteConn.settings)
+
 	ticket := hub.tickerManager.generate()
-	publicIP := helper.GetPublicIP()
-	msg := publicIP + ":" + ticket
+	msg := ticketMessage(hub.advertiseAddress(), ticket, remoteConn.Domain, remoteConn.group)
 	hub.incomingClientConns[ticket] = remoteConn
 
 	if len(hub.ProxyNotificationConns) == 0 {
-		mng, err := subscriptions.GetSubscriptionManager()
+		bp, err := backplane.Get()
 		if err != nil {
-			logger.Default.Error("Error getting SubscriptionManager:", err)
-			_, _ = remoteConn.Write([]byte(helper.BadGatewayResponse))
-			remoteConn.Close()
+			logger.Default.Error("Error getting backplane:", err)
+			delete(hub.incomingClientConns, ticket)
+			hub.closeVisitor(remoteConn, helper.BadGatewayResponse, closeNoAgent)
 			return
 		}
 
-		mng.Publish(hub.HubName, []byte(msg))
+		if err := bp.Publish(hub.HubName, []byte(msg)); err != nil {
+			logger.Default.Error("Error publishing ticket:", err)
+		}
 		return
 	}
 
-	ws := hub.getProxyNotificationConn()
+	ws := hub.getProxyNotificationConn(remoteConn.group)
 	if ws == nil {
-		logger.Default.Error("No ProxyNotificationConns available for hub:", hub.HubName)
-		_, _ = remoteConn.Write([]byte(helper.BadGatewayResponse))
-		remoteConn.Close()
+		logger.Default.Error("No ProxyNotificationConns available for hub:", hub.HubName, "Group:", remoteConn.group)
+		delete(hub.incomingClientConns, ticket)
+		hub.closeVisitor(remoteConn, helper.BadGatewayResponse, closeNoAgent)
 		return
 	}
 
 	_, err := ws.Write([]byte(msg + "\n"))
 	if err != nil {
 		logger.Default.Error("Error writing ticket to ProxyNotificationConn:", err)
-		_, _ = remoteConn.Write([]byte(helper.BadGatewayResponse))
-		remoteConn.Close()
 		delete(hub.incomingClientConns, ticket)
+		hub.closeVisitor(remoteConn, helper.BadGatewayResponse, closeNoAgent)
+		return
 	}
+	remoteConn.agent = ws
 	logger.Default.Debug("Ticket sent to ProxyNotificationConn for hub:", hub.HubName, "Ticket:", ticket)
 }
 
-func (hub *NetworkHub) getProxyNotificationConn() *ProxyNotificationConn {
+// getProxyNotificationConn picks a random agent serving the route group.
+// Requests outside any route (group "") go to agents that declared no routes.
+func (hub *NetworkHub) getProxyNotificationConn(group string) *ProxyNotificationConn {
 	conns := make([]*ProxyNotificationConn, 0, len(hub.ProxyNotificationConns))
 	for key := range hub.ProxyNotificationConns {
-		conns = append(conns, key)
+		if key.serves(group) {
+			conns = append(conns, key)
+		}
 	}
 
 	if len(conns) == 0 {
@@ -286,7 +456,7 @@ func (hub *NetworkHub) handleIncomingClientConn2(remoteConn *helper.RemoteConn)
 		ws = conns[int(rng.Next()%uint32(len(conns)))]
 	}
 	ticket := hub.tickerManager.generate()
-	hub.incomingClientConns[ticket] = remoteConn
+	hub.incomingClientConns[ticket] = &visitor{RemoteConn: remoteConn}
 	_, err := ws.Write([]byte(ticket + "\n"))
 	if err != nil {
 		logger.Default.Error("Error writing ticket to ProxyNotificationConn:", err)
@@ -297,19 +467,73 @@ func (hub *NetworkHub) handleIncomingClientConn2(remoteConn *helper.RemoteConn)
 	logger.Default.Debug("Ticket sent to ProxyNotificationConn for hub:", hub.HubName, "Ticket:", ticket)
 }
 
-func (hub *NetworkHub) handleShutdown(shutdownComplete chan struct{}) {
-	close(hub.registerProxyNotificationConn)
-	close(hub.unregisterProxyNotificationConn)
-	close(hub.incomingClientConn)
-	close(hub.serverRequests)
-	close(hub.shutdownSignal)
+func (hub *NetworkHub) handleShutdown() {
+	for conn := range hub.ProxyNotificationConns {
+		delete(hub.ProxyNotificationConns, conn)
+		hub.removeSession(conn)
+		conn.Close()
+	}
+	for ticket, conn := range hub.incomingClientConns {
+		delete(hub.incomingClientConns, ticket)
+		hub.closeVisitor(conn, helper.BadGatewayResponse, closeShutdown)
+	}
+	if hub.subscription != nil {
+		hub.subscription.Unsubscribe()
+		hub.subscription = nil
+	}
 	logger.Default.Info("Shutdown completed for hub:", hub.HubName)
-	shutdownComplete <- struct{}{}
+}
+
+// Shutdown stops the hub, closing its agents and any pending visitor.
+// Connections handed to the hub afterwards are rejected.
+func (hub *NetworkHub) Shutdown() {
+	hub.shutdownOnce.Do(func() {
+		close(hub.shutdownSignal)
+	})
+}
+
+func (hub *NetworkHub) register(conn *ProxyNotificationConn) bool {
+	select {
+	case hub.registerProxyNotificationConn <- conn:
+		return true
+	case <-hub.shutdownSignal:
+		return false
+	}
+}
+
+func (hub *NetworkHub) revalidate(settings *auth.Domain) bool {
+	select {
+	case hub.revalidations <- settings:
+		return true
+	case <-hub.shutdownSignal:
+		return false
+	}
+}
+
+func (hub *NetworkHub) addServerRequest(req *request) bool {
+	select {
+	case hub.serverRequests <- req:
+		return true
+	case <-hub.shutdownSignal:
+		return false
+	}
+}
+
+func (hub *NetworkHub) addIncomingClientConn(conn *visitor) bool {
+	select {
+	case hub.incomingClientConn <- conn:
+		return true
+	case <-hub.shutdownSignal:
+		return false
+	}
 }
 
 func (h *NetworkHub) checkConnection(connection *ProxyNotificationConn) {
 	defer func() {
-		h.unregisterProxyNotificationConn <- connection
+		select {
+		case h.unregisterProxyNotificationConn <- connection:
+		case <-h.shutdownSignal:
+		}
 		logger.Default.Info("Connection closed for ProxyNotificationConn in hub:", h.HubName)
 	}()
 	for {
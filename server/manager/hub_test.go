@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+func TestRevalidationUnregistersOnce(t *testing.T) {
+	hub := NewNetworkHub("example.com", nil, 0)
+	idle := 0
+	hub.onIdle = func(*NetworkHub) { idle++ }
+
+	agent, server := net.Pipe()
+	t.Cleanup(func() { agent.Close() })
+	conn := &ProxyNotificationConn{
+		ID:         newAgentID(),
+		Domain:     hub.HubName,
+		bandwidth:  newBandwidth(0, 0),
+		ReadWriter: bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)),
+		conn:       server,
+		credential: "revoked",
+	}
+	hub.ProxyNotificationConns[conn] = true
+
+	hub.handleRevalidation(&auth.Domain{Name: hub.HubName, ApiKey: "current"})
+	if _, exists := hub.ProxyNotificationConns[conn]; exists {
+		t.Fatal("the revoked agent is still registered")
+	}
+	if idle != 1 {
+		t.Fatalf("onIdle ran %d times on revalidation", idle)
+	}
+
+	// A visitor arrives for an agent registering meanwhile, before the
+	// connection check of the dropped agent unregisters it again.
+	visitorEnd, visitorConn := net.Pipe()
+	t.Cleanup(func() { visitorEnd.Close() })
+	go io.Copy(io.Discard, visitorEnd)
+	hub.incomingClientConns["ticket"] = &visitor{RemoteConn: &helper.RemoteConn{Conn: visitorConn}}
+
+	hub.handleUnregisterProxyNotificationConn(conn)
+	if idle != 1 {
+		t.Fatalf("onIdle ran %d times", idle)
+	}
+	if _, pending := hub.incomingClientConns["ticket"]; !pending {
+		t.Fatal("the pending visitor was closed by the second unregister")
+	}
+}
@@ -0,0 +1,130 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// ticketTimeout bounds how long a visitor waits for an agent to dial back.
+const ticketTimeout = 30 * time.Second
+
+type limitVerdict int
+
+const (
+	limitOK limitVerdict = iota
+	limitRate
+	limitBusy
+	limitQuota
+)
+
+// checkLimits applies the domain's connection limits to a new visitor. It
+// runs on the hub goroutine, which owns the pending tickets and buckets.
+func (hub *NetworkHub) checkLimits(v *visitor) limitVerdict {
+	settings := v.settings
+	if settings == nil {
+		return limitOK
+	}
+
+	if hub.quotaExceeded.Load() && settings.QuotaAction != auth.QuotaThrottle {
+		return limitQuota
+	}
+	if settings.MaxPendingTickets > 0 && len(hub.incomingClientConns) >= settings.MaxPendingTickets {
+		return limitBusy
+	}
+	if settings.MaxConnections > 0 && hub.activeVisitors.Load() >= int64(settings.MaxConnections) {
+		return limitBusy
+	}
+
+	if settings.ConnectionRate <= 0 {
+		return limitOK
+	}
+	if !settings.RateLimitPerIP {
+		if hub.connectionBucket == nil {
+			hub.connectionBucket = helper.NewTokenBucket(settings.ConnectionRate, settings.ConnectionBurst)
+		}
+		hub.connectionBucket.SetLimit(settings.ConnectionRate, settings.ConnectionBurst)
+		if !hub.connectionBucket.Allow() {
+			return limitRate
+		}
+		return limitOK
+	}
+
+	ip, ok := helper.AddrIP(v.RemoteAddr())
+	if !ok {
+		return limitOK
+	}
+	bucket, exists := hub.ipBuckets[ip]
+	if !exists {
+		bucket = helper.NewTokenBucket(settings.ConnectionRate, settings.ConnectionBurst)
+		hub.ipBuckets[ip] = bucket
+	}
+	bucket.SetLimit(settings.ConnectionRate, settings.ConnectionBurst)
+	if !bucket.Allow() {
+		return limitRate
+	}
+	return limitOK
+}
+
+// rejectVisitor answers 429 or 503 to HTTP visitors and simply refuses TCP
+// visitors.
+func (hub *NetworkHub) rejectVisitor(v *visitor, verdict limitVerdict) {
+	hub.countRejected()
+	logger.Default.Info("Visitor rejected by connection limits for hub:", hub.HubName, "Address:", v.RemoteAddr())
+
+	if v.http {
+		response := helper.ServiceUnavailableResponse
+		switch verdict {
+		case limitRate:
+			response = helper.TooManyRequestsResponse
+		case limitQuota:
+			response = helper.QuotaExceededResponse(v.settings.QuotaPage)
+		}
+		_, _ = v.Write([]byte(response))
+	}
+	v.Close()
+}
+
+// trackVisitor counts a visitor as active until releaseVisitor is called.
+func (hub *NetworkHub) trackVisitor(v *visitor) {
+	hub.activeVisitors.Add(1)
+	v.createdAt = time.Now()
+}
+
+func (hub *NetworkHub) releaseVisitor(v *visitor) {
+	v.releaseOnce.Do(func() {
+		hub.activeVisitors.Add(-1)
+	})
+}
+
+// closeVisitor drops a visitor that will never reach an agent.
+func (hub *NetworkHub) closeVisitor(v *visitor, response string, reason string) {
+	_, _ = v.Write([]byte(response))
+	v.Close()
+	hub.releaseVisitor(v)
+	hub.logConnection(v, 0, 0, reason)
+}
+
+// expireTickets closes visitors whose ticket was never claimed by an agent.
+func (hub *NetworkHub) expireTickets(now time.Time) {
+	for ticket, v := range hub.incomingClientConns {
+		if now.Sub(v.createdAt) < ticketTimeout {
+			continue
+		}
+		delete(hub.incomingClientConns, ticket)
+		ticketExpirations.Inc()
+		logger.Default.Info("Ticket expired for hub:", hub.HubName, "Ticket:", ticket)
+		hub.closeVisitor(v, helper.BadGatewayResponse, closeTicketExpired)
+	}
+}
+
+// pruneIPBuckets forgets the source IPs that are no longer rate limited.
+func (hub *NetworkHub) pruneIPBuckets() {
+	for ip, bucket := range hub.ipBuckets {
+		if bucket.Full() {
+			delete(hub.ipBuckets, ip)
+		}
+	}
+}
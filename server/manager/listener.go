@@ -74,13 +74,19 @@ func (cl *CustomListener) handle(conn net.Conn) {
 		return
 	}
 
-	urlsToIgnore := []string{"/", "/health", "/traffic"}
+	urlsToIgnore := []string{"/", "/health", trafficPath, legacyTrafficPath}
 	if slices.Contains(urlsToIgnore, url) {
 		logger.Default.Debug("Request to ignored URL:", url)
 		cl.conn <- CustomerAccepter{helper.NewConnWithBuffer(conn, buffer[:n]), nil}
 		return
 	}
 
+	if url == relayPath {
+		logger.Default.Debug("Handling relay from:", conn.RemoteAddr())
+		cl.manager.handleRelay(helper.NewConnWithBuffer(conn, buffer[:n]))
+		return
+	}
+
 	if strings.HasPrefix(url, "/") && len(url) > 1 && strings.Count(url, "/") == 1 {
 		ticket := url[1:]
 		b, err := helper.ReadUntilHeadersEnd(helper.NewConnWithBuffer(conn, buffer[:n]))
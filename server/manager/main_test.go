@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+)
+
+// TestMain runs the tests against a standalone configuration, whose usage
+// is kept in a SQLite database of its own.
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "lipstick-manager")
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Setenv("MODE", config.ModeStandalone)
+	os.Setenv("ADMIN_SECRET_KEY", "secret")
+	os.Setenv("DB_PATH", filepath.Join(dir, "lipstick.db"))
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := db.MigrateConnection(connection); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -2,17 +2,24 @@ package manager
 
 import (
 	"bufio"
+	"crypto/sha256"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/OnnaSoft/lipstick/helper"
 	"github.com/OnnaSoft/lipstick/logger"
 	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/authhook"
+	"github.com/OnnaSoft/lipstick/server/cluster"
 	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/edgeauth"
 	"github.com/OnnaSoft/lipstick/server/traffic"
 	"github.com/gin-gonic/gin"
 )
@@ -23,10 +30,17 @@ type request struct {
 }
 
 type ProxyNotificationConn struct {
+	ID                       string
 	Domain                   string
 	AllowMultipleConnections bool
+	Routes                   []string
+	bandwidth                *bandwidth
 	*bufio.ReadWriter
-	conn net.Conn
+	conn       net.Conn
+	credential string
+	// webhook is set for agents accepted by the authorization webhook,
+	// which the domain store cannot revalidate.
+	webhook bool
 }
 
 func (p *ProxyNotificationConn) Write(b []byte) (int, error) {
@@ -62,27 +76,93 @@ type Manager struct {
 	engine         *gin.Engine
 	hubs           sync.Map
 	trafficManager *traffic.TrafficManager
+	connectionLog  *traffic.ConnectionLog
+	registry       *cluster.Registry
+	relaySecret    []byte
 	authManager    auth.AuthManager
 	tlsConfig      *tls.Config
+	ephemeral      *ephemeralTunnels
+	hostnames      *hostRouter
+	edgeAuth       *edgeauth.Gate
+	webhook        *authhook.Webhook
 }
 
 func SetupManager(tlsConfig *tls.Config) *Manager {
 	gin.SetMode(gin.ReleaseMode)
 
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Fatalf("Error getting config: %v", err)
+	}
+
 	manager := &Manager{
 		hubs:           sync.Map{},
 		authManager:    auth.MakeAuthManager(),
 		trafficManager: traffic.NewTrafficManager(64 * 1024),
 		tlsConfig:      tlsConfig,
+		hostnames:      newHostRouter(),
+	}
+
+	manager.registry = cluster.NewRegistry(conf.Cluster, conf.Manager.Address)
+	manager.registry.Start()
+	if conf.Cluster.Relay {
+		manager.relaySecret = []byte(conf.Cluster.Secret)
+		logger.Default.Info("Relaying visitors to the nodes holding their agents")
+	}
+	if conf.ConnectionLog.Enabled {
+		manager.connectionLog = traffic.NewConnectionLog(conf.ConnectionLog.Retention)
+	}
+	if conf.Ephemeral.Enabled {
+		manager.ephemeral = newEphemeralTunnels(manager, conf.Ephemeral)
+		logger.Default.Info("Ephemeral tunnels enabled under ", conf.Ephemeral.BaseDomain)
+	}
+	manager.edgeAuth = edgeauth.NewGate(
+		sessionSecret(conf),
+		time.Duration(conf.EdgeAuth.SessionTTL)*time.Second,
+		conf.EdgeAuth.ForwardAuthorization,
+	)
+
+	manager.webhook = authhook.New(conf.AuthWebhook)
+	if manager.webhook != nil {
+		logger.Default.Info("Deferring authorization to webhook ", conf.AuthWebhook.URL)
 	}
 
+	manager.authManager.OnChange(manager.domainsChanged)
+
 	configureRouter(manager)
+	manager.registerMetrics()
+	go manager.watchQuotas()
 
 	logger.Default.Info("Manager setup completed")
 
 	return manager
 }
 
+// Shutdown saves the traffic counted so far, including what the hubs have not
+// handed over yet, and the queued connection log entries, then leaves the
+// cluster registry.
+func (m *Manager) Shutdown() {
+	m.hubs.Range(func(_, value interface{}) bool {
+		value.(*NetworkHub).flushDataUsage()
+		return true
+	})
+	if err := m.trafficManager.Close(); err != nil {
+		logger.Default.Error("Traffic counters lost on shutdown:", err)
+	}
+	if m.connectionLog != nil {
+		m.connectionLog.Close()
+	}
+	m.registry.Close()
+}
+
+func sessionSecret(conf config.AppConfig) []byte {
+	if conf.EdgeAuth.SessionSecret != "" {
+		return []byte(conf.EdgeAuth.SessionSecret)
+	}
+	sum := sha256.Sum256([]byte("lipstick-edge-auth:" + conf.AdminSecretKey))
+	return sum[:]
+}
+
 func (m *Manager) AddHub(domain string, hub *NetworkHub) {
 	logger.Default.Debug("Adding hub for domain:", domain)
 	m.hubs.Store(domain, hub)
@@ -100,6 +180,91 @@ func (m *Manager) GetHub(domain string) (*NetworkHub, bool) {
 func (m *Manager) RemoveHub(domain string) {
 	logger.Default.Debug("Removing hub for domain:", domain)
 	m.hubs.Delete(domain)
+	m.hostnames.unregister(domain)
+}
+
+// ResolveHub finds the hub serving a visitor hostname: the domain name itself,
+// one of its aliases or, failing that, its most specific wildcard pattern.
+func (m *Manager) ResolveHub(hostname string) (*NetworkHub, bool) {
+	if hub, ok := m.GetHub(hostname); ok {
+		return hub, true
+	}
+
+	hubName, ok := m.hostnames.resolve(hostname)
+	if !ok {
+		return nil, false
+	}
+	return m.GetHub(hubName)
+}
+
+// domainsChanged applies the new settings of changed domains to their hubs
+// and disconnects the agents whose credential is no longer accepted, all of
+// them when the domain was deleted or renamed.
+func (m *Manager) domainsChanged(names []string) {
+	for _, name := range names {
+		if m.ephemeral != nil && m.ephemeral.has(name) {
+			continue
+		}
+		hub, ok := m.GetHub(name)
+		if !ok {
+			continue
+		}
+
+		domain, err := m.authManager.GetDomain(name)
+		switch {
+		case errors.Is(err, auth.ErrNotFound):
+			domain = nil
+			m.hostnames.unregister(name)
+		case err != nil:
+			logger.Default.Error("Unable to reload domain:", name, "Error:", err)
+			continue
+		default:
+			m.hostnames.register(name, domain.Aliases, domain.Wildcards)
+		}
+		hub.revalidate(domain)
+	}
+}
+
+func (m *Manager) getOrCreateHub(domain string) *NetworkHub {
+	if hub, ok := m.GetHub(domain); ok {
+		return hub
+	}
+
+	hub := NewNetworkHub(domain, m.trafficManager, 64*1024)
+	hub.connectionLog = m.connectionLog
+	hub.registry = m.registry
+	hub.lookupSettings = func() (*auth.Domain, error) {
+		return m.lookupDomain(domain)
+	}
+	if m.ephemeral != nil && m.ephemeral.has(domain) {
+		hub.onIdle = func(hub *NetworkHub) {
+			m.ephemeral.remove(hub.HubName)
+		}
+	}
+	if actual, loaded := m.hubs.LoadOrStore(domain, hub); loaded {
+		return actual.(*NetworkHub)
+	}
+	go hub.listen()
+	logger.Default.Info("New hub created for domain:", domain)
+	return hub
+}
+
+// createEphemeralDomain authenticates an account-level key and assigns it a
+// fresh subdomain under the configured base domain.
+func (m *Manager) createEphemeralDomain(apiKey string) (*auth.Domain, error) {
+	if m.ephemeral == nil {
+		return nil, ErrEphemeralDisabled
+	}
+	if apiKey == "" {
+		return nil, errors.New("missing account key")
+	}
+
+	account, err := m.authManager.GetAccountByKey(apiKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid account key: %w", err)
+	}
+
+	return m.ephemeral.create(account)
 }
 
 func (manager *Manager) handleTunnel(conn net.Conn, req *http.Request, ticket string) {
@@ -113,7 +278,10 @@ func (manager *Manager) handleTunnel(conn net.Conn, req *http.Request, ticket st
 	}
 
 	logger.Default.Debug("Handling tunnel for domain:", domainName)
-	domain.serverRequests <- &request{ticket: ticket, conn: conn}
+	if !domain.addServerRequest(&request{ticket: ticket, conn: conn}) {
+		logger.Default.Error("hub is shut down for domain:", domainName)
+		conn.Close()
+	}
 }
 
 func (manager *Manager) Listen() {
@@ -148,7 +316,11 @@ func (manager *Manager) HandleHTTPConn(conn net.Conn, req *http.Request) {
 	host := req.Host
 	domain := strings.Split(host, ":")[0]
 
-	hub, ok := manager.GetHub(domain)
+	if manager.relay(conn, domain, relayHTTP) {
+		return
+	}
+
+	hub, ok := manager.ResolveHub(domain)
 	if !ok {
 		logger.Default.Error("Hub not found for domain:", domain)
 		_, err := fmt.Fprint(conn, helper.BadGatewayResponse)
@@ -160,12 +332,74 @@ func (manager *Manager) HandleHTTPConn(conn net.Conn, req *http.Request) {
 	}
 
 	logger.Default.Debug("Handling HTTP connection for domain:", domain)
-	if remoteConn, ok := conn.(*helper.RemoteConn); ok {
-		hub.incomingClientConn <- remoteConn
+	remoteConn, ok := conn.(*helper.RemoteConn)
+	if !ok {
+		remoteConn = &helper.RemoteConn{Conn: conn, Domain: domain}
+	}
+
+	// Without its settings the domain's access lists and edge authentication
+	// would be skipped, so visitors wait for the store to come back.
+	settings, err := manager.lookupDomain(hub.HubName)
+	if err != nil {
+		logger.Default.Error("Unable to get domain settings for hub:", hub.HubName, "Error:", err)
+		hub.countRejected()
+		fmt.Fprint(conn, helper.ServiceUnavailableResponse)
+		conn.Close()
 		return
 	}
+	if !visitorAllowed(settings, conn.RemoteAddr()) {
+		logger.Default.Info("Visitor rejected by access list for domain:", domain, "Address:", conn.RemoteAddr())
+		hub.countRejected()
+		fmt.Fprint(conn, helper.ForbiddenResponse)
+		conn.Close()
+		return
+	}
+	if !manager.visitorAuthorized(hub.HubName, domain, relayHTTP, conn.RemoteAddr()) {
+		logger.Default.Info("Visitor rejected by authorization webhook for domain:", domain, "Address:", conn.RemoteAddr())
+		authFailures.Inc("visitor")
+		hub.countRejected()
+		fmt.Fprint(conn, helper.ForbiddenResponse)
+		conn.Close()
+		return
+	}
+
+	rewrite := false
+	if edgeauth.Enabled(settings) {
+		allowed, response := manager.edgeAuth.Check(settings, req, manager.tlsConfig != nil)
+		if !allowed {
+			authFailures.Inc("visitor")
+			logger.Default.Debug("Visitor not authenticated for domain:", domain, "Path:", req.URL.Path)
+			conn.Write(response)
+			conn.Close()
+			return
+		}
+		// The agent must close the connection after answering, so that
+		// every request of the visitor goes through the gate.
+		edgeauth.StripSession(req)
+		disableKeepAlive(req)
+		rewrite = true
+	}
+
+	group := ""
+	if settings != nil && len(settings.Routes) > 0 {
+		route := matchRoute(settings.Routes, req)
+		if route != nil {
+			group = route.Group
+		}
+		applyRoute(req, route)
+		rewrite = true
+	}
 
-	hub.incomingClientConn <- &helper.RemoteConn{Conn: conn, Domain: domain}
+	if buffered, ok := conn.(*helper.ConnWithBuffer); ok && rewrite {
+		buffered.SetBuffer(requestHead(req))
+	}
+
+	v := &visitor{RemoteConn: remoteConn, group: group, http: true, settings: settings}
+	if !hub.addIncomingClientConn(v) {
+		logger.Default.Error("Hub is shut down for domain:", domain)
+		fmt.Fprint(conn, helper.BadGatewayResponse)
+		conn.Close()
+	}
 }
 
 func (manager *Manager) HandleTCPConn(conn net.Conn) {
@@ -180,7 +414,15 @@ func (manager *Manager) HandleTCPConn(conn net.Conn) {
 		return
 	}
 
-	hub, ok := manager.GetHub(domain)
+	if manager.relay(conn, domain, relayTCP) {
+		return
+	}
+	manager.handleTCPVisitor(conn, domain)
+}
+
+// handleTCPVisitor hands a raw connection to the hub serving domain.
+func (manager *Manager) handleTCPVisitor(conn net.Conn, domain string) {
+	hub, ok := manager.ResolveHub(domain)
 	if !ok {
 		logger.Default.Error("Hub not found for domain:", domain)
 		_, err := fmt.Fprint(conn, helper.BadGatewayResponse)
@@ -191,11 +433,35 @@ func (manager *Manager) HandleTCPConn(conn net.Conn) {
 		return
 	}
 
-	logger.Default.Debug("Handling TCP connection for domain:", domain)
-	if remoteConn, ok := conn.(*helper.RemoteConn); ok {
-		hub.incomingClientConn <- remoteConn
+	settings, err := manager.lookupDomain(hub.HubName)
+	if err != nil {
+		logger.Default.Error("Unable to get domain settings for hub:", hub.HubName, "Error:", err)
+		hub.countRejected()
+		conn.Close()
+		return
+	}
+	if !visitorAllowed(settings, conn.RemoteAddr()) {
+		logger.Default.Info("Visitor rejected by access list for domain:", domain, "Address:", conn.RemoteAddr())
+		hub.countRejected()
+		conn.Close()
+		return
+	}
+	if !manager.visitorAuthorized(hub.HubName, domain, relayTCP, conn.RemoteAddr()) {
+		logger.Default.Info("Visitor rejected by authorization webhook for domain:", domain, "Address:", conn.RemoteAddr())
+		authFailures.Inc("visitor")
+		hub.countRejected()
+		conn.Close()
 		return
 	}
 
-	hub.incomingClientConn <- &helper.RemoteConn{Conn: conn, Domain: domain}
+	logger.Default.Debug("Handling TCP connection for domain:", domain)
+	remoteConn, ok := conn.(*helper.RemoteConn)
+	if !ok {
+		remoteConn = &helper.RemoteConn{Conn: conn, Domain: domain}
+	}
+	if !hub.addIncomingClientConn(&visitor{RemoteConn: remoteConn, settings: settings}) {
+		logger.Default.Error("Hub is shut down for domain:", domain)
+		fmt.Fprint(conn, helper.BadGatewayResponse)
+		conn.Close()
+	}
 }
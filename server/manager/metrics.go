@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"github.com/OnnaSoft/lipstick/server/metrics"
+)
+
+var (
+	ticketExpirations = metrics.NewCounter("lipstick_ticket_expirations_total",
+		"Visitors dropped because no agent claimed their ticket in time.")
+	authFailures = metrics.NewCounter("lipstick_auth_failures_total",
+		"Rejected authentications, by kind (agent, visitor, traffic or relay).", "kind")
+	relayedConnections = metrics.NewCounter("lipstick_relay_connections_total",
+		"Visitors forwarded between nodes, by direction (out or in) and result.", "direction", "result")
+)
+
+// registerMetrics exposes the state of the manager's hubs. Values are read
+// when the metrics are scraped.
+func (m *Manager) registerMetrics() {
+	perHub := func(value func(hub *NetworkHub) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			var samples []metrics.Sample
+			m.hubs.Range(func(_, v any) bool {
+				hub := v.(*NetworkHub)
+				samples = append(samples, metrics.Sample{Labels: []string{hub.HubName}, Value: value(hub)})
+				return true
+			})
+			return samples
+		}
+	}
+
+	metrics.NewGaugeFunc("lipstick_hubs", "Active hubs.", func() []metrics.Sample {
+		count := 0
+		m.hubs.Range(func(_, _ any) bool {
+			count++
+			return true
+		})
+		return []metrics.Sample{{Value: float64(count)}}
+	})
+	metrics.NewGaugeFunc("lipstick_agents", "Agents connected to this server.", perHub(func(hub *NetworkHub) float64 {
+		return float64(hub.agentCount.Load())
+	}), "domain")
+	metrics.NewGaugeFunc("lipstick_pending_tickets", "Visitors waiting for an agent to dial back.", perHub(func(hub *NetworkHub) float64 {
+		return float64(hub.pendingCount.Load())
+	}), "domain")
+	metrics.NewGaugeFunc("lipstick_visitor_connections", "Open visitor connections.", perHub(func(hub *NetworkHub) float64 {
+		return float64(hub.activeVisitors.Load())
+	}), "domain")
+	metrics.NewCounterFunc("lipstick_bytes_total", "Bytes relayed, by domain and direction.", func() []metrics.Sample {
+		var samples []metrics.Sample
+		m.hubs.Range(func(_, v any) bool {
+			hub := v.(*NetworkHub)
+			samples = append(samples,
+				metrics.Sample{Labels: []string{hub.HubName, "ingress"}, Value: float64(hub.ingressTotal.Load())},
+				metrics.Sample{Labels: []string{hub.HubName, "egress"}, Value: float64(hub.egressTotal.Load())},
+			)
+			return true
+		})
+		return samples
+	}, "domain", "direction")
+}
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/traffic"
+)
+
+// quotaInterval is how often the monthly usage of every hub is checked.
+const quotaInterval = 30 * time.Second
+
+func (m *Manager) watchQuotas() {
+	ticker := time.NewTicker(quotaInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.hubs.Range(func(_, value any) bool {
+			m.checkQuota(value.(*NetworkHub))
+			return true
+		})
+	}
+}
+
+func (m *Manager) checkQuota(hub *NetworkHub) {
+	settings, err := m.lookupDomain(hub.HubName)
+	if err != nil {
+		logger.Default.Error("Unable to get domain settings for hub:", hub.HubName, "Error:", err)
+		return
+	}
+	if settings == nil || settings.MonthlyQuota <= 0 {
+		hub.setQuotaExceeded(false, 0)
+		return
+	}
+
+	month := traffic.Month(time.Now())
+	used, err := traffic.MonthlyUsage(hub.HubName, month)
+	if err != nil {
+		logger.Default.Error("Unable to get monthly usage for hub:", hub.HubName, "Error:", err)
+		return
+	}
+	used = settings.QuotaUsage(month, used)
+
+	hub.warnQuota(settings, month, used)
+
+	var throttle int64
+	if settings.QuotaAction == auth.QuotaThrottle {
+		throttle = settings.QuotaThrottleRate
+	}
+	hub.setQuotaExceeded(used >= settings.MonthlyQuota, throttle)
+}
+
+// setQuotaExceeded records whether the monthly quota is used up. Throttled
+// domains keep accepting visitors, but every connection shares throttle
+// bytes per second in each direction.
+func (hub *NetworkHub) setQuotaExceeded(exceeded bool, throttle int64) {
+	if hub.quotaExceeded.Swap(exceeded) != exceeded {
+		if exceeded {
+			logger.Default.Warning("Monthly quota exceeded for hub:", hub.HubName)
+		} else {
+			logger.Default.Info("Monthly quota available again for hub:", hub.HubName)
+		}
+	}
+
+	if !exceeded {
+		throttle = 0
+	}
+	hub.quotaBandwidth.set(throttle, throttle)
+}
+
+// warnQuota logs once per month the highest warning percentage reached.
+func (hub *NetworkHub) warnQuota(settings *auth.Domain, month string, used int64) {
+	percent := used * 100 / settings.MonthlyQuota
+
+	reached := 0
+	for _, threshold := range settings.QuotaWarnings {
+		if percent >= int64(threshold) && threshold > reached {
+			reached = threshold
+		}
+	}
+
+	if hub.quotaWarnedMonth != month || reached < hub.quotaWarned {
+		hub.quotaWarnedMonth = month
+		hub.quotaWarned = 0
+	}
+	if reached > hub.quotaWarned {
+		hub.quotaWarned = reached
+		logger.Default.Warning("Hub", hub.HubName, "reached", reached, "% of its monthly quota:", used, "of", settings.MonthlyQuota, "bytes")
+	}
+}
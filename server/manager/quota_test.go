@@ -0,0 +1,148 @@
+package manager
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/OnnaSoft/lipstick/server/traffic"
+)
+
+// recordUsage stores bytes as the usage of domain today.
+func recordUsage(t *testing.T, domain string, bytes int64) {
+	t.Helper()
+	conf, err := config.GetConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	err = connection.Create(&db.DailyConsumption{
+		Domain:    domain,
+		Date:      now.UTC().Truncate(24 * time.Hour),
+		Month:     traffic.Month(now),
+		BytesUsed: bytes,
+	}).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	month := traffic.Month(time.Now())
+	tests := []struct {
+		name      string
+		domain    auth.Domain
+		used      int64
+		exceeded  bool
+		verdict   limitVerdict
+		throttled bool
+		warned    int
+	}{
+		{
+			name:   "no quota",
+			domain: auth.Domain{QuotaWarnings: []int{50}},
+			used:   5000,
+		},
+		{
+			name:   "below the warnings",
+			domain: auth.Domain{MonthlyQuota: 1000, QuotaWarnings: []int{50, 80}},
+			used:   400,
+		},
+		{
+			name:   "highest warning reached",
+			domain: auth.Domain{MonthlyQuota: 1000, QuotaWarnings: []int{80, 50, 100}},
+			used:   850,
+			warned: 80,
+		},
+		{
+			name:     "rejected",
+			domain:   auth.Domain{MonthlyQuota: 1000, QuotaWarnings: []int{50, 100}},
+			used:     1000,
+			exceeded: true,
+			verdict:  limitQuota,
+			warned:   100,
+		},
+		{
+			name:      "throttled",
+			domain:    auth.Domain{MonthlyQuota: 1000, QuotaAction: auth.QuotaThrottle, QuotaThrottleRate: 100},
+			used:      1200,
+			exceeded:  true,
+			throttled: true,
+		},
+		{
+			name:   "reset this month",
+			domain: auth.Domain{MonthlyQuota: 1000, QuotaWarnings: []int{50}, QuotaResetMonth: month, QuotaResetBytes: 1000},
+			used:   1200,
+		},
+		{
+			name:     "reset another month",
+			domain:   auth.Domain{MonthlyQuota: 1000, QuotaResetMonth: "2000-01", QuotaResetBytes: 1000},
+			used:     1200,
+			exceeded: true,
+			verdict:  limitQuota,
+		},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := fmt.Sprintf("quota%d.example.com", i)
+			domain := test.domain
+			domain.Name = name
+			recordUsage(t, name, test.used)
+			m := newTestManager(&stubStore{domains: map[string]*auth.Domain{name: &domain}}, name)
+			hub, _ := m.GetHub(name)
+
+			m.checkQuota(hub)
+
+			if exceeded := hub.quotaExceeded.Load(); exceeded != test.exceeded {
+				t.Errorf("exceeded = %v, want %v", exceeded, test.exceeded)
+			}
+			if verdict := hub.checkLimits(&visitor{settings: &domain}); verdict != test.verdict {
+				t.Errorf("verdict = %v, want %v", verdict, test.verdict)
+			}
+			if throttled := !hub.quotaBandwidth.upload.Unlimited(); throttled != test.throttled {
+				t.Errorf("throttled = %v, want %v", throttled, test.throttled)
+			}
+			if hub.quotaWarned != test.warned {
+				t.Errorf("warned = %d%%, want %d%%", hub.quotaWarned, test.warned)
+			}
+		})
+	}
+}
+
+func TestQuotaChanged(t *testing.T) {
+	domain := &auth.Domain{Name: "changed.example.com", MonthlyQuota: 1000, QuotaWarnings: []int{50, 90}}
+	recordUsage(t, domain.Name, 950)
+	m := newTestManager(&stubStore{domains: map[string]*auth.Domain{domain.Name: domain}}, domain.Name)
+	hub, _ := m.GetHub(domain.Name)
+
+	m.checkQuota(hub)
+	if hub.quotaWarned != 90 {
+		t.Fatalf("warned = %d%%, want 90%%", hub.quotaWarned)
+	}
+
+	raised := *domain
+	raised.MonthlyQuota = 2000
+	m.authManager.(*stubStore).domains[domain.Name] = &raised
+	m.checkQuota(hub)
+	if hub.quotaWarned != 0 {
+		t.Fatalf("warned = %d%% after the quota was raised, want 0%%", hub.quotaWarned)
+	}
+
+	domain.MonthlyQuota = 500
+	m.authManager.(*stubStore).domains[domain.Name] = domain
+	m.checkQuota(hub)
+	if !hub.quotaExceeded.Load() || hub.quotaWarned != 90 {
+		t.Fatalf("exceeded = %v, warned = %d%% after the quota was lowered", hub.quotaExceeded.Load(), hub.quotaWarned)
+	}
+	if verdict := hub.checkLimits(&visitor{settings: domain}); verdict != limitQuota {
+		t.Fatalf("verdict = %v, want limitQuota", verdict)
+	}
+}
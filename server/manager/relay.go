@@ -0,0 +1,305 @@
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+)
+
+// relayPath is where a node accepts the visitors forwarded by the other
+// nodes of the cluster, on the manager port.
+const relayPath = "/relay"
+
+const (
+	relayHostHeader      = "X-Lipstick-Relay-Host"
+	relayProtocolHeader  = "X-Lipstick-Relay-Protocol"
+	relayVisitorHeader   = "X-Lipstick-Relay-Visitor"
+	relaySignatureHeader = "X-Lipstick-Relay-Signature"
+
+	relayHTTP = "http"
+	relayTCP  = "tcp"
+
+	// relayTimeout bounds the dial and the handshake with a peer, and
+	// relaySkew the clock difference tolerated on signatures.
+	relayTimeout = 5 * time.Second
+	relaySkew    = 30 * time.Second
+	maxRelayHead = 8 * 1024
+	// maxVisitorHead bounds the request head of a relayed HTTP visitor.
+	maxVisitorHead = 64 * 1024
+)
+
+var errHeadTooLarge = errors.New("headers too large")
+
+// relayedConn is a visitor forwarded by another node. RemoteAddr is the
+// visitor's address as that node saw it.
+type relayedConn struct {
+	net.Conn
+	visitor net.Addr
+}
+
+func (c *relayedConn) RemoteAddr() net.Addr {
+	return c.visitor
+}
+
+func isRelayed(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case *relayedConn:
+			return true
+		case *helper.RemoteConn:
+			conn = c.Conn
+		case *helper.ConnWithBuffer:
+			conn = c.Conn
+		default:
+			return false
+		}
+	}
+}
+
+// relaySignature authenticates a relay request with the cluster secret, so
+// the secret itself never travels between nodes.
+func relaySignature(secret []byte, timestamp, host, protocol, visitor string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.Join([]string{timestamp, host, protocol, visitor}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// relay forwards a visitor to another node holding agents of its domain
+// when relaying is enabled and none is connected here. It reports whether
+// the visitor was taken; otherwise it is served locally as usual.
+func (m *Manager) relay(conn net.Conn, hostname, protocol string) bool {
+	if len(m.relaySecret) == 0 || isRelayed(conn) {
+		return false
+	}
+
+	var domain string
+	if hub, ok := m.ResolveHub(hostname); ok {
+		if hub.agentCount.Load() > 0 {
+			return false
+		}
+		domain = hub.HubName
+	} else {
+		// Aliases and wildcards are only registered here once an agent of
+		// their domain connected, so the peers are looked up by the domain
+		// the store assigns them to.
+		var err error
+		if domain, err = m.storeDomain(hostname); err != nil {
+			logger.Default.Error("Error resolving the domain of host:", hostname, "Error:", err)
+			return false
+		}
+	}
+
+	peers, err := m.registry.Peers(domain)
+	if err != nil {
+		logger.Default.Error("Error looking up the nodes serving domain:", domain, "Error:", err)
+		return false
+	}
+	if len(peers) == 0 {
+		return false
+	}
+
+	offset := rand.IntN(len(peers))
+	for i := range peers {
+		address := peers[(offset+i)%len(peers)]
+		peer, err := m.dialPeer(address, hostname, protocol, conn.RemoteAddr().String())
+		if err != nil {
+			relayedConnections.Inc("out", "error")
+			logger.Default.Error("Error relaying visitor of domain:", domain, "to node:", address, "Error:", err)
+			continue
+		}
+
+		relayedConnections.Inc("out", "ok")
+		logger.Default.Debug("Relaying visitor of domain:", domain, "to node:", address)
+		pipe(conn, peer)
+		return true
+	}
+	return false
+}
+
+// dialPeer opens a relay to the node at address and waits for it to accept
+// the visitor.
+func (m *Manager) dialPeer(address, host, protocol, visitor string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: relayTimeout}
+	var peer net.Conn
+	var err error
+	if m.tlsConfig != nil {
+		// Peers are authenticated by the signature; their certificates are
+		// issued for the public domains rather than the relay addresses.
+		peer, err = tls.DialWithDialer(dialer, "tcp", address, &tls.Config{
+			MinVersion:         tls.VersionTLS12,
+			InsecureSkipVerify: true,
+		})
+	} else {
+		peer, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodGet, "http://"+address+relayPath, nil)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	req.Header.Set(relayHostHeader, host)
+	req.Header.Set(relayProtocolHeader, protocol)
+	req.Header.Set(relayVisitorHeader, visitor)
+	req.Header.Set(relaySignatureHeader, timestamp+"."+relaySignature(m.relaySecret, timestamp, host, protocol, visitor))
+
+	peer.SetDeadline(time.Now().Add(relayTimeout))
+	if err := req.Write(peer); err != nil {
+		peer.Close()
+		return nil, err
+	}
+	head, err := readHead(peer, maxRelayHead)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), req)
+	if err != nil {
+		peer.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		peer.Close()
+		return nil, fmt.Errorf("relay refused: %s", resp.Status)
+	}
+	peer.SetDeadline(time.Time{})
+	return peer, nil
+}
+
+// readHead reads up to the end of the headers, at most limit bytes, without
+// consuming the bytes that follow them, which already belong to the relayed
+// stream.
+func readHead(conn net.Conn, limit int) ([]byte, error) {
+	head := make([]byte, 0, 256)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) >= limit {
+			return nil, errHeadTooLarge
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		head = append(head, b[0])
+	}
+	return head, nil
+}
+
+func pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
+
+// handleRelay accepts a visitor forwarded by another node and serves it as
+// if it had connected here.
+func (m *Manager) handleRelay(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(relayTimeout))
+	head, err := readHead(conn, maxRelayHead)
+	if err != nil {
+		logger.Default.Error("Error reading relay request:", err)
+		conn.Close()
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		logger.Default.Error("Error parsing relay request:", err)
+		conn.Close()
+		return
+	}
+
+	host := req.Header.Get(relayHostHeader)
+	protocol := req.Header.Get(relayProtocolHeader)
+	visitor, err := netip.ParseAddrPort(req.Header.Get(relayVisitorHeader))
+	if err != nil || host == "" || (protocol != relayHTTP && protocol != relayTCP) {
+		relayedConnections.Inc("in", "invalid")
+		fmt.Fprint(conn, "HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+	if !m.validRelaySignature(req, host, protocol) {
+		relayedConnections.Inc("in", "unauthorized")
+		authFailures.Inc("relay")
+		logger.Default.Info("Relay rejected from:", conn.RemoteAddr())
+		fmt.Fprint(conn, "HTTP/1.1 403 Forbidden\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		return
+	}
+
+	if _, err := fmt.Fprint(conn, "HTTP/1.1 200 OK\r\n\r\n"); err != nil {
+		conn.Close()
+		return
+	}
+	relayedConnections.Inc("in", "ok")
+	conn.SetDeadline(time.Time{})
+
+	relayed := &relayedConn{Conn: conn, visitor: net.TCPAddrFromAddrPort(visitor)}
+	if protocol == relayTCP {
+		m.handleTCPVisitor(relayed, host)
+		return
+	}
+
+	// The body and any pipelined request stay in the connection.
+	visitorHead, err := readHead(relayed, maxVisitorHead)
+	if err != nil {
+		logger.Default.Error("Error reading relayed request:", err)
+		relayed.Close()
+		return
+	}
+	visitorReq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(visitorHead)))
+	if err != nil {
+		logger.Default.Error("Error parsing relayed request:", err)
+		relayed.Close()
+		return
+	}
+	m.HandleHTTPConn(helper.NewConnWithBuffer(relayed, visitorHead), visitorReq)
+}
+
+func (m *Manager) validRelaySignature(req *http.Request, host, protocol string) bool {
+	if len(m.relaySecret) == 0 {
+		return false
+	}
+	timestamp, signature, ok := strings.Cut(req.Header.Get(relaySignatureHeader), ".")
+	if !ok {
+		return false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(unix, 0)); age > relaySkew || age < -relaySkew {
+		return false
+	}
+	expected := relaySignature(m.relaySecret, timestamp, host, protocol, req.Header.Get(relayVisitorHeader))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
@@ -0,0 +1,168 @@
+package manager
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// Relaying looks up the nodes serving a visitor by its domain, so hostnames
+// no local agent registered are resolved through the store.
+func TestStoreDomain(t *testing.T) {
+	store := &stubStore{domains: map[string]*auth.Domain{
+		"example.com": {
+			Name:      "example.com",
+			Aliases:   []string{"www.example.com"},
+			Wildcards: []string{"*.example.com"},
+		},
+		"preview.example.org": {
+			Name:      "preview.example.org",
+			Aliases:   []string{"pr-1.preview.example.com"},
+			Wildcards: []string{"*.preview.example.com"},
+		},
+	}}
+	m := newTestManager(store)
+
+	for hostname, want := range map[string]string{
+		"example.com":              "example.com",
+		"WWW.Example.com.":         "example.com",
+		"api.example.com":          "example.com",
+		"pr-2.preview.example.com": "preview.example.org",
+		"pr-1.preview.example.com": "preview.example.org",
+		"unknown.example.net":      "unknown.example.net",
+	} {
+		if got, err := m.storeDomain(hostname); err != nil || got != want {
+			t.Errorf("storeDomain(%q) = %q, %v; want %q", hostname, got, err, want)
+		}
+	}
+
+	store.err = errStoreDown
+	if _, err := m.storeDomain("www.example.com"); !errors.Is(err, errStoreDown) {
+		t.Fatalf("storeDomain with the store down returned %v", err)
+	}
+}
+
+// startRelayNode runs m's relay endpoint on a loopback listener, as
+// CustomListener does for relayPath, and returns its address.
+func startRelayNode(t *testing.T, m *Manager) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.handleRelay(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRelayHTTP(t *testing.T) {
+	secret := []byte("cluster-secret")
+	store := &stubStore{domains: map[string]*auth.Domain{
+		// Only the relayed visitor's own address is allowed in.
+		"example.com": {Name: "example.com", AllowCIDRs: []string{"203.0.113.9/32"}},
+	}}
+	target := newTestManager(store)
+	target.relaySecret = secret
+	hub := startHub(t, target, "example.com")
+	connectAgent(t, target, hub, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.Path, body)
+	}))
+	address := startRelayNode(t, target)
+
+	origin := newTestManager(&stubStore{})
+	origin.relaySecret = secret
+	peer, err := origin.dialPeer(address, "example.com", relayHTTP, "203.0.113.9:41000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	visitor, server := net.Pipe()
+	defer visitor.Close()
+	go pipe(server, peer)
+
+	// The head and the body arrive together, and neither may be lost.
+	visitor.SetDeadline(time.Now().Add(5 * time.Second))
+	body := strings.Repeat("payload ", 512)
+	request := "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	go visitor.Write([]byte(request))
+
+	resp, err := http.ReadResponse(bufio.NewReader(visitor), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(got) != "POST /upload "+body {
+		t.Fatalf("relayed request answered %d %.40q", resp.StatusCode, got)
+	}
+}
+
+func TestRelayRejected(t *testing.T) {
+	target := newTestManager(&stubStore{})
+	target.relaySecret = []byte("cluster-secret")
+	address := startRelayNode(t, target)
+
+	origin := newTestManager(&stubStore{})
+	origin.relaySecret = []byte("another-secret")
+	if _, err := origin.dialPeer(address, "example.com", relayHTTP, "203.0.113.9:41000"); err == nil ||
+		!strings.Contains(err.Error(), "403") {
+		t.Fatalf("relay signed with another secret returned %v, want 403", err)
+	}
+
+	sign := func(timestamp time.Time, visitor string) string {
+		unix := strconv.FormatInt(timestamp.Unix(), 10)
+		return unix + "." + relaySignature(target.relaySecret, unix, "example.com", relayHTTP, visitor)
+	}
+	for name, test := range map[string]struct {
+		visitor, signature string
+		want               int
+	}{
+		"stale signature":  {"203.0.113.9:41000", sign(time.Now().Add(-2*relaySkew), "203.0.113.9:41000"), http.StatusForbidden},
+		"future signature": {"203.0.113.9:41000", sign(time.Now().Add(2*relaySkew), "203.0.113.9:41000"), http.StatusForbidden},
+		"other visitor":    {"203.0.113.10:41000", sign(time.Now(), "203.0.113.9:41000"), http.StatusForbidden},
+		"invalid visitor":  {"somewhere", sign(time.Now(), "somewhere"), http.StatusBadRequest},
+	} {
+		t.Run(name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			req, _ := http.NewRequest(http.MethodGet, "http://"+address+relayPath, nil)
+			req.Header.Set(relayHostHeader, "example.com")
+			req.Header.Set(relayProtocolHeader, relayHTTP)
+			req.Header.Set(relayVisitorHeader, test.visitor)
+			req.Header.Set(relaySignatureHeader, test.signature)
+			if err := req.Write(conn); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != test.want {
+				t.Fatalf("relay answered %d, want %d", resp.StatusCode, test.want)
+			}
+		})
+	}
+}
@@ -3,11 +3,9 @@ package manager
 import (
 	"net/http"
 	"strings"
-	"time"
 
 	"github.com/OnnaSoft/lipstick/logger"
-	"github.com/OnnaSoft/lipstick/server/config"
-	"github.com/OnnaSoft/lipstick/server/db"
+	"github.com/OnnaSoft/lipstick/server/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 )
@@ -26,72 +24,25 @@ func configureRouter(manager *Manager) {
 	router := &router{manager: manager}
 	r := gin.New()
 
-	r.GET("/traffic", router.getTraffic)
+	r.GET(trafficPath, router.getTraffic)
+	r.GET(legacyTrafficPath, router.getTraffic)
 	r.GET("/health", router.health)
 	r.GET("/", router.upgrade)
 
 	manager.engine = r
 }
 
-func (r *router) getTraffic(c *gin.Context) {
-	host := c.Request.Host
-	domainName := strings.Split(host, ":")[0]
-
-	fromParam := c.Query("from")
-	toParam := c.Query("to")
-
-	from, err := time.Parse("2006-01-02", fromParam)
-	if err != nil {
-		logger.Default.Error("Invalid 'from' parameter:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
-		return
-	}
-
-	to, err := time.Parse("2006-01-02", toParam)
-	if err != nil {
-		logger.Default.Error("Invalid 'to' parameter:", err)
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' parameter"})
-		return
-	}
-
-	to = to.Add(23*time.Hour + 59*time.Minute + 59*time.Second)
-
-	conf, err := config.GetConfig()
-	if err != nil {
-		logger.Default.Error("Error getting configuration:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get config"})
-		return
-	}
-
-	connection, err := db.GetConnection(conf.Database)
-	if err != nil {
-		logger.Default.Error("Error connecting to database:", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to connect to database"})
-		return
-	}
-
-	var consumptions []db.DailyConsumption
-	connection.Where("domain = ? AND date >= ? AND date <= ?", domainName, from, to).Find(&consumptions)
-
-	logger.Default.Info("Traffic data retrieved for domain:", domainName)
-	c.JSON(http.StatusOK, gin.H{
-		"domain":       domainName,
-		"from":         fromParam,
-		"to":           toParam,
-		"consumptions": consumptions,
-	})
-}
-
 func (r *router) health(c *gin.Context) {
 	host := c.Request.Host
 	domainName := strings.Split(host, ":")[0]
 
-	if domain, ok := r.manager.GetHub(domainName); ok {
+	if domain, ok := r.manager.ResolveHub(domainName); ok {
 		logger.Default.Info("Health check for active domain:", domainName)
 		c.JSON(http.StatusOK, gin.H{
-			"status":     "ok",
-			"domain":     domain.HubName,
-			"data_usage": domain.totalDataTransferred,
+			"status":               "ok",
+			"domain":               domain.HubName,
+			"data_usage":           domain.totalDataTransferred,
+			"rejected_connections": domain.rejectedConnections.Load(),
 		})
 		return
 	}
@@ -126,42 +77,62 @@ func (r *router) upgrade(c *gin.Context) {
 		return
 	}
 
-	host := c.Request.Host
-	domainName := strings.Split(host, ":")[0]
-	domain, err := r.manager.authManager.GetDomain(domainName)
-	if err != nil {
-		logger.Default.Error("Unable to get domain:", domainName, "Error:", err)
-		conn.Close()
-		return
+	var domain *auth.Domain
+	agentID := newAgentID()
+	viaWebhook := false
+	ephemeral := c.Request.Header.Get(ephemeralHeader) == "true"
+	if ephemeral {
+		domain, err = r.manager.createEphemeralDomain(c.Request.Header.Get("Authorization"))
+		if err != nil {
+			logger.Default.Error("Unable to create ephemeral tunnel:", err)
+			authFailures.Inc("agent")
+			conn.Close()
+			return
+		}
+	} else {
+		host := c.Request.Host
+		domainName := strings.Split(host, ":")[0]
+		domain, viaWebhook, err = r.manager.authorizeAgent(c.Request, domainName, agentID)
+		if err != nil {
+			logger.Default.Error("Agent not authorized for domain:", domainName, "Error:", err)
+			authFailures.Inc("agent")
+			conn.Close()
+			return
+		}
 	}
 
-	hub, ok := r.manager.GetHub(domain.Name)
-	if !ok {
-		hub = NewNetworkHub(
-			domain.Name,
-			r.manager.trafficManager,
-			64*1024,
-		)
-		r.manager.AddHub(domain.Name, hub)
-		go hub.listen()
-		logger.Default.Info("New hub created for domain:", domain.Name)
-	}
+	hub := r.manager.getOrCreateHub(domain.Name)
+	r.manager.hostnames.register(domain.Name, domain.Aliases, domain.Wildcards)
 
 	rw.WriteString("HTTP/1.1 200 OK\r\n")
 	rw.WriteString("Content-Type: text/plain\r\n")
+	if ephemeral {
+		rw.WriteString(publicURLHeader + ": " + r.manager.ephemeral.publicURL(domain.Name) + "\r\n")
+	}
 	rw.WriteString("\r\n")
 	if err := rw.Flush(); err != nil {
 		logger.Default.Error("Error flushing headers for upgrade:", err)
+		if ephemeral {
+			r.manager.ephemeral.remove(domain.Name)
+		}
 		return
 	}
 
 	logger.Default.Info("Connection upgraded for domain:", domain.Name)
 	notification := &ProxyNotificationConn{
+		ID:                       agentID,
 		Domain:                   domain.Name,
+		credential:               credential(c.Request),
+		webhook:                  viaWebhook,
 		conn:                     conn,
 		ReadWriter:               rw,
 		AllowMultipleConnections: domain.AllowMultipleConnections,
+		Routes:                   parseRoutesHeader(c.Request.Header.Get(routesHeader)),
+		bandwidth:                newBandwidth(domain.AgentUploadRate, domain.AgentDownloadRate),
 	}
 
-	hub.registerProxyNotificationConn <- notification
+	if !hub.register(notification) {
+		logger.Default.Error("Hub is shut down for domain:", domain.Name)
+		notification.Close()
+	}
 }
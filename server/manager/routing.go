@@ -0,0 +1,172 @@
+package manager
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+const routesHeader = "X-Lipstick-Routes"
+
+// visitor is a connection waiting for an agent, together with the routing
+// decisions taken before it was handed to the hub.
+type visitor struct {
+	*helper.RemoteConn
+	group       string
+	http        bool
+	settings    *auth.Domain
+	agent       *ProxyNotificationConn
+	createdAt   time.Time
+	releaseOnce sync.Once
+}
+
+// ticketMessage builds the line sent to agents: "addr:ticket:hostname:group".
+// Older agents only read the first two fields.
+func ticketMessage(addr, ticket, hostname, group string) string {
+	return addr + ":" + ticket + ":" + hostname + ":" + group
+}
+
+func parseTicketGroup(msg string) string {
+	parts := strings.SplitN(msg, ":", 4)
+	if len(parts) < 4 {
+		return ""
+	}
+	return parts[3]
+}
+
+func parseRoutesHeader(value string) []string {
+	routes := []string{}
+	for _, route := range strings.Split(value, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+func (p *ProxyNotificationConn) serves(group string) bool {
+	if group == "" {
+		return len(p.Routes) == 0
+	}
+	return slices.Contains(p.Routes, group)
+}
+
+// lookupDomain returns the stored settings of a hub's domain, or nil for hubs
+// without a domain record such as ephemeral tunnels. Any other error of the
+// domain store is returned, so that callers do not skip the access lists
+// and edge authentication of a domain they could not read.
+func (m *Manager) lookupDomain(hubName string) (*auth.Domain, error) {
+	if m.ephemeral != nil && m.ephemeral.has(hubName) {
+		return nil, nil
+	}
+
+	domain, err := m.authManager.GetDomain(hubName)
+	if errors.Is(err, auth.ErrNotFound) {
+		logger.Default.Debug("No domain settings for hub:", hubName)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return domain, nil
+}
+
+// storeDomain returns the name of the stored domain answering for hostname,
+// which may be the domain itself, one of its aliases or a match of its
+// wildcards, or hostname when no stored domain answers for it.
+func (m *Manager) storeDomain(hostname string) (string, error) {
+	if m.ephemeral != nil && m.ephemeral.has(hostname) {
+		return hostname, nil
+	}
+
+	domain, err := m.authManager.GetDomain(hostname)
+	if err == nil {
+		return domain.Name, nil
+	}
+	if !errors.Is(err, auth.ErrNotFound) {
+		return "", err
+	}
+
+	domains, err := m.authManager.GetDomains()
+	if err != nil {
+		return "", err
+	}
+	if name, ok := matchDomain(domains, hostname); ok {
+		return name, nil
+	}
+	return hostname, nil
+}
+
+// matchRoute returns the route with the longest path prefix matching req.
+func matchRoute(routes []auth.Route, req *http.Request) *auth.Route {
+	var best *auth.Route
+	for i := range routes {
+		route := &routes[i]
+		if !hasPathPrefix(req.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if route.Header != "" && req.Header.Get(route.Header) != route.HeaderValue {
+			continue
+		}
+		if best == nil || len(route.PathPrefix) > len(best.PathPrefix) {
+			best = route
+		}
+	}
+	return best
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
+
+// applyRoute prepares an HTTP request for a route: the prefix is stripped when
+// configured, and keep-alive is disabled so that every request on the
+// connection is routed on its own.
+func applyRoute(req *http.Request, route *auth.Route) {
+	if route != nil && route.StripPrefix {
+		path := strings.TrimPrefix(req.URL.Path, strings.TrimSuffix(route.PathPrefix, "/"))
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+	disableKeepAlive(req)
+}
+
+// disableKeepAlive asks the agent to close the connection after its response,
+// so that the next request of the visitor is handled on a new connection.
+// Upgrades keep the connection, which no longer carries requests.
+func disableKeepAlive(req *http.Request) {
+	if !strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") {
+		req.Header.Set("Connection", "close")
+	}
+}
+
+func requestHead(req *http.Request) []byte {
+	var buffer bytes.Buffer
+	fmt.Fprintf(&buffer, "%s %s %s\r\n", req.Method, req.URL.RequestURI(), req.Proto)
+	fmt.Fprintf(&buffer, "Host: %s\r\n", req.Host)
+	if len(req.TransferEncoding) > 0 {
+		fmt.Fprintf(&buffer, "Transfer-Encoding: %s\r\n", strings.Join(req.TransferEncoding, ", "))
+	}
+	req.Header.Write(&buffer)
+	buffer.WriteString("\r\n")
+	return buffer.Bytes()
+}
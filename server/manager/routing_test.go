@@ -0,0 +1,112 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+func TestHasPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         bool
+	}{
+		{"/v1", "/v1", true},
+		{"/v1/", "/v1", true},
+		{"/v1/users", "/v1", true},
+		{"/v1/users", "/v1/", true},
+		{"/v10", "/v1", false},
+		{"/v10/users", "/v1/", false},
+		{"/v", "/v1", false},
+		{"/anything", "", true},
+		{"/anything", "/", true},
+	}
+	for _, test := range tests {
+		if got := hasPathPrefix(test.path, test.prefix); got != test.want {
+			t.Errorf("hasPathPrefix(%q, %q) = %v, want %v", test.path, test.prefix, got, test.want)
+		}
+	}
+}
+
+func TestMatchRoute(t *testing.T) {
+	routes := []auth.Route{
+		{PathPrefix: "/", Group: "web"},
+		{PathPrefix: "/api", Group: "api"},
+		{PathPrefix: "/api/v2/", Group: "v2"},
+		{PathPrefix: "/api", Header: "X-Canary", HeaderValue: "1", Group: "canary"},
+	}
+	tests := []struct {
+		path   string
+		canary string
+		group  string
+	}{
+		{"/", "", "web"},
+		{"/apis", "", "web"},
+		{"/api", "", "api"},
+		{"/api/v2", "", "v2"},
+		{"/api/v20", "", "api"},
+		{"/api/users", "1", "api"},
+		{"/api/v2/users", "1", "v2"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		if test.canary != "" {
+			req.Header.Set("X-Canary", test.canary)
+		}
+		route := matchRoute(routes, req)
+		if route == nil || route.Group != test.group {
+			t.Errorf("matchRoute(%q) = %+v, want group %q", test.path, route, test.group)
+		}
+	}
+
+	// A header route is taken over the plain one of the same prefix only
+	// when listed first.
+	canaryFirst := []auth.Route{routes[3], routes[1]}
+	req := httptest.NewRequest(http.MethodGet, "/api/users", nil)
+	req.Header.Set("X-Canary", "1")
+	if route := matchRoute(canaryFirst, req); route == nil || route.Group != "canary" {
+		t.Errorf("matchRoute with the header = %+v, want canary", route)
+	}
+	req.Header.Set("X-Canary", "0")
+	if route := matchRoute(canaryFirst, req); route == nil || route.Group != "api" {
+		t.Errorf("matchRoute with another header value = %+v, want api", route)
+	}
+	if route := matchRoute(routes[1:3], httptest.NewRequest(http.MethodGet, "/other", nil)); route != nil {
+		t.Errorf("matchRoute of an unrouted path = %+v", route)
+	}
+}
+
+func TestApplyRoute(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		route      *auth.Route
+		connection string
+		path       string
+		uri        string
+		close      bool
+	}{
+		{name: "no route", target: "/v1/users", path: "/v1/users", uri: "/v1/users", close: true},
+		{name: "kept prefix", target: "/v1/users", route: &auth.Route{PathPrefix: "/v1"}, path: "/v1/users", uri: "/v1/users", close: true},
+		{name: "stripped prefix", target: "/v1/users?page=2", route: &auth.Route{PathPrefix: "/v1/", StripPrefix: true}, path: "/users", uri: "/users?page=2", close: true},
+		{name: "stripped to the root", target: "/v1", route: &auth.Route{PathPrefix: "/v1", StripPrefix: true}, path: "/", uri: "/", close: true},
+		{name: "upgrade", target: "/v1/ws", route: &auth.Route{PathPrefix: "/v1", StripPrefix: true}, connection: "Upgrade", path: "/ws", uri: "/ws"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			if test.connection != "" {
+				req.Header.Set("Connection", test.connection)
+			}
+			applyRoute(req, test.route)
+			if req.URL.Path != test.path || req.URL.RequestURI() != test.uri {
+				t.Errorf("path = %q, request URI = %q, want %q and %q", req.URL.Path, req.URL.RequestURI(), test.path, test.uri)
+			}
+			if closed := req.Header.Get("Connection") == "close"; closed != test.close {
+				t.Errorf("Connection = %q", req.Header.Get("Connection"))
+			}
+		})
+	}
+}
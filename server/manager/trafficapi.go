@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/traffic"
+	"github.com/gin-gonic/gin"
+)
+
+// trafficPath serves domain owners their own usage, and legacyTrafficPath
+// does the same for clients written before the API was versioned. Both must
+// be listed in the URLs CustomListener passes through to the router.
+const (
+	trafficPath       = "/api/v1/traffic"
+	legacyTrafficPath = "/traffic"
+)
+
+func credential(req *http.Request) string {
+	value := req.Header.Get("Authorization")
+	if token, ok := strings.CutPrefix(value, "Bearer "); ok {
+		return token
+	}
+	return value
+}
+
+// getTraffic returns the traffic of the domain named by the domain parameter
+// (or the Host header) between the from and to dates, inclusive, in the time
+// zone given by tz. The credential is the domain API key or a token with the
+// traffic:read scope.
+func (r *router) getTraffic(c *gin.Context) {
+	domainName := c.Query("domain")
+	if domainName == "" {
+		domainName = strings.Split(c.Request.Host, ":")[0]
+	}
+
+	domain, err := r.manager.authManager.GetDomain(domainName)
+	if err != nil || !domain.Authorize(credential(c.Request), auth.ScopeTrafficRead) {
+		authFailures.Inc("traffic")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	loc, err := time.LoadLocation(c.DefaultQuery("tz", "UTC"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'tz' parameter"})
+		return
+	}
+	from, err := time.ParseInLocation("2006-01-02", c.Query("from"), loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'from' parameter"})
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", c.Query("to"), loc)
+	if err != nil || to.Before(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'to' parameter"})
+		return
+	}
+
+	granularity := c.DefaultQuery("granularity", traffic.Daily)
+	buckets, err := traffic.Query(domain.Name, from, to.AddDate(0, 0, 1), granularity, loc)
+	if errors.Is(err, traffic.ErrGranularity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid 'granularity' parameter"})
+		return
+	}
+	if err != nil {
+		logger.Default.Error("Error querying traffic:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to get traffic"})
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" && strings.Contains(c.GetHeader("Accept"), "text/csv") {
+		format = "csv"
+	}
+	if format == "csv" {
+		writeTrafficCSV(c, buckets)
+		return
+	}
+
+	var totals traffic.Usage
+	rows := make([]gin.H, 0, len(buckets))
+	for _, bucket := range buckets {
+		totals.In += bucket.In
+		totals.Out += bucket.Out
+		rows = append(rows, gin.H{
+			"start":   bucket.Start.Format(time.RFC3339),
+			"ingress": bucket.In,
+			"egress":  bucket.Out,
+			"total":   bucket.Total(),
+		})
+	}
+
+	logger.Default.Info("Traffic data retrieved for domain:", domain.Name)
+	c.JSON(http.StatusOK, gin.H{
+		"domain":      domain.Name,
+		"from":        from.Format("2006-01-02"),
+		"to":          to.Format("2006-01-02"),
+		"timezone":    loc.String(),
+		"granularity": granularity,
+		"buckets":     rows,
+		"totals": gin.H{
+			"ingress": totals.In,
+			"egress":  totals.Out,
+			"total":   totals.Total(),
+		},
+	})
+}
+
+func writeTrafficCSV(c *gin.Context, buckets []traffic.Bucket) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"start", "ingress", "egress", "total"})
+	for _, bucket := range buckets {
+		w.Write([]string{
+			bucket.Start.Format(time.RFC3339),
+			strconv.FormatInt(bucket.In, 10),
+			strconv.FormatInt(bucket.Out, 10),
+			strconv.FormatInt(bucket.Total(), 10),
+		})
+	}
+	w.Flush()
+}
@@ -0,0 +1,35 @@
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OnnaSoft/lipstick/server/auth"
+)
+
+// The unversioned path predates the API and must keep working, behind the
+// same credentials.
+func TestTrafficPaths(t *testing.T) {
+	store := &stubStore{domains: map[string]*auth.Domain{
+		"example.com": {Name: "example.com", ApiKey: "example-key"},
+	}}
+	m := newTestManager(store)
+	configureRouter(m)
+
+	for _, path := range []string{trafficPath, legacyTrafficPath} {
+		for credential, want := range map[string]int{
+			"":            http.StatusUnauthorized,
+			"wrong-key":   http.StatusUnauthorized,
+			"example-key": http.StatusBadRequest, // authorized, but tz is invalid
+		} {
+			req := httptest.NewRequest(http.MethodGet, path+"?domain=example.com&tz=Nowhere/Nowhere", nil)
+			req.Header.Set("Authorization", credential)
+			rec := httptest.NewRecorder()
+			m.engine.ServeHTTP(rec, req)
+			if rec.Code != want {
+				t.Errorf("GET %s with credential %q = %d, want %d", path, credential, rec.Code, want)
+			}
+		}
+	}
+}
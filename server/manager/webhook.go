@@ -0,0 +1,74 @@
+package manager
+
+import (
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/OnnaSoft/lipstick/helper"
+	"github.com/OnnaSoft/lipstick/logger"
+	"github.com/OnnaSoft/lipstick/server/auth"
+	"github.com/OnnaSoft/lipstick/server/authhook"
+)
+
+var errAgentUnauthorized = errors.New("invalid agent credential")
+
+// authorizeAgent returns the domain an agent asks to serve when the domain
+// store accepts its credential or, failing that, the authorization webhook
+// does. Domains known only to the webhook are served with default settings.
+// It also reports whether the webhook accepted the agent.
+func (m *Manager) authorizeAgent(req *http.Request, name, agentID string) (*auth.Domain, bool, error) {
+	credential := credential(req)
+	domain, err := m.authManager.GetDomain(name)
+	if err == nil && domain.Authorize(credential, auth.ScopeAgentConnect) {
+		return domain, false, nil
+	}
+	if m.webhook == nil || (err != nil && !errors.Is(err, auth.ErrNotFound)) {
+		if err == nil {
+			err = errAgentUnauthorized
+		}
+		return nil, false, err
+	}
+
+	allowed, err := m.webhook.AuthorizeAgent(name, credential, authhook.Agent{
+		ID:        agentID,
+		Address:   req.RemoteAddr,
+		UserAgent: req.UserAgent(),
+		Routes:    parseRoutesHeader(req.Header.Get(routesHeader)),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if !allowed {
+		return nil, false, errAgentUnauthorized
+	}
+	if domain == nil {
+		domain = &auth.Domain{Name: name}
+	}
+	return domain, true, nil
+}
+
+// visitorAuthorized asks the authorization webhook, when it checks visitors,
+// whether the visitor of hostname may reach the agents of hubName. Visitors
+// are refused when the webhook cannot be reached.
+func (m *Manager) visitorAuthorized(hubName, hostname, protocol string, addr net.Addr) bool {
+	if m.webhook == nil || !m.webhook.Visitors || (m.ephemeral != nil && m.ephemeral.has(hubName)) {
+		return true
+	}
+
+	ip, ok := helper.AddrIP(addr)
+	if !ok {
+		logger.Default.Error("Unable to get visitor IP for domain:", hubName, "Address:", addr)
+		return false
+	}
+	allowed, err := m.webhook.AuthorizeVisitor(hubName, authhook.Visitor{
+		Address:  ip.String(),
+		Hostname: hostname,
+		Protocol: protocol,
+	})
+	if err != nil {
+		logger.Default.Error("Authorization webhook failed for domain:", hubName, "Error:", err)
+		return false
+	}
+	return allowed
+}
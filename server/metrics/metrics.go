@@ -0,0 +1,225 @@
+// Package metrics keeps the server's counters and writes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Sample is one value of a metric, with its label values in the order the
+// metric declared its label names.
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+type collector interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics exposed by Handler.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// Write writes every metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+func (d *desc) sample(w io.Writer, name string, labels []string, extra string, value float64) {
+	fmt.Fprint(w, name)
+	if len(labels) > 0 || extra != "" {
+		pairs := make([]string, 0, len(labels)+1)
+		for i, label := range labels {
+			pairs = append(pairs, d.labels[i]+"="+strconv.Quote(label))
+		}
+		if extra != "" {
+			pairs = append(pairs, extra)
+		}
+		fmt.Fprint(w, "{"+strings.Join(pairs, ",")+"}")
+	}
+	fmt.Fprintf(w, " %s\n", formatFloat(value))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a monotonically increasing value, optionally split by labels.
+type Counter struct {
+	desc
+	mu     sync.Mutex
+	values map[string]*atomic.Int64
+	keys   map[string][]string
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		desc:   desc{name: name, help: help, kind: "counter", labels: labels},
+		values: make(map[string]*atomic.Int64),
+		keys:   make(map[string][]string),
+	}
+	Default.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) Add(n int64, labels ...string) {
+	key := strings.Join(labels, "\xff")
+
+	c.mu.Lock()
+	value, ok := c.values[key]
+	if !ok {
+		value = &atomic.Int64{}
+		c.values[key] = value
+		c.keys[key] = labels
+	}
+	c.mu.Unlock()
+
+	value.Add(n)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	c.mu.Unlock()
+
+	c.header(w)
+	for _, key := range keys {
+		c.mu.Lock()
+		labels, value := c.keys[key], c.values[key].Load()
+		c.mu.Unlock()
+		c.sample(w, c.name, labels, "", float64(value))
+	}
+}
+
+// Func reports values computed when the metrics are scraped.
+type Func struct {
+	desc
+	collect func() []Sample
+}
+
+// NewGaugeFunc registers a gauge whose samples are returned by collect.
+func NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) *Func {
+	f := &Func{desc: desc{name: name, help: help, kind: "gauge", labels: labels}, collect: collect}
+	Default.register(f)
+	return f
+}
+
+// NewCounterFunc registers a counter whose samples are returned by collect.
+func NewCounterFunc(name, help string, collect func() []Sample, labels ...string) *Func {
+	f := &Func{desc: desc{name: name, help: help, kind: "counter", labels: labels}, collect: collect}
+	Default.register(f)
+	return f
+}
+
+func (f *Func) write(w io.Writer) {
+	f.header(w)
+	for _, s := range f.collect() {
+		f.sample(w, f.name, s.Labels, "", s.Value)
+	}
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	desc
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, kind: "histogram"},
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+	Default.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	buckets := append([]uint64(nil), h.buckets...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	h.header(w)
+	for i, bound := range h.bounds {
+		h.sample(w, h.name+"_bucket", nil, "le="+strconv.Quote(formatFloat(bound)), float64(buckets[i]))
+	}
+	h.sample(w, h.name+"_bucket", nil, `le="+Inf"`, float64(count))
+	h.sample(w, h.name+"_sum", nil, "", sum)
+	h.sample(w, h.name+"_count", nil, "", float64(count))
+}
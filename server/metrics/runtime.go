@@ -0,0 +1,34 @@
+package metrics
+
+import "runtime"
+
+func one(value float64) []Sample {
+	return []Sample{{Value: value}}
+}
+
+func memStats() *runtime.MemStats {
+	stats := &runtime.MemStats{}
+	runtime.ReadMemStats(stats)
+	return stats
+}
+
+func init() {
+	NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() []Sample {
+		return one(float64(runtime.NumGoroutine()))
+	})
+	NewGaugeFunc("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.", func() []Sample {
+		return one(float64(memStats().Alloc))
+	})
+	NewGaugeFunc("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", func() []Sample {
+		return one(float64(memStats().HeapInuse))
+	})
+	NewGaugeFunc("go_memstats_sys_bytes", "Number of bytes obtained from the system.", func() []Sample {
+		return one(float64(memStats().Sys))
+	})
+	NewCounterFunc("go_gc_cycles_total", "Number of completed GC cycles.", func() []Sample {
+		return one(float64(memStats().NumGC))
+	})
+	NewCounterFunc("go_gc_pause_seconds_total", "Total time spent in GC stop-the-world pauses.", func() []Sample {
+		return one(float64(memStats().PauseTotalNs) / 1e9)
+	})
+}
@@ -0,0 +1,122 @@
+package traffic
+
+import (
+	"log"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+)
+
+const connectionLogBatch = 100
+
+// ConnectionLog persists finished visitor connections in batches. Entries are
+// dropped, not queued without bound, when the database falls behind.
+type ConnectionLog struct {
+	entries   chan db.ConnectionLog
+	retention int
+	stop      chan struct{}
+	stopped   chan struct{}
+}
+
+func NewConnectionLog(retention int) *ConnectionLog {
+	l := &ConnectionLog{
+		entries:   make(chan db.ConnectionLog, 10*connectionLogBatch),
+		retention: retention,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *ConnectionLog) Record(entry db.ConnectionLog) {
+	select {
+	case l.entries <- entry:
+	default:
+		log.Printf("Connection log full, dropping entry for %s", entry.Domain)
+	}
+}
+
+// Close saves the entries still queued.
+func (l *ConnectionLog) Close() {
+	close(l.stop)
+	<-l.stopped
+}
+
+func (l *ConnectionLog) run() {
+	defer close(l.stopped)
+	flushTicker := time.NewTicker(5 * time.Second)
+	defer flushTicker.Stop()
+	retentionTicker := time.NewTicker(time.Hour)
+	defer retentionTicker.Stop()
+
+	batch := make([]db.ConnectionLog, 0, connectionLogBatch)
+	for {
+		select {
+		case entry := <-l.entries:
+			batch = append(batch, entry)
+			if len(batch) >= connectionLogBatch {
+				batch = l.flush(batch)
+			}
+		case <-flushTicker.C:
+			batch = l.flush(batch)
+		case <-retentionTicker.C:
+			l.applyRetention()
+		case <-l.stop:
+			for {
+				select {
+				case entry := <-l.entries:
+					batch = append(batch, entry)
+				default:
+					l.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *ConnectionLog) flush(batch []db.ConnectionLog) []db.ConnectionLog {
+	if len(batch) == 0 {
+		return batch
+	}
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Printf("Error getting config: %v", err)
+		return batch[:0]
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		log.Printf("Error connecting to database: %v", err)
+		return batch[:0]
+	}
+
+	if err := connection.CreateInBatches(batch, connectionLogBatch).Error; err != nil {
+		log.Printf("Error saving %d connection log entries: %v", len(batch), err)
+	}
+	return batch[:0]
+}
+
+func (l *ConnectionLog) applyRetention() {
+	if l.retention <= 0 {
+		return
+	}
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Printf("Error getting config: %v", err)
+		return
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		log.Printf("Error connecting to database: %v", err)
+		return
+	}
+
+	cutoff := time.Now().UTC().AddDate(0, 0, -l.retention)
+	if err := connection.Where("started_at < ?", cutoff).Delete(&db.ConnectionLog{}).Error; err != nil {
+		log.Printf("Error deleting connection log entries: %v", err)
+	}
+}
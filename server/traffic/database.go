@@ -7,12 +7,145 @@ import (
 	"github.com/OnnaSoft/lipstick/server/config"
 	"github.com/OnnaSoft/lipstick/server/db"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-func (tm *TrafficManager) updateDatabase(domain string, traffic int64) {
+// DatabaseSink writes the counters into the hourly, daily and monthly tables
+// read by the traffic API and the quota checks.
+type DatabaseSink struct{}
+
+func NewDatabaseSink() *DatabaseSink {
+	return &DatabaseSink{}
+}
+
+func (s *DatabaseSink) Name() string {
+	return "database"
+}
+
+func (s *DatabaseSink) Close() error {
+	return nil
+}
+
+// Write adds the usage to the hourly buckets, rolls it up into the daily and
+// monthly totals and adds the request metrics, all in one transaction with a
+// single upsert per table.
+func (s *DatabaseSink) Write(batch Batch) error {
 	conf, err := config.GetConfig()
 	if err != nil {
-		log.Fatalf("Error getting config: %v", err)
+		return err
+	}
+
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		return err
+	}
+
+	hourly := make([]db.HourlyConsumption, 0, len(batch.Usage))
+	daily := make(map[dayKey]*db.DailyConsumption)
+	monthly := make(map[monthKey]*db.MonthlyConsumption)
+	for _, record := range batch.Usage {
+		hourly = append(hourly, db.HourlyConsumption{
+			Domain: record.Domain, Hour: record.Hour, BytesIn: record.BytesIn, BytesOut: record.BytesOut,
+		})
+
+		date := record.Hour.Truncate(24 * time.Hour)
+		month := Month(date)
+
+		day, ok := daily[dayKey{record.Domain, date}]
+		if !ok {
+			day = &db.DailyConsumption{Domain: record.Domain, Date: date, Month: month}
+			daily[dayKey{record.Domain, date}] = day
+		}
+		day.BytesIn += record.BytesIn
+		day.BytesOut += record.BytesOut
+		day.BytesUsed += record.BytesIn + record.BytesOut
+
+		total, ok := monthly[monthKey{record.Domain, month}]
+		if !ok {
+			total = &db.MonthlyConsumption{Domain: record.Domain, Month: month}
+			monthly[monthKey{record.Domain, month}] = total
+		}
+		total.BytesIn += record.BytesIn
+		total.BytesOut += record.BytesOut
+		total.BytesUsed += record.BytesIn + record.BytesOut
+	}
+
+	return connection.Transaction(func(tx *gorm.DB) error {
+		if err := upsert(tx, hourly, []string{"domain", "hour"}, "bytes_in", "bytes_out"); err != nil {
+			return err
+		}
+		if err := upsert(tx, values(daily), []string{"domain", "date"}, "bytes_used", "bytes_in", "bytes_out"); err != nil {
+			return err
+		}
+		if err := upsert(tx, values(monthly), []string{"domain", "month"}, "bytes_used", "bytes_in", "bytes_out"); err != nil {
+			return err
+		}
+		return saveRequests(tx, batch.Requests, batch.Latency)
+	})
+}
+
+type dayKey struct {
+	domain string
+	date   time.Time
+}
+
+type monthKey struct {
+	domain string
+	month  string
+}
+
+func values[K comparable, V any](m map[K]*V) []V {
+	rows := make([]V, 0, len(m))
+	for _, row := range m {
+		rows = append(rows, *row)
+	}
+	return rows
+}
+
+// upsertBatch bounds the rows sent in one statement, well below the
+// parameter limits of the databases.
+const upsertBatch = 500
+
+// upsert inserts rows, adding the given columns to the existing row instead
+// when one already holds the same keys. rows must not repeat a key.
+func upsert[T any](tx *gorm.DB, rows []T, keys []string, columns ...string) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	return tx.Clauses(accumulate(tx.Dialector.Name(), keys, columns...)).CreateInBatches(rows, upsertBatch).Error
+}
+
+// accumulate is the ON CONFLICT clause that adds the inserted values of
+// columns to the row already stored under keys. MySQL, which has no excluded
+// table, reads the inserted values with VALUES().
+func accumulate(dialect string, keys []string, columns ...string) clause.OnConflict {
+	conflict := clause.OnConflict{Columns: make([]clause.Column, 0, len(keys))}
+	for _, key := range keys {
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: key})
+	}
+
+	set := make(clause.Set, 0, len(columns)+1)
+	for _, column := range columns {
+		current := clause.Column{Table: clause.CurrentTable, Name: column}
+		value := gorm.Expr("? + ?", current, clause.Column{Table: "excluded", Name: column})
+		if dialect == "mysql" {
+			value = gorm.Expr("? + VALUES(?)", current, clause.Column{Name: column})
+		}
+		set = append(set, clause.Assignment{Column: clause.Column{Name: column}, Value: value})
+	}
+	set = append(set, clause.Assignment{
+		Column: clause.Column{Name: "updated_at"},
+		Value:  clause.Column{Table: "excluded", Name: "updated_at"},
+	})
+	conflict.DoUpdates = set
+	return conflict
+}
+
+// applyRetention deletes the traffic buckets older than configured.
+func (tm *TrafficManager) applyRetention() {
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Printf("Error getting config: %v", err)
 		return
 	}
 
@@ -22,31 +155,53 @@ func (tm *TrafficManager) updateDatabase(domain string, traffic int64) {
 		return
 	}
 
-	today := time.Now().Truncate(24 * time.Hour)
-	month := today.Format("2006-01")
+	now := time.Now().UTC()
+	retention := conf.Traffic
+	if retention.HourlyRetention > 0 {
+		cutoff := now.AddDate(0, 0, -retention.HourlyRetention).Truncate(time.Hour)
+		if err := connection.Where("hour < ?", cutoff).Delete(&db.HourlyConsumption{}).Error; err != nil {
+			log.Printf("Error deleting hourly traffic: %v", err)
+		}
+	}
+	if retention.DailyRetention > 0 {
+		cutoff := now.AddDate(0, 0, -retention.DailyRetention).Truncate(24 * time.Hour)
+		for _, model := range []interface{}{&db.DailyConsumption{}, &db.DailyRequests{}, &db.DailyLatency{}} {
+			if err := connection.Where("date < ?", cutoff).Delete(model).Error; err != nil {
+				log.Printf("Error deleting daily traffic: %v", err)
+			}
+		}
+	}
+	if retention.MonthlyRetention > 0 {
+		cutoff := Month(now.AddDate(0, -retention.MonthlyRetention, 0))
+		if err := connection.Where("month < ?", cutoff).Delete(&db.MonthlyConsumption{}).Error; err != nil {
+			log.Printf("Error deleting monthly traffic: %v", err)
+		}
+	}
+}
 
-	var dailyConsumption db.DailyConsumption
-	err = connection.Where("domain = ? AND date = ?", domain, today).First(&dailyConsumption).Error
+// Month returns the accounting month t belongs to, as stored in
+// DailyConsumption.
+func Month(t time.Time) string {
+	return t.Truncate(24 * time.Hour).Format("2006-01")
+}
 
+// MonthlyUsage adds up the bytes recorded for domain in month across every
+// server sharing the database.
+func MonthlyUsage(domain string, month string) (int64, error) {
+	conf, err := config.GetConfig()
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			newConsumption := db.DailyConsumption{
-				Domain:    domain,
-				Date:      today,
-				Month:     month,
-				BytesUsed: traffic,
-			}
-			if createErr := connection.Create(&newConsumption).Error; createErr != nil {
-				log.Printf("Error creating DailyConsumption: %v", createErr)
-			}
-		} else {
-			log.Printf("Error querying DailyConsumption: %v", err)
-		}
-		return
+		return 0, err
 	}
 
-	tx := connection.Model(&dailyConsumption).Update("bytes_used", gorm.Expr("bytes_used + ?", traffic))
-	if tx.Error != nil {
-		log.Printf("Error updating DailyConsumption: %v", tx.Error)
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		return 0, err
 	}
+
+	var total int64
+	err = connection.Model(&db.DailyConsumption{}).
+		Where("domain = ? AND month = ?", domain, month).
+		Select("COALESCE(SUM(bytes_used), 0)").
+		Scan(&total).Error
+	return total, err
 }
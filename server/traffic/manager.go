@@ -1,66 +1,265 @@
 package traffic
 
 import (
+	"log"
 	"sync"
 	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/metrics"
+)
+
+const (
+	flushInterval = 5 * time.Second
+	maxBackoff    = 5 * time.Minute
+	closeAttempts = 3
 )
 
+// Usage holds the bytes sent to agents (In) and to visitors (Out).
+type Usage struct {
+	In  int64
+	Out int64
+}
+
+func (u Usage) Total() int64 {
+	return u.In + u.Out
+}
+
+var flushDuration = metrics.NewHistogram("lipstick_traffic_flush_duration_seconds",
+	"Time spent saving traffic counters to the sinks.",
+	[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+
+var flushFailures = metrics.NewCounter("lipstick_traffic_flush_failures_total",
+	"Traffic flushes that failed and were kept in memory for a retry.", "sink")
+
+// usageKey identifies the hourly bucket traffic was seen in, so that counters
+// kept for a retry are still saved in the hour, day and month they belong to.
+type usageKey struct {
+	domain string
+	hour   time.Time
+}
+
+// counters are the traffic and request figures collected between flushes.
+type counters struct {
+	usage     map[usageKey]Usage
+	requests  map[requestKey]requestStats
+	latencies map[latencyKey]int64
+}
+
+func newCounters() *counters {
+	return &counters{
+		usage:     make(map[usageKey]Usage),
+		requests:  make(map[requestKey]requestStats),
+		latencies: make(map[latencyKey]int64),
+	}
+}
+
+func (c *counters) empty() bool {
+	return len(c.usage) == 0 && len(c.requests) == 0 && len(c.latencies) == 0
+}
+
+func (c *counters) merge(other *counters) {
+	for key, u := range other.usage {
+		current := c.usage[key]
+		current.In += u.In
+		current.Out += u.Out
+		c.usage[key] = current
+	}
+	for key, stats := range other.requests {
+		current := c.requests[key]
+		current.requests += stats.requests
+		current.latencyMs += stats.latencyMs
+		c.requests[key] = current
+	}
+	for key, count := range other.latencies {
+		c.latencies[key] += count
+	}
+}
+
+// sinkState holds what a sink has not saved yet and when to try again, so
+// that a failing sink neither loses data nor holds back the others. The batch
+// it failed to save is kept as it was, and the counters collected meanwhile
+// go in the next one.
+type sinkState struct {
+	sink     TrafficSink
+	pending  *counters
+	failed   *Batch
+	failures int
+	retryAt  time.Time
+}
+
+// flush sends the failed batch again, then the pending counters, unless the
+// sink is backing off.
+func (s *sinkState) flush(force bool) error {
+	if (s.failed == nil && s.pending.empty()) || (!force && time.Now().Before(s.retryAt)) {
+		return nil
+	}
+
+	batch := s.failed
+	if batch == nil {
+		next := s.pending.batch()
+		s.pending = newCounters()
+		batch = &next
+	}
+	err := s.sink.Write(*batch)
+	if err == nil {
+		retried := s.failed != nil
+		s.failed = nil
+		s.failures = 0
+		s.retryAt = time.Time{}
+		if retried {
+			return s.flush(force)
+		}
+		return nil
+	}
+
+	s.failed = batch
+	s.failures++
+	backoff := maxBackoff
+	if s.failures < 10 {
+		backoff = min(flushInterval<<(s.failures-1), maxBackoff)
+	}
+	s.retryAt = time.Now().Add(backoff)
+	flushFailures.Inc(s.sink.Name())
+	log.Printf("Error saving traffic to %s, retrying in %s: %v", s.sink.Name(), backoff, err)
+	return err
+}
+
 type TrafficManager struct {
-	mu          sync.Mutex
-	trafficData map[string]int64
-	threshold   int64
-	dbTicker    *time.Ticker
-	stopChan    chan struct{}
+	mu              sync.Mutex
+	flushMu         sync.Mutex
+	current         *counters
+	sinks           []*sinkState
+	threshold       int64
+	dbTicker        *time.Ticker
+	retentionTicker *time.Ticker
+	stopChan        chan struct{}
 }
 
+// NewTrafficManager sends the counters to the sinks configured under
+// traffic.sinks.
 func NewTrafficManager(threshold int64) *TrafficManager {
+	conf, err := config.GetConfig()
+	if err != nil {
+		log.Fatalf("Error getting config: %v", err)
+	}
+
+	sinks, err := NewSinks(conf.Traffic.Sinks, conf.Nats.URL)
+	if err != nil {
+		log.Fatalf("Error configuring traffic sinks: %v", err)
+	}
+	return NewTrafficManagerWithSinks(threshold, sinks...)
+}
+
+func NewTrafficManagerWithSinks(threshold int64, sinks ...TrafficSink) *TrafficManager {
 	manager := &TrafficManager{
-		trafficData: make(map[string]int64),
-		threshold:   threshold,
-		dbTicker:    time.NewTicker(5 * time.Second),
-		stopChan:    make(chan struct{}),
+		current:         newCounters(),
+		threshold:       threshold,
+		dbTicker:        time.NewTicker(flushInterval),
+		retentionTicker: time.NewTicker(time.Hour),
+		stopChan:        make(chan struct{}),
+	}
+	for _, sink := range sinks {
+		manager.sinks = append(manager.sinks, &sinkState{sink: sink, pending: newCounters()})
 	}
 	go manager.run()
 	return manager
 }
 
-func (tm *TrafficManager) AddTraffic(domain string, bytes int64) {
+func (tm *TrafficManager) AddTraffic(domain string, ingress, egress int64) {
+	key := usageKey{domain: domain, hour: time.Now().Truncate(time.Hour)}
+
 	tm.mu.Lock()
 	defer tm.mu.Unlock()
 
-	tm.trafficData[domain] += bytes
+	usage := tm.current.usage[key]
+	usage.In += ingress
+	usage.Out += egress
+	tm.current.usage[key] = usage
 }
 
 func (tm *TrafficManager) run() {
 	for {
 		select {
 		case <-tm.dbTicker.C:
-			tm.saveAllToDatabase()
+			start := time.Now()
+			tm.flush(false)
+			flushDuration.Observe(time.Since(start).Seconds())
+		case <-tm.retentionTicker.C:
+			if tm.usesDatabase() {
+				tm.applyRetention()
+			}
 		case <-tm.stopChan:
 			tm.dbTicker.Stop()
+			tm.retentionTicker.Stop()
 			return
 		}
 	}
 }
 
-func (tm *TrafficManager) saveAllToDatabase() {
-	tm.mu.Lock()
-	dataToSave := make(map[string]int64)
-	for domain, bytes := range tm.trafficData {
-		if bytes > 0 {
-			dataToSave[domain] = bytes
-			tm.trafficData[domain] = 0
+func (tm *TrafficManager) usesDatabase() bool {
+	for _, state := range tm.sinks {
+		if _, ok := state.sink.(*DatabaseSink); ok {
+			return true
 		}
 	}
+	return false
+}
+
+// Flush sends every pending counter to the sinks right away, ignoring their
+// backoff. Counters a sink failed to save are kept for its next flush.
+func (tm *TrafficManager) Flush() error {
+	return tm.flush(true)
+}
+
+func (tm *TrafficManager) flush(force bool) error {
+	tm.flushMu.Lock()
+	defer tm.flushMu.Unlock()
+
+	tm.mu.Lock()
+	collected := tm.current
+	tm.current = newCounters()
 	tm.mu.Unlock()
 
-	for domain, traffic := range dataToSave {
-		tm.updateDatabase(domain, traffic)
+	errs := make([]error, len(tm.sinks))
+	var wg sync.WaitGroup
+	for i, state := range tm.sinks {
+		state.pending.merge(collected)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = state.flush(force)
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (tm *TrafficManager) Close() {
+// Close stops the periodic flushes, makes a last attempt to save the pending
+// counters and closes the sinks.
+func (tm *TrafficManager) Close() error {
 	close(tm.stopChan)
 
-	tm.saveAllToDatabase()
+	var err error
+	for attempt := 0; attempt < closeAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = tm.Flush(); err == nil {
+			break
+		}
+	}
+
+	for _, state := range tm.sinks {
+		if closeErr := state.sink.Close(); closeErr != nil {
+			log.Printf("Error closing traffic sink %s: %v", state.sink.Name(), closeErr)
+		}
+	}
+	return err
 }
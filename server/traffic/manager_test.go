@@ -0,0 +1,117 @@
+package traffic
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink keeps every batch it is given and fails the first failures.
+type recordingSink struct {
+	failures int
+	batches  []Batch
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+func (s *recordingSink) Close() error { return nil }
+
+func (s *recordingSink) Write(batch Batch) error {
+	s.batches = append(s.batches, batch)
+	if len(s.batches) <= s.failures {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func usage(domain string, in, out int64) *counters {
+	c := newCounters()
+	c.usage[usageKey{domain: domain, hour: time.Now().Truncate(time.Hour)}] = Usage{In: in, Out: out}
+	return c
+}
+
+func TestRetriedBatchKeepsItsID(t *testing.T) {
+	sink := &recordingSink{failures: 2}
+	state := &sinkState{sink: sink, pending: newCounters()}
+
+	state.pending.merge(usage("example.com", 10, 20))
+	if err := state.flush(true); err == nil {
+		t.Fatal("the failed write was not reported")
+	}
+	state.pending.merge(usage("example.org", 1, 2))
+	if err := state.flush(false); err != nil || len(sink.batches) != 1 {
+		t.Fatalf("a backing off sink was written: %v, %d batches", err, len(sink.batches))
+	}
+	if err := state.flush(true); err == nil {
+		t.Fatal("the second failed write was not reported")
+	}
+	state.pending.merge(usage("example.org", 3, 4))
+	if err := state.flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.batches) != 4 {
+		t.Fatalf("got %d batches, want 4", len(sink.batches))
+	}
+	first := sink.batches[0]
+	if first.ID == "" || len(first.Usage) != 1 || first.Usage[0].Domain != "example.com" {
+		t.Fatalf("first batch = %+v", first)
+	}
+	for _, retried := range sink.batches[1:3] {
+		if !reflect.DeepEqual(retried, first) {
+			t.Errorf("retried batch = %+v, want %+v", retried, first)
+		}
+	}
+	next := sink.batches[3]
+	if next.ID == first.ID {
+		t.Error("the counters collected during the retries reused the batch ID")
+	}
+	if len(next.Usage) != 1 || next.Usage[0].Domain != "example.org" || next.Usage[0].BytesIn != 4 || next.Usage[0].BytesOut != 6 {
+		t.Errorf("next batch = %+v", next)
+	}
+	if !state.pending.empty() || state.failed != nil {
+		t.Error("the delivered counters are still pending")
+	}
+}
+
+func TestWebhookRetriesWithTheSameID(t *testing.T) {
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var batch Batch
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Errorf("webhook body %q: %v", body, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, batch.ID)
+		if len(ids) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	sink, err := NewWebhookSink(server.URL, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := &sinkState{sink: sink, pending: usage("example.com", 10, 20)}
+	if err := state.flush(true); err == nil {
+		t.Fatal("the 503 was not reported")
+	}
+	if err := state.flush(true); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ids) != 2 || ids[0] == "" || ids[0] != ids[1] {
+		t.Fatalf("webhook received ids %q, want the same one twice", ids)
+	}
+}
@@ -0,0 +1,55 @@
+package traffic
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultNatsSubject = "lipstick.traffic"
+	natsFlushTimeout   = 5 * time.Second
+)
+
+// NatsSink publishes each batch as a JSON message on a NATS subject.
+type NatsSink struct {
+	subject string
+	conn    *nats.Conn
+}
+
+func NewNatsSink(url, subject string) (*NatsSink, error) {
+	if subject == "" {
+		subject = defaultNatsSubject
+	}
+
+	// The first connection may fail while NATS starts; writes are retried.
+	conn, err := nats.Connect(url, nats.RetryOnFailedConnect(true), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, err
+	}
+	return &NatsSink{subject: subject, conn: conn}, nil
+}
+
+func (s *NatsSink) Name() string {
+	return "nats:" + s.subject
+}
+
+// Write waits for the server to receive the batch, so that a lost
+// connection is reported and the batch retried.
+func (s *NatsSink) Write(batch Batch) error {
+	message, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+
+	if err := s.conn.Publish(s.subject, message); err != nil {
+		return err
+	}
+	return s.conn.FlushTimeout(natsFlushTimeout)
+}
+
+func (s *NatsSink) Close() error {
+	s.conn.Close()
+	return nil
+}
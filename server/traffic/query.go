@@ -0,0 +1,89 @@
+package traffic
+
+import (
+	"errors"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+	"github.com/OnnaSoft/lipstick/server/db"
+)
+
+// Granularities accepted by Query.
+const (
+	Hourly  = "hour"
+	Daily   = "day"
+	Monthly = "month"
+)
+
+var ErrGranularity = errors.New("granularity must be hour, day or month")
+
+// Bucket is the traffic of a domain during the period starting at Start.
+type Bucket struct {
+	Start time.Time
+	Usage
+}
+
+// Query returns the traffic of domain in [from, to) grouped by granularity,
+// with buckets aligned to loc. Daily and monthly buckets outside UTC are
+// computed from the hourly ones, so they only reach back as far as
+// traffic.hourly_retention.
+func Query(domain string, from, to time.Time, granularity string, loc *time.Location) ([]Bucket, error) {
+	if granularity != Hourly && granularity != Daily && granularity != Monthly {
+		return nil, ErrGranularity
+	}
+
+	conf, err := config.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	connection, err := db.GetConnection(conf.Database)
+	if err != nil {
+		return nil, err
+	}
+
+	from, to = from.UTC(), to.UTC()
+
+	var buckets []Bucket
+	switch {
+	case granularity == Daily && loc == time.UTC:
+		var rows []db.DailyConsumption
+		err = connection.Where("domain = ? AND date >= ? AND date < ?", domain, from, to).Order("date").Find(&rows).Error
+		for _, row := range rows {
+			buckets = append(buckets, Bucket{Start: row.Date.UTC(), Usage: Usage{In: row.BytesIn, Out: row.BytesOut}})
+		}
+	case granularity == Monthly && loc == time.UTC:
+		var rows []db.MonthlyConsumption
+		err = connection.Where("domain = ? AND month >= ? AND month <= ?", domain, Month(from), Month(to.Add(-time.Nanosecond))).
+			Order("month").Find(&rows).Error
+		for _, row := range rows {
+			start, parseErr := time.Parse("2006-01", row.Month)
+			if parseErr != nil {
+				continue
+			}
+			buckets = append(buckets, Bucket{Start: start, Usage: Usage{In: row.BytesIn, Out: row.BytesOut}})
+		}
+	default:
+		var rows []db.HourlyConsumption
+		err = connection.Where("domain = ? AND hour >= ? AND hour < ?", domain, from, to).Order("hour").Find(&rows).Error
+		for _, row := range rows {
+			start := bucketStart(row.Hour.In(loc), granularity)
+			if n := len(buckets); n > 0 && buckets[n-1].Start.Equal(start) {
+				buckets[n-1].In += row.BytesIn
+				buckets[n-1].Out += row.BytesOut
+				continue
+			}
+			buckets = append(buckets, Bucket{Start: start, Usage: Usage{In: row.BytesIn, Out: row.BytesOut}})
+		}
+	}
+	return buckets, err
+}
+
+func bucketStart(t time.Time, granularity string) time.Time {
+	switch granularity {
+	case Daily:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case Monthly:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	}
+	return t
+}
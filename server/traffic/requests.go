@@ -0,0 +1,99 @@
+package traffic
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/db"
+	"gorm.io/gorm"
+)
+
+// LatencyBuckets are the upper bounds, in milliseconds, of the latency
+// histogram kept for HTTP requests. Slower requests fall in the last bucket,
+// stored with an upper bound of -1.
+var LatencyBuckets = []int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+type requestKey struct {
+	domain      string
+	date        time.Time
+	method      string
+	statusClass string
+}
+
+type requestStats struct {
+	requests  int64
+	latencyMs int64
+}
+
+type latencyKey struct {
+	domain string
+	date   time.Time
+	le     int64
+}
+
+// AddRequest counts an HTTP request answered by an agent.
+func (tm *TrafficManager) AddRequest(domain, method string, status int, latency time.Duration) {
+	date := time.Now().Truncate(24 * time.Hour)
+	key := requestKey{domain: domain, date: date, method: normalizeMethod(method), statusClass: StatusClass(status)}
+	ms := latency.Milliseconds()
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+
+	stats := tm.current.requests[key]
+	stats.requests++
+	stats.latencyMs += ms
+	tm.current.requests[key] = stats
+	tm.current.latencies[latencyKey{domain: domain, date: date, le: latencyBucket(ms)}]++
+}
+
+// StatusClass groups status codes as "2xx", "4xx" and so on.
+func StatusClass(status int) string {
+	if status < 100 || status > 599 {
+		return "other"
+	}
+	return strconv.Itoa(status/100) + "xx"
+}
+
+func normalizeMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "OTHER"
+}
+
+func latencyBucket(ms int64) int64 {
+	for _, le := range LatencyBuckets {
+		if ms <= le {
+			return le
+		}
+	}
+	return -1
+}
+
+// saveRequests adds the request counters to their daily rows.
+func saveRequests(tx *gorm.DB, requests []RequestRecord, latencies []LatencyRecord) error {
+	rows := make([]db.DailyRequests, 0, len(requests))
+	for _, record := range requests {
+		rows = append(rows, db.DailyRequests{
+			Domain: record.Domain, Date: record.Date, Month: Month(record.Date),
+			Method: record.Method, StatusClass: record.StatusClass,
+			Requests: record.Requests, LatencyMs: record.LatencyMs,
+		})
+	}
+	err := upsert(tx, rows, []string{"domain", "date", "method", "status_class"}, "requests", "latency_ms")
+	if err != nil {
+		return err
+	}
+
+	buckets := make([]db.DailyLatency, 0, len(latencies))
+	for _, record := range latencies {
+		buckets = append(buckets, db.DailyLatency{
+			Domain: record.Domain, Date: record.Date, Month: Month(record.Date), LeMs: record.LeMs, Requests: record.Requests,
+		})
+	}
+	return upsert(tx, buckets, []string{"domain", "date", "le_ms"}, "requests")
+}
@@ -0,0 +1,126 @@
+package traffic
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/OnnaSoft/lipstick/server/config"
+)
+
+// TrafficSink receives the counters collected by TrafficManager on every
+// flush. A Write that fails is retried later with the same batch, so sinks
+// must not keep a partially written one.
+type TrafficSink interface {
+	Name() string
+	Write(batch Batch) error
+	Close() error
+}
+
+// Batch is what a flush hands to the sinks. Each record is keyed by domain
+// and time bucket and appears at most once. Delivery is at least once: a
+// batch whose Write failed is sent again unchanged, with the same ID, even if
+// the sink did save it, so consumers should skip the IDs they already have.
+type Batch struct {
+	ID        string          `json:"id"`
+	FlushedAt time.Time       `json:"flushedAt"`
+	Usage     []UsageRecord   `json:"usage,omitempty"`
+	Requests  []RequestRecord `json:"requests,omitempty"`
+	Latency   []LatencyRecord `json:"latency,omitempty"`
+}
+
+// UsageRecord is the traffic of a domain in one hour.
+type UsageRecord struct {
+	Domain   string    `json:"domain"`
+	Hour     time.Time `json:"hour"`
+	BytesIn  int64     `json:"bytesIn"`
+	BytesOut int64     `json:"bytesOut"`
+}
+
+// RequestRecord counts the HTTP requests of a domain in one day by method
+// and status class.
+type RequestRecord struct {
+	Domain      string    `json:"domain"`
+	Date        time.Time `json:"date"`
+	Method      string    `json:"method"`
+	StatusClass string    `json:"statusClass"`
+	Requests    int64     `json:"requests"`
+	LatencyMs   int64     `json:"latencyMs"`
+}
+
+// LatencyRecord is one bucket of a domain's daily latency histogram.
+type LatencyRecord struct {
+	Domain   string    `json:"domain"`
+	Date     time.Time `json:"date"`
+	LeMs     int64     `json:"leMs"`
+	Requests int64     `json:"requests"`
+}
+
+func (c *counters) batch() Batch {
+	batch := Batch{ID: newBatchID(), FlushedAt: time.Now().UTC()}
+	for key, u := range c.usage {
+		if u.Total() == 0 {
+			continue
+		}
+		batch.Usage = append(batch.Usage, UsageRecord{Domain: key.domain, Hour: key.hour.UTC(), BytesIn: u.In, BytesOut: u.Out})
+	}
+	for key, stats := range c.requests {
+		batch.Requests = append(batch.Requests, RequestRecord{
+			Domain: key.domain, Date: key.date.UTC(), Method: key.method, StatusClass: key.statusClass,
+			Requests: stats.requests, LatencyMs: stats.latencyMs,
+		})
+	}
+	for key, count := range c.latencies {
+		batch.Latency = append(batch.Latency, LatencyRecord{Domain: key.domain, Date: key.date.UTC(), LeMs: key.le, Requests: count})
+	}
+	return batch
+}
+
+func newBatchID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewSinks builds the sinks described in the configuration. Without any,
+// the counters go to the database alone.
+func NewSinks(confs []config.TrafficSinkConfig, natsURL string) ([]TrafficSink, error) {
+	if len(confs) == 0 {
+		return []TrafficSink{NewDatabaseSink()}, nil
+	}
+
+	sinks := make([]TrafficSink, 0, len(confs))
+	for i, conf := range confs {
+		sink, err := newSink(conf, natsURL)
+		if err != nil {
+			for _, opened := range sinks {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("traffic sink %d: %w", i, err)
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+func newSink(conf config.TrafficSinkConfig, natsURL string) (TrafficSink, error) {
+	switch conf.Type {
+	case "database", "postgres":
+		return NewDatabaseSink(), nil
+	case "file":
+		return NewFileSink(conf.Path)
+	case "webhook":
+		timeout := time.Duration(conf.Timeout) * time.Second
+		return NewWebhookSink(conf.URL, conf.Headers, timeout)
+	case "nats":
+		url := conf.URL
+		if url == "" {
+			url = natsURL
+		}
+		return NewNatsSink(url, conf.Subject)
+	}
+	return nil, fmt.Errorf("unknown type %q", conf.Type)
+}